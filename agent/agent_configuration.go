@@ -10,16 +10,35 @@ type AgentConfiguration struct {
 	GitMirrorsPath             string
 	GitMirrorsLockTimeout      int
 	GitMirrorsSkipUpdate       bool
+	GitLFSStoragePath          string
+	EnvProvenanceFile          string
 	PluginsPath                string
+	PluginsStorePath           string
+	JobTmpdirRoot              string
 	GitCloneFlags              string
 	GitCloneMirrorFlags        string
 	GitCleanFlags              string
 	GitFetchFlags              string
+	GitCheckoutMode            string
+	GitCheckoutStrategy        string
+	GitVerifySignatures        string
+	GitVerifySignaturesSince   string
+	GitAllowedSignersFile      string
+	GitGPGKeyring              string
+	GitCredentials             []string
+	GitCredentialsFile         string
 	GitSubmodules              bool
 	SSHKeyscan                 bool
 	CommandEval                bool
+	CommandAllowlist           string
 	PluginsEnabled             bool
 	PluginValidation           bool
+	PluginsLock                bool
+	PluginsLockfile            string
+	PluginsPolicyFile          string
+	JobPolicyFile              string
+	HookTimeouts               []string
+	HookFailurePolicies        []string
 	LocalHooksEnabled          bool
 	RunInPty                   bool
 	TimestampLines             bool
@@ -370,9 +370,15 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 
 			// Upload the artifact and then set the state depending
 			// on whether or not it passed. We'll retry the upload
-			// a couple of times before giving up.
+			// a couple of times before giving up, unless the
+			// uploader retries it itself.
+			attempts := 10
+			if _, ok := uploader.(retryingUploader); ok {
+				attempts = 1
+			}
+
 			err = roko.NewRetrier(
-				roko.WithMaxAttempts(10),
+				roko.WithMaxAttempts(attempts),
 				roko.WithStrategy(roko.Constant(5*time.Second)),
 			).Do(func(r *roko.Retrier) error {
 				err := uploader.Upload(artifact)
@@ -389,6 +395,10 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 			if err != nil {
 				a.logger.Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
 
+				if aborter, ok := uploader.(abortingUploader); ok {
+					aborter.abort(artifact)
+				}
+
 				// Track the error that was raised. We need to
 				// acquire a lock since we mutate the errors
 				// slice in multiple routines.
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// fakeGCS is an in-memory Google Cloud Storage, enough of one for the
+// artifact uploader
+type fakeGCS struct {
+	mu         sync.Mutex
+	buckets    map[string]map[string]*fakeGCSObject
+	generation int64
+
+	// FailUpload decides whether uploads of an object fail
+	FailUpload func(name string) bool
+
+	// The names of the objects that have been uploaded, in order
+	Uploaded []string
+}
+
+type fakeGCSObject struct {
+	storage.Object
+	data []byte
+}
+
+func newFakeGCS(buckets ...string) *fakeGCS {
+	s := &fakeGCS{buckets: map[string]map[string]*fakeGCSObject{}}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string]*fakeGCSObject{}
+	}
+	return s
+}
+
+// Object returns an object, and whether it exists
+func (s *fakeGCS) Object(bucket, name string) (*fakeGCSObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.buckets[bucket][name]
+	return object, ok
+}
+
+// Names returns the names of the objects in a bucket
+func (s *fakeGCS) Names(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.buckets[bucket] {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *fakeGCS) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload := strings.HasPrefix(req.URL.Path, "/upload")
+	path := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/upload"), "/storage/v1/b/")
+	bucket, name, _ := strings.Cut(path, "/o")
+	name = strings.TrimPrefix(name, "/")
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeFakeGCSError(rw, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case upload && req.Method == http.MethodPost:
+		s.serveUpload(rw, req, bucket, objects)
+
+	case strings.HasSuffix(name, "/compose") && req.Method == http.MethodPost:
+		var compose storage.ComposeRequest
+		if err := json.NewDecoder(req.Body).Decode(&compose); err != nil {
+			writeFakeGCSError(rw, http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for _, source := range compose.SourceObjects {
+			object, ok := objects[source.Name]
+			if !ok || (source.Generation != 0 && source.Generation != object.Generation) {
+				writeFakeGCSError(rw, http.StatusNotFound)
+				return
+			}
+			data = append(data, object.data...)
+		}
+		compose.Destination.Name = strings.TrimSuffix(name, "/compose")
+		writeFakeGCSObject(rw, s.put(objects, bucket, *compose.Destination, data))
+
+	case name == "" && req.Method == http.MethodGet:
+		var result storage.Objects
+		for name, object := range objects {
+			if strings.HasPrefix(name, req.URL.Query().Get("prefix")) {
+				result.Items = append(result.Items, &object.Object)
+			}
+		}
+		sort.Slice(result.Items, func(i, j int) bool { return result.Items[i].Name < result.Items[j].Name })
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(result)
+
+	case req.Method == http.MethodGet:
+		object, ok := objects[name]
+		if !ok {
+			writeFakeGCSError(rw, http.StatusNotFound)
+			return
+		}
+		writeFakeGCSObject(rw, object)
+
+	case req.Method == http.MethodDelete:
+		if _, ok := objects[name]; !ok {
+			writeFakeGCSError(rw, http.StatusNotFound)
+			return
+		}
+		delete(objects, name)
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeFakeGCSError(rw, http.StatusNotImplemented)
+	}
+}
+
+// serveUpload handles uploads of an object's metadata and its data together,
+// as multipart/related requests
+func (s *fakeGCS) serveUpload(rw http.ResponseWriter, req *http.Request, bucket string, objects map[string]*fakeGCSObject) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || req.URL.Query().Get("uploadType") != "multipart" {
+		writeFakeGCSError(rw, http.StatusBadRequest)
+		return
+	}
+
+	parts := multipart.NewReader(req.Body, params["boundary"])
+
+	metadata, err := parts.NextPart()
+	if err != nil {
+		writeFakeGCSError(rw, http.StatusBadRequest)
+		return
+	}
+	var object storage.Object
+	if err := json.NewDecoder(metadata).Decode(&object); err != nil {
+		writeFakeGCSError(rw, http.StatusBadRequest)
+		return
+	}
+
+	media, err := parts.NextPart()
+	if err != nil {
+		writeFakeGCSError(rw, http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(media)
+	if err != nil {
+		writeFakeGCSError(rw, http.StatusBadRequest)
+		return
+	}
+
+	if s.FailUpload != nil && s.FailUpload(object.Name) {
+		writeFakeGCSError(rw, http.StatusServiceUnavailable)
+		return
+	}
+
+	s.Uploaded = append(s.Uploaded, object.Name)
+	writeFakeGCSObject(rw, s.put(objects, bucket, object, data))
+}
+
+func (s *fakeGCS) put(objects map[string]*fakeGCSObject, bucket string, object storage.Object, data []byte) *fakeGCSObject {
+	s.generation++
+	object.Bucket = bucket
+	object.Generation = s.generation
+	object.Size = uint64(len(data))
+	object.SelfLink = "https://www.googleapis.com/storage/v1/b/" + bucket + "/o/" + object.Name + "?generation=" + strconv.FormatInt(s.generation, 10)
+
+	stored := &fakeGCSObject{Object: object, data: data}
+	objects[object.Name] = stored
+	return stored
+}
+
+func writeFakeGCSObject(rw http.ResponseWriter, object *fakeGCSObject) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(object.Object)
+}
+
+func writeFakeGCSError(rw http.ResponseWriter, status int) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": http.StatusText(status)},
+	})
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeS3 is an in-memory S3 compatible store, enough of one for the artifact
+// uploaders and downloaders, which addresses buckets in the path
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]*fakeS3Upload
+
+	// FailPart decides whether uploads of a part of a multipart upload fail
+	FailPart func(part int) bool
+
+	// The parts of multipart uploads that have been uploaded, in order
+	UploadedParts []int
+}
+
+// fakeS3Upload is a multipart upload in progress
+type fakeS3Upload struct {
+	bucket, key string
+	parts       map[int][]byte
+}
+
+func newFakeS3(buckets ...string) *fakeS3 {
+	s := &fakeS3{buckets: map[string]map[string][]byte{}, uploads: map[string]*fakeS3Upload{}}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string][]byte{}
+	}
+	return s
+}
+
+// Object returns the contents of an object, and whether it exists
+func (s *fakeS3) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.buckets[bucket][key]
+	return data, ok
+}
+
+// Uploads returns how many multipart uploads are in progress
+func (s *fakeS3) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+func (s *fakeS3) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeFakeS3Error(rw, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := req.URL.Query()
+	_, startUpload := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case startUpload && req.Method == http.MethodPost:
+		uploadID := fmt.Sprintf("upload-%d", len(s.uploads)+1)
+		s.uploads[uploadID] = &fakeS3Upload{bucket: bucket, key: key, parts: map[int][]byte{}}
+		writeFakeS3XML(rw, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+
+	case uploadID != "":
+		s.serveMultipartUpload(rw, req, uploadID)
+
+	case key == "" && req.Method == http.MethodGet:
+		result := struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Name     string
+			Contents []struct{ Key string }
+		}{Name: bucket}
+		for key := range objects {
+			result.Contents = append(result.Contents, struct{ Key string }{key})
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		writeFakeS3XML(rw, result)
+
+	case key != "" && req.Method == http.MethodPut:
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeFakeS3Error(rw, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		objects[key] = data
+
+	case key != "" && req.Method == http.MethodGet:
+		data, ok := objects[key]
+		if !ok {
+			writeFakeS3Error(rw, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		rw.Write(data)
+
+	default:
+		writeFakeS3Error(rw, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) serveMultipartUpload(rw http.ResponseWriter, req *http.Request, uploadID string) {
+	upload, ok := s.uploads[uploadID]
+	if !ok {
+		writeFakeS3Error(rw, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		part, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+		if err != nil {
+			writeFakeS3Error(rw, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		if s.FailPart != nil && s.FailPart(part) {
+			writeFakeS3Error(rw, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeFakeS3Error(rw, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		upload.parts[part] = data
+		s.UploadedParts = append(s.UploadedParts, part)
+		rw.Header().Set("ETag", fakeS3ETag(data))
+
+	case http.MethodGet:
+		type fakeS3Part struct {
+			PartNumber int
+			ETag       string
+			Size       int
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			UploadId    string
+			IsTruncated bool
+			Parts       []fakeS3Part `xml:"Part"`
+		}{UploadId: uploadID}
+		for part, data := range upload.parts {
+			result.Parts = append(result.Parts, fakeS3Part{part, fakeS3ETag(data), len(data)})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		writeFakeS3XML(rw, result)
+
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(req.Body).Decode(&complete); err != nil {
+			writeFakeS3Error(rw, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for _, part := range complete.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || fakeS3ETag(data) != part.ETag {
+				writeFakeS3Error(rw, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+		}
+		s.buckets[upload.bucket][upload.key] = object
+		delete(s.uploads, uploadID)
+		writeFakeS3XML(rw, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+		}{Bucket: upload.bucket, Key: upload.key})
+
+	case http.MethodDelete:
+		delete(s.uploads, uploadID)
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeFakeS3Error(rw, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func fakeS3ETag(data []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data)))
+}
+
+func writeFakeS3XML(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(rw).Encode(v)
+}
+
+func writeFakeS3Error(rw http.ResponseWriter, status int, code string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(status)
+	_ = xml.NewEncoder(rw).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
 )
 
 var ArtifactPathVariableRegex = regexp.MustCompile("\\$\\{artifact\\:path\\}")
@@ -52,11 +53,49 @@ func (u *FormUploader) URL(artifact *api.Artifact) string {
 	return ""
 }
 
+// formUploadError is returned when the upload of a file is responded to with
+// an error
+type formUploadError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *formUploadError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Body, e.StatusCode)
+}
+
+// retryable returns whether the upload could succeed if it's tried again, as
+// uploads that are rejected, like those whose upload instructions have
+// expired, won't
+func (e *formUploadError) retryable() bool {
+	return e.StatusCode/100 != 4 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
 func (u *FormUploader) Upload(artifact *api.Artifact) error {
 	if artifact.FileSize > maxFormUploadedArtifactSize {
 		return errors.New(fmt.Sprintf("File size (%d bytes) exceeds the maximum supported by Buildkite's default artifact storage (5Gb). Alternative artifact storage options may support larger files.", artifact.FileSize))
 	}
 
+	// Each file is retried on its own, from the start, as the whole file is
+	// uploaded in one request
+	return newUploadRetrier().Do(func(r *roko.Retrier) error {
+		err := u.upload(artifact)
+		if err != nil {
+			// Neither missing files nor rejected uploads will work next time
+			var formErr *formUploadError
+			if os.IsNotExist(err) || (errors.As(err, &formErr) && !formErr.retryable()) {
+				r.Break()
+			}
+			u.logger.Warn("Failed to upload artifact \"%s\": %v (%s)", artifact.Path, err, r)
+		}
+		return err
+	})
+}
+
+// retriesUploads marks the FormUploader as retrying its own uploads
+func (u *FormUploader) retriesUploads() {}
+
+func (u *FormUploader) upload(artifact *api.Artifact) error {
 	// Create a HTTP request for uploading the file
 	request, err := createUploadRequest(u.logger, artifact)
 	if err != nil {
@@ -124,8 +163,7 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 			}
 
 			// Return a custom error with the response body from the page
-			message := fmt.Sprintf("%s (%d)", body, response.StatusCode)
-			return errors.New(message)
+			return &formUploadError{StatusCode: response.StatusCode, Body: body.String()}
 		}
 	}
 
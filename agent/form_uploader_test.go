@@ -186,3 +186,66 @@ func TestFormUploadTooBig(t *testing.T) {
 		t.Errorf("Expected polite error message when uploading a file over 5Gb")
 	}
 }
+
+func TestFormUploadRetriesEachFile(t *testing.T) {
+	withoutUploadRetryDelays(t)
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		requests int
+		ok       bool
+	}{
+		{"server error", []int{http.StatusInternalServerError, http.StatusCreated}, 2, true},
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusCreated}, 2, true},
+		{"always failing", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, 3, false},
+		{"rejected", []int{http.StatusForbidden, http.StatusCreated}, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				status := tc.statuses[requests]
+				requests++
+				rw.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			abspath := filepath.Join(t.TempDir(), "llamas.txt")
+			if err := ioutil.WriteFile(abspath, []byte("llamas"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			uploader := NewFormUploader(logger.Discard, FormUploaderConfig{})
+			artifact := &api.Artifact{
+				ID:           "xxxxx-xxxx-xxxx-xxxx-xxxxxxxxxx",
+				Path:         "llamas.txt",
+				AbsolutePath: abspath,
+				GlobPath:     "llamas.txt",
+				ContentType:  "text/plain",
+				UploadInstructions: &api.ArtifactUploadInstructions{
+					Action: struct {
+						URL       string "json:\"url,omitempty\""
+						Method    string "json:\"method\""
+						Path      string "json:\"path\""
+						FileInput string "json:\"file_input\""
+					}{
+						URL:       server.URL,
+						Method:    "POST",
+						Path:      "buildkiteartifacts.com",
+						FileInput: "file",
+					}},
+			}
+
+			err := uploader.Upload(artifact)
+			if tc.ok && err != nil {
+				t.Fatalf("Expected the upload to succeed, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("Expected the upload to fail")
+			}
+			if requests != tc.requests {
+				t.Fatalf("Expected %d requests, got %d", tc.requests, requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+)
+
+// WriteGitCredentialsFile writes credentials for git to a new file in dir that
+// only the current user can read, one URL per line, followed by the contents
+// of credentialsFile if one is given. Credentials are passed to other
+// processes in a file rather than the environment, so that they can contain
+// commas and aren't visible to anything that can read those processes'
+// environments. The caller removes the file when it's done with it.
+func WriteGitCredentialsFile(dir string, credentials []string, credentialsFile string) (string, error) {
+	var buf bytes.Buffer
+	for _, credential := range credentials {
+		buf.WriteString(credential + "\n")
+	}
+
+	if credentialsFile != "" {
+		contents, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(contents)
+	}
+
+	file, err := ioutil.TempFile(dir, "git-credentials-")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
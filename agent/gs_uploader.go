@@ -2,13 +2,17 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/buildkite/agent/v3/api"
@@ -19,6 +23,13 @@ import (
 	storage "google.golang.org/api/storage/v1"
 )
 
+// GCS composes objects from no more than 32 others, so larger files are
+// composed in tiers, from objects that are themselves composed from parts
+const (
+	gsMaxComposeSources = 32
+	gsMaxParts          = 10000
+)
+
 type GSUploaderConfig struct {
 	// The destination which includes the GS bucket name and the path.
 	// gs://my-bucket-name/foo/bar
@@ -149,6 +160,22 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
 	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Large files are uploaded in parts that can be resumed
+	partSize, err := uploadPartSize(info.Size(), 1, gsMaxParts)
+	if err != nil {
+		return err
+	}
+	if info.Size() > partSize {
+		return u.uploadComposite(object, file, info, partSize, permission)
+	}
+
 	call := u.service.Objects.Insert(u.BucketName, object)
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
@@ -162,6 +189,159 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 	return nil
 }
 
+// uploadComposite uploads a file as separate objects for each of its parts,
+// then composes them into the artifact, resuming a previous upload of it if
+// there was one
+func (u *GSUploader) uploadComposite(object *storage.Object, f *os.File, info os.FileInfo, partSize int64, permission string) error {
+	concurrency, err := uploadPartConcurrency()
+	if err != nil {
+		return err
+	}
+
+	state := loadMultipartUploadState(u.logger, "gs://"+u.BucketName+"/"+object.Name, info, partSize)
+	if state.UploadID != "" {
+		u.resumeComposite(object.Name, state)
+	} else {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		state.Start(hex.EncodeToString(id))
+	}
+
+	u.logger.Debug("Uploading \"%s\" to bucket \"%s\" in %d parts", object.Name, u.BucketName, state.PartCount())
+
+	err = uploadParts(u.logger, f, state, concurrency, func(part int, r *io.SectionReader) (string, error) {
+		// Parts are retried by uploadParts, so they're uploaded in one request
+		res, err := u.service.Objects.
+			Insert(u.BucketName, &storage.Object{Name: gsPartName(object.Name, state.UploadID, part)}).
+			Media(r, googleapi.ContentType(""), googleapi.ChunkSize(0)).
+			Do()
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(res.Generation, 10), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var sources []*storage.ComposeRequestSourceObjects
+	for part := 1; part <= state.PartCount(); part++ {
+		generation, _ := state.Part(part)
+		source := &storage.ComposeRequestSourceObjects{Name: gsPartName(object.Name, state.UploadID, part)}
+		source.Generation, _ = strconv.ParseInt(generation, 10, 64)
+		sources = append(sources, source)
+	}
+
+	// Compose the parts into fewer and fewer objects until there are few
+	// enough to compose into the artifact
+	for tier := 1; len(sources) > gsMaxComposeSources; tier++ {
+		var composed []*storage.ComposeRequestSourceObjects
+		for i := 0; i < len(sources); i += gsMaxComposeSources {
+			end := i + gsMaxComposeSources
+			if end > len(sources) {
+				end = len(sources)
+			}
+
+			name := gsComposedPartName(object.Name, state.UploadID, tier, len(composed)+1)
+			res, err := u.service.Objects.Compose(u.BucketName, name, &storage.ComposeRequest{
+				Destination:   &storage.Object{Name: name},
+				SourceObjects: sources[i:end],
+			}).Do()
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to compose parts of file \"%s\" (%v)", object.Name, err))
+			}
+			composed = append(composed, &storage.ComposeRequestSourceObjects{Name: name, Generation: res.Generation})
+		}
+		sources = composed
+	}
+
+	call := u.service.Objects.Compose(u.BucketName, object.Name, &storage.ComposeRequest{
+		Destination:   object,
+		SourceObjects: sources,
+	})
+	if permission != "" {
+		call = call.DestinationPredefinedAcl(permission)
+	}
+	res, err := call.Do()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to compose file \"%s\" (%v)", object.Name, err))
+	}
+	u.logger.Debug("Created object %v at location %v\n\n", res.Name, res.SelfLink)
+
+	u.deleteParts(object.Name, state.UploadID)
+	state.Remove()
+	return nil
+}
+
+// abort deletes the parts of an upload of an artifact that's been given up
+// on, so that they're not left in the bucket
+func (u *GSUploader) abort(artifact *api.Artifact) {
+	name := u.artifactPath(artifact)
+
+	state, ok := inProgressMultipartUpload("gs://" + u.BucketName + "/" + name)
+	if !ok {
+		return
+	}
+	defer state.Remove()
+
+	if state.UploadID == "" {
+		return
+	}
+
+	u.logger.Debug("Aborting upload of \"%s\"", name)
+	u.deleteParts(name, state.UploadID)
+}
+
+// deleteParts deletes the objects that parts of an upload were uploaded or
+// composed to
+func (u *GSUploader) deleteParts(name, uploadID string) {
+	prefix := gsPartPrefix(name, uploadID)
+
+	err := u.service.Objects.List(u.BucketName).Prefix(prefix).Pages(context.Background(), func(objects *storage.Objects) error {
+		for _, object := range objects.Items {
+			if err := u.service.Objects.Delete(u.BucketName, object.Name).Do(); err != nil {
+				u.logger.Warn("Failed to delete part \"%s\" (%v)", object.Name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		u.logger.Warn("Failed to list the parts of \"%s\" to delete them (%v)", name, err)
+	}
+}
+
+// resumeComposite checks which of the parts of a previous upload are still in
+// the bucket, so that only the others are uploaded
+func (u *GSUploader) resumeComposite(name string, state *multipartUploadState) {
+	for part, generation := range state.Parts {
+		res, err := u.service.Objects.Get(u.BucketName, gsPartName(name, state.UploadID, part)).Do()
+		if err != nil || strconv.FormatInt(res.Generation, 10) != generation {
+			delete(state.Parts, part)
+		}
+	}
+
+	u.logger.Debug("Resuming upload of \"%s\" with %d of %d parts uploaded", name, len(state.Parts), state.PartCount())
+}
+
+// gsPartPrefix returns the prefix of the names of the objects that the parts
+// of an upload are uploaded and composed to
+func gsPartPrefix(name, uploadID string) string {
+	return fmt.Sprintf("%s.buildkite-upload-%s-", name, uploadID)
+}
+
+// gsPartName returns the name of the object a part of an upload is uploaded to
+func gsPartName(name, uploadID string, part int) string {
+	return fmt.Sprintf("%s%d", gsPartPrefix(name, uploadID), part)
+}
+
+// gsComposedPartName returns the name of an object composed from parts of an
+// upload, or from other composed objects, in a tier of composition
+func gsComposedPartName(name, uploadID string, tier, part int) string {
+	return fmt.Sprintf("%scompose-%d-%d", gsPartPrefix(name, uploadID), tier, part)
+}
+
 func (u *GSUploader) artifactPath(artifact *api.Artifact) string {
 	parts := []string{u.BucketPath, artifact.Path}
 
@@ -1,7 +1,20 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
 )
 
 func TestParseGSDestinationBucketPath(t *testing.T) {
@@ -31,3 +44,114 @@ func TestParseGSDestinationBucketName(t *testing.T) {
 		}
 	}
 }
+
+// newFakeGSUploader returns an uploader to builds/1 in my-bucket of a fake
+// Google Cloud Storage
+func newFakeGSUploader(t *testing.T, gcs *fakeGCS) *GSUploader {
+	server := httptest.NewServer(gcs)
+	t.Cleanup(server.Close)
+
+	service, err := storage.NewService(context.Background(),
+		option.WithHTTPClient(server.Client()),
+		option.WithEndpoint(server.URL+"/storage/v1/"),
+	)
+	require.NoError(t, err)
+
+	return &GSUploader{
+		BucketName: "my-bucket",
+		BucketPath: "builds/1",
+		logger:     logger.Discard,
+		service:    service,
+	}
+}
+
+func TestGSUploadsOfLargeFilesAreComposedFromResumableParts(t *testing.T) {
+	withoutUploadRetryDelays(t)
+
+	t.Setenv("BUILDKITE_GS_ACL", "")
+	t.Setenv("BUILDKITE_JOB_TMPDIR", t.TempDir())
+	t.Setenv(uploadPartSizeEnvVar, "1024")
+
+	gcs := newFakeGCS("my-bucket")
+	uploader := newFakeGSUploader(t, gcs)
+
+	contents := bytes.Repeat([]byte("llamas"), 500)
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(src, contents, 0600))
+	artifact := &api.Artifact{AbsolutePath: src, Path: "llamas.txt", ContentType: "text/plain"}
+
+	gcs.FailUpload = func(name string) bool { return strings.HasSuffix(name, "-2") }
+	require.Error(t, uploader.Upload(artifact))
+
+	gcs.FailUpload = nil
+	gcs.Uploaded = nil
+	require.NoError(t, uploader.Upload(artifact))
+
+	// Only the part that failed is uploaded again
+	require.Len(t, gcs.Uploaded, 1)
+	assert.True(t, strings.HasSuffix(gcs.Uploaded[0], "-2"), "expected part 2 to be uploaded, got %v", gcs.Uploaded)
+
+	object, ok := gcs.Object("my-bucket", "builds/1/llamas.txt")
+	require.True(t, ok, "expected the artifact to be uploaded")
+	assert.True(t, bytes.Equal(contents, object.data), "expected the artifact to be uploaded intact")
+	assert.Equal(t, "text/plain", object.ContentType)
+	assert.Equal(t, `inline; filename="llamas.txt"`, object.ContentDisposition)
+
+	// And the parts are cleaned up
+	assert.Equal(t, []string{"builds/1/llamas.txt"}, gcs.Names("my-bucket"))
+}
+
+func TestGSUploadsOfFilesInManyPartsAreComposedInTiers(t *testing.T) {
+	withoutUploadRetryDelays(t)
+
+	t.Setenv("BUILDKITE_GS_ACL", "")
+	t.Setenv("BUILDKITE_JOB_TMPDIR", t.TempDir())
+	t.Setenv(uploadPartSizeEnvVar, "10")
+	t.Setenv(uploadPartConcurrencyEnvVar, "16")
+
+	gcs := newFakeGCS("my-bucket")
+	uploader := newFakeGSUploader(t, gcs)
+
+	// 1,001 parts, which are composed into 32 objects, then 1, then the artifact
+	contents := bytes.Repeat([]byte("llamas"), 1668)
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(src, contents, 0600))
+	artifact := &api.Artifact{AbsolutePath: src, Path: "llamas.txt", ContentType: "text/plain"}
+
+	require.NoError(t, uploader.Upload(artifact))
+	assert.Len(t, gcs.Uploaded, 1001)
+
+	object, ok := gcs.Object("my-bucket", "builds/1/llamas.txt")
+	require.True(t, ok, "expected the artifact to be uploaded")
+	assert.True(t, bytes.Equal(contents, object.data), "expected the artifact to be uploaded intact")
+	assert.Equal(t, "text/plain", object.ContentType)
+
+	// And the parts, and what they were composed into, are cleaned up
+	assert.Equal(t, []string{"builds/1/llamas.txt"}, gcs.Names("my-bucket"))
+}
+
+func TestGSUploadsThatAreGivenUpOnHaveTheirPartsDeleted(t *testing.T) {
+	withoutUploadRetryDelays(t)
+
+	t.Setenv("BUILDKITE_GS_ACL", "")
+	t.Setenv("BUILDKITE_JOB_TMPDIR", t.TempDir())
+	t.Setenv(uploadPartSizeEnvVar, "1024")
+
+	gcs := newFakeGCS("my-bucket")
+	uploader := newFakeGSUploader(t, gcs)
+
+	contents := bytes.Repeat([]byte("llamas"), 500)
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(src, contents, 0600))
+	artifact := &api.Artifact{AbsolutePath: src, Path: "llamas.txt", ContentType: "text/plain"}
+
+	gcs.FailUpload = func(name string) bool { return strings.HasSuffix(name, "-2") }
+	require.Error(t, uploader.Upload(artifact))
+	require.Len(t, gcs.Names("my-bucket"), 2, "expected parts 1 and 3 to be uploaded")
+
+	uploader.abort(artifact)
+	assert.Empty(t, gcs.Names("my-bucket"))
+
+	_, ok := inProgressMultipartUpload("gs://my-bucket/builds/1/llamas.txt")
+	assert.False(t, ok, "expected the upload to be forgotten")
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/yaml"
+)
+
+// JobPolicy decides which jobs an agent will run. A job is refused if it
+// matches any of the deny rules, or if there are allow rules and it matches
+// none of them. For example:
+//
+//	allow:
+//	  - name: our repositories
+//	    repository: git@github.com:my-org/*
+//	deny:
+//	  - name: no deploys from branches
+//	    pipeline: deploy-*
+//	    branch: "!main"
+//	  - name: no plugins from outside
+//	    plugins: ["https://github.com/*/*"]
+type JobPolicy struct {
+	Allow []JobPolicyRule `yaml:"allow"`
+	Deny  []JobPolicyRule `yaml:"deny"`
+}
+
+// JobPolicyRule matches jobs by what they run. A rule matches a job when all
+// of the things it sets match. Repository, branch and pipeline are globs, as
+// with path.Match, and can be prefixed with ! to match anything else.
+type JobPolicyRule struct {
+	// A name for the rule, shown in the job log when it refuses a job
+	Name string `yaml:"name"`
+
+	// Globs matched against the job's BUILDKITE_REPO, BUILDKITE_BRANCH and
+	// BUILDKITE_PIPELINE_SLUG
+	Repository string `yaml:"repository"`
+	Branch     string `yaml:"branch"`
+	Pipeline   string `yaml:"pipeline"`
+
+	// A regular expression matched against the job's command
+	Command string `yaml:"command"`
+
+	// Globs matched against the repositories of the job's plugins, which
+	// match if any of the plugins match any of them
+	Plugins []string `yaml:"plugins"`
+
+	// Globs matched against the names of the job's environment variables,
+	// which match if the job sets any of them
+	Env []string `yaml:"env"`
+}
+
+// LoadJobPolicy reads and validates a job policy from a YAML file
+func LoadJobPolicy(filename string) (*JobPolicy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJobPolicy(b)
+}
+
+// ParseJobPolicy parses and validates a job policy
+func ParseJobPolicy(b []byte) (*JobPolicy, error) {
+	var policy JobPolicy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+
+	for _, rules := range [][]JobPolicyRule{policy.Allow, policy.Deny} {
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// Check returns an error naming the rule that refuses a job with the given
+// environment, or nil if the policy allows it
+func (policy *JobPolicy) Check(env map[string]string) error {
+	job, err := newPolicyJob(env)
+	if err != nil {
+		return fmt.Errorf("Failed to check the job against the agent's job policy: %v", err)
+	}
+
+	for _, rule := range policy.Deny {
+		if rule.matches(job) {
+			return fmt.Errorf("The job is denied by the agent's job policy (%s)", rule)
+		}
+	}
+
+	if len(policy.Allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range policy.Allow {
+		if rule.matches(job) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("The job isn't allowed by any of the rules in the agent's job policy")
+}
+
+// policyJob is what job policy rules are matched against
+type policyJob struct {
+	env     map[string]string
+	plugins []string
+}
+
+func newPolicyJob(env map[string]string) (policyJob, error) {
+	job := policyJob{env: env}
+
+	if pluginsJSON := env["BUILDKITE_PLUGINS"]; pluginsJSON != "" {
+		plugins, err := plugin.CreateFromJSON(pluginsJSON)
+		if err != nil {
+			return policyJob{}, err
+		}
+
+		for _, p := range plugins {
+			// Credentials aren't part of where a plugin comes from
+			withoutAuth := *p
+			withoutAuth.Authentication = ""
+
+			repository, err := withoutAuth.Repository()
+			if err != nil {
+				return policyJob{}, err
+			}
+			job.plugins = append(job.plugins, repository)
+		}
+	}
+
+	return job, nil
+}
+
+func (rule JobPolicyRule) String() string {
+	if rule.Name != "" {
+		return fmt.Sprintf("rule %q", rule.Name)
+	}
+
+	var parts []string
+	for _, field := range []struct{ name, value string }{
+		{"repository", rule.Repository},
+		{"branch", rule.Branch},
+		{"pipeline", rule.Pipeline},
+		{"command", rule.Command},
+		{"plugins", strings.Join(rule.Plugins, ", ")},
+		{"env", strings.Join(rule.Env, ", ")},
+	} {
+		if field.value != "" {
+			parts = append(parts, fmt.Sprintf("%s %q", field.name, field.value))
+		}
+	}
+	return "rule with " + strings.Join(parts, ", ")
+}
+
+func (rule JobPolicyRule) validate() error {
+	if rule.Repository == "" && rule.Branch == "" && rule.Pipeline == "" &&
+		rule.Command == "" && len(rule.Plugins) == 0 && len(rule.Env) == 0 {
+		return fmt.Errorf("Job policy %s doesn't match anything", rule)
+	}
+
+	globs := append([]string{rule.Repository, rule.Branch, rule.Pipeline}, rule.Plugins...)
+	for _, glob := range append(globs, rule.Env...) {
+		if _, err := path.Match(strings.TrimPrefix(glob, "!"), ""); err != nil {
+			return fmt.Errorf("Invalid pattern %q in job policy %s: %v", glob, rule, err)
+		}
+	}
+
+	if _, err := regexp.Compile(rule.Command); err != nil {
+		return fmt.Errorf("Invalid command pattern %q in job policy %s: %v", rule.Command, rule, err)
+	}
+
+	return nil
+}
+
+func (rule JobPolicyRule) matches(job policyJob) bool {
+	for _, field := range []struct{ glob, value string }{
+		{rule.Repository, job.env["BUILDKITE_REPO"]},
+		{rule.Branch, job.env["BUILDKITE_BRANCH"]},
+		{rule.Pipeline, job.env["BUILDKITE_PIPELINE_SLUG"]},
+	} {
+		if field.glob != "" && !matchPolicyGlob(field.glob, field.value) {
+			return false
+		}
+	}
+
+	if rule.Command != "" {
+		if ok, _ := regexp.MatchString(rule.Command, job.env["BUILDKITE_COMMAND"]); !ok {
+			return false
+		}
+	}
+
+	if len(rule.Plugins) > 0 && !matchAnyPolicyGlob(rule.Plugins, job.plugins) {
+		return false
+	}
+
+	if len(rule.Env) > 0 {
+		var names []string
+		for name := range job.env {
+			names = append(names, name)
+		}
+		if !matchAnyPolicyGlob(rule.Env, names) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchPolicyGlob matches a value against a glob, or anything but the glob if
+// it starts with !
+func matchPolicyGlob(glob, value string) bool {
+	if negated := strings.TrimPrefix(glob, "!"); negated != glob {
+		return !matchPolicyGlob(negated, value)
+	}
+	ok, _ := path.Match(glob, value)
+	return ok
+}
+
+// matchAnyPolicyGlob returns whether any of the values match any of the globs
+func matchAnyPolicyGlob(globs, values []string) bool {
+	for _, glob := range globs {
+		for _, value := range values {
+			if matchPolicyGlob(glob, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testJobPolicy = `
+allow:
+  - name: our repositories
+    repository: git@github.com:my-org/*
+deny:
+  - name: no deploys from branches
+    pipeline: deploy-*
+    branch: "!main"
+  - name: no curl to shell
+    command: curl .*\| *(ba)?sh
+  - name: no plugins from outside
+    plugins: ["https://github.com/*/*"]
+  - env: [AWS_SECRET_*]
+`
+
+func TestJobPolicyCheck(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParseJobPolicy([]byte(testJobPolicy))
+	require.NoError(t, err)
+
+	job := func(env ...string) map[string]string {
+		m := map[string]string{
+			"BUILDKITE_REPO":          "git@github.com:my-org/app.git",
+			"BUILDKITE_BRANCH":        "main",
+			"BUILDKITE_PIPELINE_SLUG": "app",
+			"BUILDKITE_COMMAND":       "make test",
+		}
+		for i := 0; i < len(env); i += 2 {
+			m[env[i]] = env[i+1]
+		}
+		return m
+	}
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{"allowed", job(), ""},
+		{"other repository", job("BUILDKITE_REPO", "git@github.com:other-org/app.git"),
+			"The job isn't allowed by any of the rules in the agent's job policy"},
+		{"deploy from main", job("BUILDKITE_PIPELINE_SLUG", "deploy-app"), ""},
+		{"deploy from a branch", job("BUILDKITE_PIPELINE_SLUG", "deploy-app", "BUILDKITE_BRANCH", "feature"),
+			`The job is denied by the agent's job policy (rule "no deploys from branches")`},
+		{"command", job("BUILDKITE_COMMAND", "curl https://example.com/install | bash"),
+			`The job is denied by the agent's job policy (rule "no curl to shell")`},
+		{"our plugin", job("BUILDKITE_PLUGINS", `[{"github.com/my-org/docker-buildkite-plugin#v1.0.0":{}}]`),
+			`The job is denied by the agent's job policy (rule "no plugins from outside")`},
+		{"local plugin", job("BUILDKITE_PLUGINS", `[{"./.buildkite/plugins/llamas":{}}]`), ""},
+		{"env", job("AWS_SECRET_ACCESS_KEY", "llamas"),
+			`The job is denied by the agent's job policy (rule with env "AWS_SECRET_*")`},
+	} {
+		err := policy.Check(tc.env)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.name)
+		} else {
+			assert.EqualError(t, err, tc.err, tc.name)
+		}
+	}
+}
+
+func TestParseJobPolicyRejectsInvalidRules(t *testing.T) {
+	t.Parallel()
+
+	_, err := ParseJobPolicy([]byte("deny:\n  - name: nothing\n"))
+	assert.EqualError(t, err, `Job policy rule "nothing" doesn't match anything`)
+
+	_, err = ParseJobPolicy([]byte("deny:\n  - branch: \"[\"\n"))
+	assert.EqualError(t, err, `Invalid pattern "[" in job policy rule with branch "[": syntax error in pattern`)
+
+	_, err = ParseJobPolicy([]byte("deny:\n  - command: \"(\"\n"))
+	assert.EqualError(t, err, "Invalid command pattern \"(\" in job policy rule with command \"(\": error parsing regexp: missing closing ): `(`")
+}
@@ -105,6 +105,9 @@ type JobRunner struct {
 
 	// File containing a copy of the job env
 	envFile *os.File
+
+	// File containing the git credentials for the bootstrap, if any
+	gitCredentialsFile string
 }
 
 // Initializes the job runner
@@ -155,6 +158,17 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		runner.envFile = file
 	}
 
+	// Prepare a file of the git credentials, as they can't be passed through
+	// the environment safely
+	if len(conf.AgentConfiguration.GitCredentials) > 0 {
+		file, err := WriteGitCredentialsFile(tempDir, conf.AgentConfiguration.GitCredentials, conf.AgentConfiguration.GitCredentialsFile)
+		if err != nil {
+			return runner, fmt.Errorf("Failed to write git credentials file: %v", err)
+		}
+		l.Debug("[JobRunner] Created git credentials file: %s", file)
+		runner.gitCredentialsFile = file
+	}
+
 	env, err := runner.createEnvironment()
 	if err != nil {
 		return nil, err
@@ -312,11 +326,20 @@ func (r *JobRunner) Run() error {
 	signalReason := ""
 
 	// Before executing the bootstrap process with the received Job env,
-	// execute the pre-bootstrap hook (if present) for it to tell us
-	// whether it is happy to proceed.
+	// check the job policy and execute the pre-bootstrap hook (if present)
+	// for them to tell us whether they're happy to proceed.
 	environmentCommandOkay := true
 
-	if hook, _ := hook.Find(r.conf.AgentConfiguration.HooksPath, "pre-bootstrap"); hook != "" {
+	if err := r.checkJobPolicy(); err != nil {
+		environmentCommandOkay = false
+
+		// The rule that refused the job is all the job needs to know
+		r.logStreamer.Process(fmt.Sprintf("%s\n", err))
+		r.logger.Error("Job policy refused this job: %s", err)
+
+		exitStatus = "-1"
+		signalReason = "agent_refused"
+	} else if hook, _ := hook.Find(r.conf.AgentConfiguration.HooksPath, "pre-bootstrap"); hook != "" {
 		// Once we have a hook any failure to run it MUST be fatal to the job to guarantee a true
 		// positive result from the hook
 		okay, err := r.executePreBootstrapHook(hook)
@@ -391,6 +414,14 @@ func (r *JobRunner) Run() error {
 		r.logger.Debug("[JobRunner] Deleted env file: %s", r.envFile.Name())
 	}
 
+	// Remove the git credentials file, if any
+	if r.gitCredentialsFile != "" {
+		if err := os.Remove(r.gitCredentialsFile); err != nil {
+			r.logger.Warn("[JobRunner] Error cleaning up git credentials file: %s", err)
+		}
+		r.logger.Debug("[JobRunner] Deleted git credentials file: %s", r.gitCredentialsFile)
+	}
+
 	// Write some metrics about the job run
 	jobMetrics := r.metrics.With(metrics.Tags{
 		"exit_code": exitStatus,
@@ -510,18 +541,36 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		`BUILDKITE_BUILD_PATH`,
 		`BUILDKITE_GIT_MIRRORS_PATH`,
 		`BUILDKITE_GIT_MIRRORS_SKIP_UPDATE`,
+		`BUILDKITE_GIT_LFS_STORAGE_PATH`,
+		`BUILDKITE_ENV_PROVENANCE_FILE`,
 		`BUILDKITE_HOOKS_PATH`,
 		`BUILDKITE_PLUGINS_PATH`,
+		`BUILDKITE_PLUGINS_STORE_PATH`,
+		`BUILDKITE_JOB_TMPDIR_ROOT`,
 		`BUILDKITE_SSH_KEYSCAN`,
 		`BUILDKITE_GIT_SUBMODULES`,
 		`BUILDKITE_COMMAND_EVAL`,
+		`BUILDKITE_COMMAND_ALLOWLIST`,
 		`BUILDKITE_PLUGINS_ENABLED`,
+		`BUILDKITE_PLUGINS_LOCKFILE`,
+		`BUILDKITE_PLUGINS_POLICY_FILE`,
+		`BUILDKITE_HOOK_TIMEOUTS`,
+		`BUILDKITE_HOOK_FAILURE_POLICIES`,
+		`BUILDKITE_CANCEL_GRACE_PERIOD`,
 		`BUILDKITE_LOCAL_HOOKS_ENABLED`,
 		`BUILDKITE_GIT_CLONE_FLAGS`,
 		`BUILDKITE_GIT_FETCH_FLAGS`,
 		`BUILDKITE_GIT_CLONE_MIRROR_FLAGS`,
 		`BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT`,
 		`BUILDKITE_GIT_CLEAN_FLAGS`,
+		`BUILDKITE_GIT_CHECKOUT_MODE`,
+		`BUILDKITE_GIT_CHECKOUT_STRATEGY`,
+		`BUILDKITE_GIT_VERIFY_SIGNATURES`,
+		`BUILDKITE_GIT_VERIFY_SIGNATURES_SINCE`,
+		`BUILDKITE_GIT_ALLOWED_SIGNERS_FILE`,
+		`BUILDKITE_GIT_GPG_KEYRING`,
+		`BUILDKITE_GIT_CREDENTIALS`,
+		`BUILDKITE_GIT_CREDENTIALS_FILE`,
 		`BUILDKITE_SHELL`,
 	}
 
@@ -566,17 +615,41 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_BUILD_PATH"] = r.conf.AgentConfiguration.BuildPath
 	env["BUILDKITE_GIT_MIRRORS_PATH"] = r.conf.AgentConfiguration.GitMirrorsPath
 	env["BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitMirrorsSkipUpdate)
+	env["BUILDKITE_GIT_LFS_STORAGE_PATH"] = r.conf.AgentConfiguration.GitLFSStoragePath
+	env["BUILDKITE_ENV_PROVENANCE_FILE"] = r.conf.AgentConfiguration.EnvProvenanceFile
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
+	env["BUILDKITE_PLUGINS_STORE_PATH"] = r.conf.AgentConfiguration.PluginsStorePath
+	env["BUILDKITE_JOB_TMPDIR_ROOT"] = r.conf.AgentConfiguration.JobTmpdirRoot
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
 	env["BUILDKITE_GIT_SUBMODULES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitSubmodules)
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.CommandEval)
+	env["BUILDKITE_COMMAND_ALLOWLIST"] = r.conf.AgentConfiguration.CommandAllowlist
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsEnabled)
+	env["BUILDKITE_PLUGINS_LOCKFILE"] = r.conf.AgentConfiguration.PluginsLockfile
+	env["BUILDKITE_PLUGINS_POLICY_FILE"] = r.conf.AgentConfiguration.PluginsPolicyFile
+	env["BUILDKITE_HOOK_TIMEOUTS"] = strings.Join(r.conf.AgentConfiguration.HookTimeouts, ",")
+	env["BUILDKITE_HOOK_FAILURE_POLICIES"] = strings.Join(r.conf.AgentConfiguration.HookFailurePolicies, ",")
+	env["BUILDKITE_CANCEL_GRACE_PERIOD"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.CancelGracePeriod)
 	env["BUILDKITE_LOCAL_HOOKS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.LocalHooksEnabled)
 	env["BUILDKITE_GIT_CLONE_FLAGS"] = r.conf.AgentConfiguration.GitCloneFlags
 	env["BUILDKITE_GIT_FETCH_FLAGS"] = r.conf.AgentConfiguration.GitFetchFlags
 	env["BUILDKITE_GIT_CLONE_MIRROR_FLAGS"] = r.conf.AgentConfiguration.GitCloneMirrorFlags
 	env["BUILDKITE_GIT_CLEAN_FLAGS"] = r.conf.AgentConfiguration.GitCleanFlags
+	env["BUILDKITE_GIT_CHECKOUT_MODE"] = r.conf.AgentConfiguration.GitCheckoutMode
+	env["BUILDKITE_GIT_CHECKOUT_STRATEGY"] = r.conf.AgentConfiguration.GitCheckoutStrategy
+	env["BUILDKITE_GIT_VERIFY_SIGNATURES"] = r.conf.AgentConfiguration.GitVerifySignatures
+	env["BUILDKITE_GIT_VERIFY_SIGNATURES_SINCE"] = r.conf.AgentConfiguration.GitVerifySignaturesSince
+	env["BUILDKITE_GIT_ALLOWED_SIGNERS_FILE"] = r.conf.AgentConfiguration.GitAllowedSignersFile
+	env["BUILDKITE_GIT_GPG_KEYRING"] = r.conf.AgentConfiguration.GitGPGKeyring
+	// The credentials are only passed in a file, which includes those from
+	// any configured credentials file. This is empty rather than unset so the
+	// agent's own environment doesn't leak through.
+	env["BUILDKITE_GIT_CREDENTIALS"] = ""
+	env["BUILDKITE_GIT_CREDENTIALS_FILE"] = r.conf.AgentConfiguration.GitCredentialsFile
+	if r.gitCredentialsFile != "" {
+		env["BUILDKITE_GIT_CREDENTIALS_FILE"] = r.gitCredentialsFile
+	}
 	env["BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitMirrorsLockTimeout)
 	env["BUILDKITE_SHELL"] = r.conf.AgentConfiguration.Shell
 	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
@@ -609,6 +682,17 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	}
 	env["BUILDKITE_PLUGIN_VALIDATION"] = fmt.Sprintf("%t", enablePluginValidation)
 
+	enablePluginsLock := r.conf.AgentConfiguration.PluginsLock
+	// Allow BUILDKITE_PLUGINS_LOCK to be enabled per-pipeline, but not
+	// disabled if the agent requires it
+	if pluginsLock, ok := env["BUILDKITE_PLUGINS_LOCK"]; ok {
+		switch pluginsLock {
+		case "true", "1", "on":
+			enablePluginsLock = true
+		}
+	}
+	env["BUILDKITE_PLUGINS_LOCK"] = fmt.Sprintf("%t", enablePluginsLock)
+
 	if r.conf.AgentConfiguration.TracingBackend != "" {
 		env["BUILDKITE_TRACING_BACKEND"] = r.conf.AgentConfiguration.TracingBackend
 	}
@@ -657,6 +741,22 @@ func (w LogWriter) Write(bytes []byte) (int, error) {
 	return len(bytes), nil
 }
 
+// checkJobPolicy returns an error naming the rule that refuses the job if the
+// agent's job policy doesn't allow it. A policy that can't be loaded refuses
+// every job.
+func (r *JobRunner) checkJobPolicy() error {
+	if r.conf.AgentConfiguration.JobPolicyFile == "" {
+		return nil
+	}
+
+	policy, err := LoadJobPolicy(r.conf.AgentConfiguration.JobPolicyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load the agent's job policy: %v", err)
+	}
+
+	return policy.Check(r.job.Env)
+}
+
 func (r *JobRunner) executePreBootstrapHook(hook string) (bool, error) {
 	r.logger.Info("Running pre-bootstrap hook %q", hook)
 
@@ -0,0 +1,319 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/pool"
+	"github.com/buildkite/roko"
+)
+
+// Large artifacts are uploaded to S3 and GCS in parts, which are uploaded in
+// parallel and retried individually. The parts that have been uploaded are
+// remembered, and saved in the job's temporary directory if there is one, so
+// an upload that fails part way through carries on from where it was up to
+// when it's retried. Uploads that are given up on are aborted, so their parts
+// aren't left behind.
+
+const (
+	// The size of the parts artifacts are uploaded in, in bytes. Artifacts no
+	// bigger than this are uploaded in a single request.
+	uploadPartSizeEnvVar = "BUILDKITE_ARTIFACT_UPLOAD_PART_SIZE"
+
+	// How many parts of each artifact are uploaded at once
+	uploadPartConcurrencyEnvVar = "BUILDKITE_ARTIFACT_UPLOAD_PART_CONCURRENCY"
+
+	defaultUploadPartSize        = 64 * 1024 * 1024
+	defaultUploadPartConcurrency = 4
+)
+
+// newUploadRetrier returns how parts, and files that are uploaded whole, are
+// retried. It's a variable so that tests don't have to wait.
+var newUploadRetrier = func() *roko.Retrier {
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(5),
+		roko.WithStrategy(roko.Exponential(2*time.Second, 0)),
+		roko.WithJitter(),
+	)
+}
+
+// uploadPartSize returns the size of the parts a file should be uploaded in,
+// which is at least minPartSize, and big enough that there are no more than
+// maxParts of them
+func uploadPartSize(fileSize, minPartSize, maxParts int64) (int64, error) {
+	partSize := int64(defaultUploadPartSize)
+	if v := os.Getenv(uploadPartSizeEnvVar); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return 0, fmt.Errorf("Invalid %s %q, expected a number of bytes", uploadPartSizeEnvVar, v)
+		}
+		partSize = size
+	}
+
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if forMaxParts := (fileSize + maxParts - 1) / maxParts; partSize < forMaxParts {
+		partSize = forMaxParts
+	}
+
+	return partSize, nil
+}
+
+// uploadPartConcurrency returns how many parts of a file are uploaded at once
+func uploadPartConcurrency() (int, error) {
+	v := os.Getenv(uploadPartConcurrencyEnvVar)
+	if v == "" {
+		return defaultUploadPartConcurrency, nil
+	}
+
+	concurrency, err := strconv.Atoi(v)
+	if err != nil || concurrency <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q, expected a number of parts", uploadPartConcurrencyEnvVar, v)
+	}
+	return concurrency, nil
+}
+
+// multipartUploadState is what's saved about an upload in progress so that it
+// can be resumed
+type multipartUploadState struct {
+	// The file being uploaded, which can't have changed for it to be resumed
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	PartSize int64     `json:"part_size"`
+
+	// The S3 multipart upload ID, or the ID that GCS part objects are named
+	// with. Empty if the upload hasn't been started.
+	UploadID string `json:"upload_id"`
+
+	// The parts that have been uploaded by their number, from 1, with their
+	// S3 ETags or GCS generations
+	Parts map[int]string `json:"parts"`
+
+	destination string
+	path        string
+	logger      logger.Logger
+	mu          sync.Mutex
+}
+
+// multipartUploads are the uploads in progress by this process, by their
+// destination, so that they can be resumed or aborted even if their state
+// couldn't be saved
+var multipartUploads = struct {
+	sync.Mutex
+	states map[string]*multipartUploadState
+}{states: map[string]*multipartUploadState{}}
+
+// loadMultipartUploadState returns the state of an upload of a file to a
+// destination, like s3://bucket/key, or a new state if there isn't one for
+// the file as it is now. The state is saved in the job's temporary directory,
+// and isn't saved at all without one.
+func loadMultipartUploadState(l logger.Logger, destination string, info os.FileInfo, partSize int64) *multipartUploadState {
+	multipartUploads.Lock()
+	defer multipartUploads.Unlock()
+
+	matches := func(s *multipartUploadState) bool {
+		return s.Size == info.Size() && s.ModTime.Equal(info.ModTime()) && s.PartSize == partSize
+	}
+
+	if state, ok := multipartUploads.states[destination]; ok && matches(state) {
+		return state
+	}
+
+	var path string
+	if dir := os.Getenv("BUILDKITE_JOB_TMPDIR"); dir != "" {
+		hash := sha256.Sum256([]byte(destination))
+		path = filepath.Join(dir, "buildkite-artifact-uploads", hex.EncodeToString(hash[:])+".json")
+	}
+
+	state := &multipartUploadState{}
+	if !state.read(path) || !matches(state) {
+		state = &multipartUploadState{
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			PartSize: partSize,
+		}
+	}
+	if state.Parts == nil {
+		state.Parts = map[int]string{}
+	}
+	state.destination = destination
+	state.path = path
+	state.logger = l
+
+	multipartUploads.states[destination] = state
+	return state
+}
+
+// read reads a saved state, returning whether there was one
+func (s *multipartUploadState) read(path string) bool {
+	if path == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	return err == nil && json.Unmarshal(data, s) == nil
+}
+
+// inProgressMultipartUpload returns the state of an upload to a destination
+// that's in progress, and whether there is one
+func inProgressMultipartUpload(destination string) (*multipartUploadState, bool) {
+	multipartUploads.Lock()
+	defer multipartUploads.Unlock()
+
+	state, ok := multipartUploads.states[destination]
+	return state, ok
+}
+
+// PartCount returns how many parts the file is uploaded in
+func (s *multipartUploadState) PartCount() int {
+	return int((s.Size + s.PartSize - 1) / s.PartSize)
+}
+
+// Start records the ID of a new upload, forgetting any previous one
+func (s *multipartUploadState) Start(uploadID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.UploadID = uploadID
+	s.Parts = map[int]string{}
+	s.save()
+}
+
+// CompletePart records that a part has been uploaded
+func (s *multipartUploadState) CompletePart(part int, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Parts[part] = etag
+	s.save()
+}
+
+// Part returns the ETag or generation of a part, and whether it's uploaded
+func (s *multipartUploadState) Part(part int) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	etag, ok := s.Parts[part]
+	return etag, ok
+}
+
+// Remove forgets about the upload, once it's complete or aborted
+func (s *multipartUploadState) Remove() {
+	multipartUploads.Lock()
+	if multipartUploads.states[s.destination] == s {
+		delete(multipartUploads.states, s.destination)
+	}
+	multipartUploads.Unlock()
+
+	if s.path != "" {
+		_ = os.Remove(s.path)
+	}
+}
+
+// save saves the state, if it can be, so that the upload can be resumed by
+// another process. It must be called with the lock held.
+func (s *multipartUploadState) save() {
+	if s.path == "" {
+		return
+	}
+	if err := s.write(); err != nil {
+		s.logger.Warn("Failed to save the progress of uploading %s, it can't be resumed by another upload (%v)", s.destination, err)
+	}
+}
+
+// write writes the state to a temporary file and moves it into place, so it's
+// never partially written
+func (s *multipartUploadState) write() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// uploadParts uploads the parts of a file that haven't been uploaded yet, some
+// at a time, retrying each of them. The upload func returns the part's ETag.
+func uploadParts(l logger.Logger, f *os.File, state *multipartUploadState, concurrency int, upload func(part int, r *io.SectionReader) (string, error)) error {
+	p := pool.New(concurrency)
+
+	var err error
+	var errMutex sync.Mutex
+	failed := func() bool {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		return err != nil
+	}
+
+	parts := state.PartCount()
+	for part := 1; part <= parts; part++ {
+		if _, ok := state.Part(part); ok {
+			l.Debug("Part %d of %d of %s has already been uploaded", part, parts, f.Name())
+			continue
+		}
+
+		// There's no point uploading the rest once a part has failed
+		if failed() {
+			break
+		}
+
+		part := part
+		p.Spawn(func() {
+			offset := int64(part-1) * state.PartSize
+			length := state.PartSize
+			if offset+length > state.Size {
+				length = state.Size - offset
+			}
+
+			partErr := newUploadRetrier().Do(func(r *roko.Retrier) error {
+				etag, err := upload(part, io.NewSectionReader(f, offset, length))
+				if err != nil {
+					l.Warn("Failed to upload part %d of %d of %s: %v (%s)", part, parts, f.Name(), err, r)
+					return err
+				}
+				state.CompletePart(part, etag)
+				return nil
+			})
+
+			if partErr != nil {
+				errMutex.Lock()
+				if err == nil {
+					err = fmt.Errorf("Failed to upload part %d of %d (%v)", part, parts, partErr)
+				}
+				errMutex.Unlock()
+			}
+		})
+	}
+
+	p.Wait()
+
+	return err
+}
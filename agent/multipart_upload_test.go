@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withoutUploadRetryDelays makes upload retries immediate for a test
+func withoutUploadRetryDelays(t *testing.T) {
+	original := newUploadRetrier
+	newUploadRetrier = func() *roko.Retrier {
+		return roko.NewRetrier(
+			roko.WithMaxAttempts(3),
+			roko.WithStrategy(roko.Constant(0)),
+			roko.WithSleepFunc(func(time.Duration) {}),
+		)
+	}
+	t.Cleanup(func() { newUploadRetrier = original })
+}
+
+// forgetMultipartUploads forgets the uploads in progress, as if they were
+// started by another process
+func forgetMultipartUploads() {
+	multipartUploads.Lock()
+	defer multipartUploads.Unlock()
+
+	multipartUploads.states = map[string]*multipartUploadState{}
+}
+
+func TestUploadPartSize(t *testing.T) {
+	for _, tc := range []struct {
+		env                             string
+		fileSize, minPartSize, maxParts int64
+		expected                        int64
+	}{
+		{"", 1 << 30, 1, 32, defaultUploadPartSize},
+		{"1024", 4096, 1, 32, 1024},
+		{"1024", 4096, 2048, 32, 2048},
+		{"1024", 1 << 20, 1, 32, 1 << 15},
+		{"1024", 1<<20 + 1, 1, 32, 1<<15 + 1},
+	} {
+		t.Setenv(uploadPartSizeEnvVar, tc.env)
+
+		partSize, err := uploadPartSize(tc.fileSize, tc.minPartSize, tc.maxParts)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, partSize, "%+v", tc)
+	}
+
+	t.Setenv(uploadPartSizeEnvVar, "lots")
+	_, err := uploadPartSize(1024, 1, 32)
+	assert.Error(t, err)
+}
+
+func TestMultipartUploadStateIsResumedForTheSameFile(t *testing.T) {
+	t.Setenv("BUILDKITE_JOB_TMPDIR", t.TempDir())
+
+	path := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	state := loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", info, 2)
+	assert.Equal(t, 3, state.PartCount())
+	state.Start("upload-1")
+	state.CompletePart(2, "etag-2")
+
+	// By another process too
+	forgetMultipartUploads()
+	resumed := loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", info, 2)
+	assert.Equal(t, "upload-1", resumed.UploadID)
+	assert.Equal(t, map[int]string{2: "etag-2"}, resumed.Parts)
+
+	// Not if it's to somewhere else, or in different parts
+	assert.Empty(t, loadMultipartUploadState(logger.Discard, "s3://my-bucket/alpacas.txt", info, 2).UploadID)
+	assert.Empty(t, loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", info, 3).UploadID)
+
+	// Or if the file has changed
+	require.NoError(t, ioutil.WriteFile(path, []byte("alpacas"), 0600))
+	changed, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Empty(t, loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", changed, 2).UploadID)
+
+	resumed.Remove()
+	_, err = os.Stat(resumed.path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultipartUploadStateIsOnlyRememberedWithoutAJobTmpdir(t *testing.T) {
+	t.Setenv("BUILDKITE_JOB_TMPDIR", "")
+	forgetMultipartUploads()
+
+	path := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	state := loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", info, 2)
+	assert.Empty(t, state.path)
+	state.Start("upload-1")
+	state.CompletePart(1, "etag-1")
+
+	resumed, ok := inProgressMultipartUpload("s3://my-bucket/llamas.txt")
+	require.True(t, ok, "expected the upload to be remembered")
+	assert.Equal(t, "upload-1", resumed.UploadID)
+
+	resumed.Remove()
+	_, ok = inProgressMultipartUpload("s3://my-bucket/llamas.txt")
+	assert.False(t, ok, "expected the upload to be forgotten")
+}
+
+func TestMultipartUploadStateThatCantBeSavedIsStillRemembered(t *testing.T) {
+	// A file where the directory the state is saved in would be
+	tmpdir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpdir, "buildkite-artifact-uploads"), nil, 0600))
+	t.Setenv("BUILDKITE_JOB_TMPDIR", tmpdir)
+	forgetMultipartUploads()
+
+	path := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	state := loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", info, 2)
+	state.Start("upload-1")
+	state.CompletePart(1, "etag-1")
+
+	resumed := loadMultipartUploadState(logger.Discard, "s3://my-bucket/llamas.txt", info, 2)
+	assert.Equal(t, map[int]string{1: "etag-1"}, resumed.Parts)
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// PipelineCommand is the command of a command step in a pipeline
+type PipelineCommand struct {
+	Step    string
+	Command string
+}
+
+// Commands returns the commands of the command steps in the pipeline,
+// including those in group steps, in order. Steps with a list of commands
+// have them joined by newlines, as they are when the job is run.
+func (p *PipelineParserResult) Commands() []PipelineCommand {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return nil
+	}
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return nil
+	}
+	return stepCommands(steps)
+}
+
+func stepCommands(steps []interface{}) []PipelineCommand {
+	var commands []PipelineCommand
+	for _, step := range steps {
+		s, ok := step.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+
+		for _, key := range []string{"command", "commands"} {
+			item, ok := mapSliceItem(key, s)
+			if !ok {
+				continue
+			}
+
+			var lines []string
+			switch v := item.Value.(type) {
+			case string:
+				lines = append(lines, v)
+			case []interface{}:
+				for _, line := range v {
+					if line, ok := line.(string); ok {
+						lines = append(lines, line)
+					}
+				}
+			}
+
+			if len(lines) > 0 {
+				commands = append(commands, PipelineCommand{
+					Step:    stepName(s),
+					Command: strings.Join(lines, "\n"),
+				})
+			}
+		}
+
+		if item, has := mapSliceItem("steps", s); has {
+			if nested, ok := item.Value.([]interface{}); ok {
+				commands = append(commands, stepCommands(nested)...)
+			}
+		}
+	}
+	return commands
+}
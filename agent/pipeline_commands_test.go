@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineCommands(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - label: "test"
+    command: make test
+  - wait
+  - group: "lint"
+    steps:
+      - key: "lint"
+        commands:
+          - make lint
+          - make vet
+  - trigger: "deploy"
+  - command: "echo $$HOME"
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	assert.Equal(t, []PipelineCommand{
+		{Step: "test", Command: "make test"},
+		{Step: "lint", Command: "make lint\nmake vet"},
+		{Step: "echo $HOME", Command: "echo $HOME"},
+	}, result.Commands())
+}
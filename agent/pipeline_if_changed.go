@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// IfChangedKey is the step attribute holding the globs that a step's changes
+// must match for it to be included in an upload
+const IfChangedKey = "if_changed"
+
+// HasIfChanged returns whether any step (or group step) in the pipeline has an
+// if_changed attribute
+func (p *PipelineParserResult) HasIfChanged() bool {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return false
+	}
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return false
+	}
+	return stepsHaveIfChanged(steps)
+}
+
+func stepsHaveIfChanged(steps []interface{}) bool {
+	for _, step := range steps {
+		s, ok := step.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		if _, has := mapSliceItem(IfChangedKey, s); has {
+			return true
+		}
+		if item, has := mapSliceItem("steps", s); has {
+			if nested, ok := item.Value.([]interface{}); ok && stepsHaveIfChanged(nested) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FilterIfChanged drops any steps whose if_changed globs don't match at least
+// one of the changed paths, and strips the if_changed attribute from the steps
+// that remain. Group steps are filtered as a whole if they have if_changed, and
+// their nested steps are filtered individually. Groups left without any steps are
+// dropped too. The labels (or keys) of the dropped steps are returned.
+//
+// Steps that depended on a dropped step no longer depend on it, as it's not
+// going to run, rather than being left depending on a key that doesn't exist.
+//
+// If changed is nil, no steps are dropped, but if_changed is still stripped.
+func (p *PipelineParserResult) FilterIfChanged(changed []string) ([]string, error) {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return nil, nil
+	}
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected pipeline steps to be a list, got %T", item.Value)
+	}
+
+	filtered, dropped, err := filterStepsIfChanged(steps, changed)
+	if err != nil {
+		return nil, err
+	}
+
+	droppedKeys := map[string]bool{}
+	for _, step := range steps {
+		for _, key := range stepKeys(step) {
+			droppedKeys[key] = true
+		}
+	}
+	for _, step := range filtered {
+		for _, key := range stepKeys(step) {
+			delete(droppedKeys, key)
+		}
+	}
+	if len(droppedKeys) > 0 {
+		filtered = removeDependencies(filtered, droppedKeys)
+	}
+
+	p.pipeline = upsertSliceItem("steps", p.pipeline, filtered)
+	return dropped, nil
+}
+
+func filterStepsIfChanged(steps []interface{}, changed []string) ([]interface{}, []string, error) {
+	filtered := make([]interface{}, 0, len(steps))
+	var dropped []string
+
+	for _, step := range steps {
+		s, ok := step.(yaml.MapSlice)
+		if !ok {
+			// Plain string steps like "wait" don't have attributes
+			filtered = append(filtered, step)
+			continue
+		}
+
+		if item, has := mapSliceItem(IfChangedKey, s); has {
+			globs, err := ifChangedGlobs(item.Value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Step %q: %v", stepName(s), err)
+			}
+
+			s = removeSliceItem(IfChangedKey, s)
+
+			if changed != nil && !anyPathMatches(globs, changed) {
+				dropped = append(dropped, stepName(s))
+				continue
+			}
+		}
+
+		// Group steps have their own list of steps which need filtering too
+		if item, has := mapSliceItem("steps", s); has {
+			if nested, ok := item.Value.([]interface{}); ok {
+				nestedFiltered, nestedDropped, err := filterStepsIfChanged(nested, changed)
+				if err != nil {
+					return nil, nil, err
+				}
+				dropped = append(dropped, nestedDropped...)
+
+				if len(nested) > 0 && len(nestedFiltered) == 0 {
+					dropped = append(dropped, stepName(s))
+					continue
+				}
+				s = upsertSliceItem("steps", s, nestedFiltered)
+			}
+		}
+
+		filtered = append(filtered, s)
+	}
+
+	return filtered, dropped, nil
+}
+
+// removeDependencies removes any depends_on references to keys from the
+// steps, and the steps within them. depends_on is removed altogether if it's
+// left empty.
+func removeDependencies(steps []interface{}, keys map[string]bool) []interface{} {
+	result := make([]interface{}, 0, len(steps))
+	for _, step := range steps {
+		s, ok := step.(yaml.MapSlice)
+		if !ok {
+			result = append(result, step)
+			continue
+		}
+
+		if item, has := mapSliceItem("depends_on", s); has {
+			switch tv := item.Value.(type) {
+			case string:
+				if keys[tv] {
+					s = removeSliceItem("depends_on", s)
+				}
+			case []interface{}:
+				deps := make([]interface{}, 0, len(tv))
+				for _, d := range tv {
+					if key, ok := dependencyKey(d); ok && keys[key] {
+						continue
+					}
+					deps = append(deps, d)
+				}
+				if len(deps) == 0 {
+					s = removeSliceItem("depends_on", s)
+				} else if len(deps) < len(tv) {
+					s = upsertSliceItem("depends_on", s, deps)
+				}
+			}
+		}
+
+		if item, has := mapSliceItem("steps", s); has {
+			if nested, ok := item.Value.([]interface{}); ok {
+				s = upsertSliceItem("steps", s, removeDependencies(nested, keys))
+			}
+		}
+
+		result = append(result, s)
+	}
+	return result
+}
+
+// dependencyKey returns the key of an entry in a list of dependencies, which
+// is either the key itself or a {step: key} map
+func dependencyKey(d interface{}) (string, bool) {
+	switch dv := d.(type) {
+	case string:
+		return dv, true
+	case yaml.MapSlice:
+		if item, ok := mapSliceItem("step", dv); ok {
+			v, ok := item.Value.(string)
+			return v, ok
+		}
+	}
+	return "", false
+}
+
+// ifChangedGlobs accepts either a single glob or a list of them
+func ifChangedGlobs(v interface{}) ([]string, error) {
+	switch tv := v.(type) {
+	case string:
+		return []string{tv}, nil
+	case []interface{}:
+		globs := make([]string, 0, len(tv))
+		for _, g := range tv {
+			s, ok := g.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected %s to be a list of strings, got %T", IfChangedKey, g)
+			}
+			globs = append(globs, s)
+		}
+		return globs, nil
+	default:
+		return nil, fmt.Errorf("Expected %s to be a string or list of strings, got %T", IfChangedKey, v)
+	}
+}
+
+func anyPathMatches(globs, paths []string) bool {
+	for _, g := range globs {
+		for _, p := range paths {
+			if matchChangedPath(g, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchChangedPath matches a slash-separated path against a glob. As well as
+// the usual zglob syntax, a glob that ends in a slash or /** matches everything
+// underneath that directory.
+func matchChangedPath(glob, p string) bool {
+	glob = strings.TrimPrefix(glob, "./")
+	p = path.Clean(p)
+
+	if glob == "**" {
+		return true
+	}
+
+	if strings.HasSuffix(glob, "/") || strings.HasSuffix(glob, "/**") {
+		dir := strings.TrimSuffix(strings.TrimSuffix(glob, "**"), "/")
+		if !strings.ContainsAny(dir, "*?[") {
+			return p == dir || strings.HasPrefix(p, dir+"/")
+		}
+	}
+
+	matched, err := zglob.Match(glob, p)
+	return err == nil && matched
+}
+
+func stepName(s yaml.MapSlice) string {
+	for _, key := range []string{"label", "name", "group", "key", "id", "command", "trigger"} {
+		if item, ok := mapSliceItem(key, s); ok {
+			if v, ok := item.Value.(string); ok && v != "" {
+				return v
+			}
+		}
+	}
+	return "(unnamed step)"
+}
+
+func removeSliceItem(key string, s yaml.MapSlice) yaml.MapSlice {
+	result := make(yaml.MapSlice, 0, len(s))
+	for _, item := range s {
+		if k, ok := item.Key.(string); ok && k == key {
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
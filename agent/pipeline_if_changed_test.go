@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineFilterIfChanged(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - label: "app"
+    command: make app
+    if_changed: "app/**"
+  - label: "docs"
+    command: make docs
+    if_changed:
+      - "*.md"
+      - "docs/"
+  - wait
+  - label: "always"
+    command: make all
+`),
+	}.Parse()
+	require.NoError(t, err)
+	assert.True(t, result.HasIfChanged())
+
+	dropped, err := result.FilterIfChanged([]string{"app/main.go", "lib/util.go"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs"}, dropped)
+	assert.False(t, result.HasIfChanged())
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"label":"app","command":"make app"},"wait",{"label":"always","command":"make all"}]}`, string(j))
+}
+
+func TestPipelineFilterIfChangedGroups(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - group: "frontend"
+    steps:
+      - label: "lint"
+        command: make lint
+        if_changed: "web/**/*.js"
+      - label: "css"
+        command: make css
+        if_changed: "web/**/*.css"
+  - group: "backend"
+    if_changed: "api/"
+    steps:
+      - command: make api
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	dropped, err := result.FilterIfChanged([]string{"web/src/index.js"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"css", "backend"}, dropped)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"group":"frontend","steps":[{"label":"lint","command":"make lint"}]}]}`, string(j))
+
+	// A group that loses all of its steps is dropped too
+	result, err = PipelineParser{
+		Pipeline: []byte(`steps:
+  - group: "frontend"
+    steps:
+      - label: "lint"
+        command: make lint
+        if_changed: "web/**"
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	dropped, err = result.FilterIfChanged([]string{"README.md"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lint", "frontend"}, dropped)
+
+	j, err = json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[]}`, string(j))
+}
+
+func TestPipelineFilterIfChangedRemovesDependenciesOnDroppedSteps(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - key: "app"
+    command: make app
+    if_changed: "app/**"
+  - group: "docs"
+    if_changed: "docs/**"
+    steps:
+      - key: "docs-build"
+        command: make docs
+  - key: "lib"
+    command: make lib
+  - command: deploy app
+    depends_on: "app"
+  - command: deploy docs
+    depends_on:
+      - step: "docs-build"
+        allow_failure: true
+      - "lib"
+  - command: deploy everything
+    depends_on: ["app", "docs-build"]
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	dropped, err := result.FilterIfChanged([]string{"lib/util.go"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app", "docs"}, dropped)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"key":"lib","command":"make lib"},{"command":"deploy app"},{"command":"deploy docs","depends_on":["lib"]},{"command":"deploy everything"}]}`, string(j))
+}
+
+func TestPipelineFilterIfChangedWithoutChangedPaths(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: make\n    if_changed: src/**\n"),
+	}.Parse()
+	require.NoError(t, err)
+
+	dropped, err := result.FilterIfChanged(nil)
+	require.NoError(t, err)
+	assert.Empty(t, dropped)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make"}]}`, string(j))
+}
+
+func TestPipelineFilterIfChangedRejectsInvalidGlobs(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - label: bad\n    if_changed: {foo: bar}\n"),
+	}.Parse()
+	require.NoError(t, err)
+
+	_, err = result.FilterIfChanged([]string{"foo"})
+	assert.EqualError(t, err, `Step "bad": Expected if_changed to be a string or list of strings, got yaml.MapSlice`)
+}
+
+func TestMatchChangedPath(t *testing.T) {
+	for _, tc := range []struct {
+		glob, path string
+		expected   bool
+	}{
+		{"app/**", "app/x/y.go", true},
+		{"app/**", "application/y.go", false},
+		{"app/", "app/y.go", true},
+		{"./app/**/*.go", "app/y.go", true},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"**/*.md", "docs/README.md", true},
+		{"**", "anything/at/all", true},
+		{"go.mod", "go.mod", true},
+		{"go.mod", "sub/go.mod", false},
+	} {
+		assert.Equal(t, tc.expected, matchChangedPath(tc.glob, tc.path), "%q matching %q", tc.glob, tc.path)
+	}
+}
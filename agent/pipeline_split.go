@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/yamltojson"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// Split breaks the pipeline into an ordered set of pipelines whose JSON
+// encodings are no bigger than maxSize bytes, so they can be uploaded in
+// separate requests. If the pipeline already fits it's returned as is.
+//
+// Top-level steps are never split, so group steps stay together. A step that
+// depends on a key belonging to a later step is kept in the same batch as that
+// step, so that every depends_on refers to a step in the same or an earlier
+// batch. Top-level attributes such as env and agents are copied into every
+// batch, except notify which is only sent with the last one.
+//
+// A step (or set of steps that must stay together) that is bigger than maxSize
+// on its own is put in a batch by itself.
+func (p *PipelineParserResult) Split(maxSize int) ([]*PipelineParserResult, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Maximum upload size must be a positive number of bytes, got %d", maxSize)
+	}
+
+	whole, err := p.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if len(whole) <= maxSize {
+		return []*PipelineParserResult{p}, nil
+	}
+
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return []*PipelineParserResult{p}, nil
+	}
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected pipeline steps to be a list, got %T", item.Value)
+	}
+
+	// Find the size of a batch without any steps in it, so that we can add up
+	// step sizes rather than re-encode each candidate batch. This includes
+	// notify, so it's an upper bound for all but the last batch.
+	overhead, err := yamltojson.MarshalMapSliceJSON(p.batch(nil, true))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		batches [][]interface{}
+		current []interface{}
+		size    = len(overhead)
+	)
+
+	for _, segment := range stepSegments(steps) {
+		segmentSize := 0
+		for _, step := range segment {
+			j, err := yamltojson.MarshalMapSliceJSON(yaml.MapSlice{{Key: "s", Value: step}})
+			if err != nil {
+				return nil, err
+			}
+			// Less the {"s":} wrapper, plus a separating comma
+			segmentSize += len(j) - 6 + 1
+		}
+
+		if len(current) > 0 && size+segmentSize > maxSize {
+			batches = append(batches, current)
+			current, size = nil, len(overhead)
+		}
+
+		current = append(current, segment...)
+		size += segmentSize
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	results := make([]*PipelineParserResult, 0, len(batches))
+	for i, batch := range batches {
+		results = append(results, &PipelineParserResult{
+			pipeline: p.batch(batch, i == len(batches)-1),
+		})
+	}
+
+	return results, nil
+}
+
+// batch returns a copy of the top-level pipeline with the given steps
+func (p *PipelineParserResult) batch(steps []interface{}, last bool) yaml.MapSlice {
+	if steps == nil {
+		steps = []interface{}{}
+	}
+
+	result := make(yaml.MapSlice, 0, len(p.pipeline))
+	for _, item := range p.pipeline {
+		switch item.Key {
+		case "steps":
+			result = append(result, yaml.MapItem{Key: item.Key, Value: steps})
+		case "notify":
+			if last {
+				result = append(result, item)
+			}
+		default:
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// stepSegments groups consecutive top-level steps that have to be uploaded
+// together because of forward depends_on references
+func stepSegments(steps []interface{}) [][]interface{} {
+	// Where each key is defined
+	defined := map[string]int{}
+	for i, step := range steps {
+		for _, key := range stepKeys(step) {
+			defined[key] = i
+		}
+	}
+
+	// The furthest step that each step has to be uploaded with
+	reach := make([]int, len(steps))
+	for i, step := range steps {
+		reach[i] = i
+		for _, dep := range stepDependencies(step) {
+			if j, ok := defined[dep]; ok && j > reach[i] {
+				reach[i] = j
+			}
+		}
+	}
+
+	var segments [][]interface{}
+	for start := 0; start < len(steps); {
+		end := reach[start]
+		for k := start; k <= end; k++ {
+			if reach[k] > end {
+				end = reach[k]
+			}
+		}
+		segments = append(segments, steps[start:end+1])
+		start = end + 1
+	}
+
+	return segments
+}
+
+// stepKeys returns the keys (or ids) of a step, and of any steps within it
+func stepKeys(step interface{}) []string {
+	s, ok := step.(yaml.MapSlice)
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for _, attr := range []string{"key", "id", "identifier"} {
+		if item, ok := mapSliceItem(attr, s); ok {
+			if v, ok := item.Value.(string); ok && v != "" {
+				keys = append(keys, v)
+			}
+		}
+	}
+	if item, ok := mapSliceItem("steps", s); ok {
+		if nested, ok := item.Value.([]interface{}); ok {
+			for _, n := range nested {
+				keys = append(keys, stepKeys(n)...)
+			}
+		}
+	}
+
+	return keys
+}
+
+// stepDependencies returns the keys that a step, or any steps within it,
+// depends on. depends_on may be a string, a list of strings, or a list of
+// {step: key} maps.
+func stepDependencies(step interface{}) []string {
+	s, ok := step.(yaml.MapSlice)
+	if !ok {
+		return nil
+	}
+
+	var deps []string
+	if item, ok := mapSliceItem("depends_on", s); ok {
+		switch tv := item.Value.(type) {
+		case string:
+			deps = append(deps, tv)
+		case []interface{}:
+			for _, d := range tv {
+				switch dv := d.(type) {
+				case string:
+					deps = append(deps, dv)
+				case yaml.MapSlice:
+					if stepItem, ok := mapSliceItem("step", dv); ok {
+						if v, ok := stepItem.Value.(string); ok {
+							deps = append(deps, v)
+						}
+					}
+				}
+			}
+		}
+	}
+	if item, ok := mapSliceItem("steps", s); ok {
+		if nested, ok := item.Value.([]interface{}); ok {
+			for _, n := range nested {
+				deps = append(deps, stepDependencies(n)...)
+			}
+		}
+	}
+
+	return deps
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func marshalBatches(t *testing.T, batches []*PipelineParserResult) []string {
+	t.Helper()
+
+	var result []string
+	for _, b := range batches {
+		j, err := json.Marshal(b)
+		require.NoError(t, err)
+		result = append(result, string(j))
+	}
+	return result
+}
+
+func TestPipelineSplitReturnsSmallPipelinesUnchanged(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: one\n  - command: two\n"),
+	}.Parse()
+	require.NoError(t, err)
+
+	batches, err := result.Split(1024)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	assert.Same(t, result, batches[0])
+}
+
+func TestPipelineSplitPreservesOrderAndTopLevelAttributes(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("env:\n  FOO: bar\nnotify:\n  - email: dev@example.com\nsteps:\n")
+	for i := 1; i <= 6; i++ {
+		fmt.Fprintf(&b, "  - command: step-%d\n", i)
+	}
+
+	result, err := PipelineParser{Pipeline: []byte(b.String())}.Parse()
+	require.NoError(t, err)
+
+	// Each batch fits a couple of steps along with the top-level env
+	batches, err := result.Split(120)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`{"env":{"FOO":"bar"},"steps":[{"command":"step-1"},{"command":"step-2"}]}`,
+		`{"env":{"FOO":"bar"},"steps":[{"command":"step-3"},{"command":"step-4"}]}`,
+		`{"env":{"FOO":"bar"},"notify":[{"email":"dev@example.com"}],"steps":[{"command":"step-5"},{"command":"step-6"}]}`,
+	}, marshalBatches(t, batches))
+}
+
+func TestPipelineSplitKeepsGroupsAndForwardDependenciesTogether(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: first
+    depends_on:
+      - step: later
+  - command: middle
+  - command: last
+    key: later
+  - group: together
+    steps:
+      - command: a
+      - command: b
+  - command: tail
+    depends_on: later
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	batches, err := result.Split(50)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`{"steps":[{"command":"first","depends_on":[{"step":"later"}]},{"command":"middle"},{"command":"last","key":"later"}]}`,
+		`{"steps":[{"group":"together","steps":[{"command":"a"},{"command":"b"}]}]}`,
+		`{"steps":[{"command":"tail","depends_on":"later"}]}`,
+	}, marshalBatches(t, batches))
+}
+
+func TestPipelineSplitBatchesFitWithinMaxSize(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("steps:\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&b, "  - label: \"Step %d\"\n    command: ./run.sh %d\n", i, i)
+	}
+
+	result, err := PipelineParser{Pipeline: []byte(b.String())}.Parse()
+	require.NoError(t, err)
+
+	batches, err := result.Split(2000)
+	require.NoError(t, err)
+	assert.Greater(t, len(batches), 1)
+
+	var commands int
+	for _, j := range marshalBatches(t, batches) {
+		assert.LessOrEqual(t, len(j), 2000)
+		commands += strings.Count(j, `"command"`)
+	}
+	assert.Equal(t, 500, commands)
+}
+
+func TestPipelineSplitRejectsMaxSizesThatArentPositive(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: one\n"),
+	}.Parse()
+	require.NoError(t, err)
+
+	for _, maxSize := range []int{0, -1} {
+		_, err := result.Split(maxSize)
+		assert.Error(t, err, "maxSize %d", maxSize)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/yamltojson"
 	"github.com/buildkite/yaml"
@@ -22,6 +23,48 @@ type Definition struct {
 	Name          string                 `json:"name"`
 	Requirements  []string               `json:"requirements"`
 	Configuration *jsonschema.RootSchema `json:"configuration"`
+
+	// Hooks that are run directly rather than sourced, for hooks that are
+	// programs or scripts in a language other than the shell's
+	ExecutableHooks []string `json:"executable_hooks"`
+
+	// Settings for each of the plugin's hooks, by the hook's name
+	Hooks map[string]HookDefinition `json:"hooks"`
+}
+
+// HookDefinition is the settings for one of a plugin's hooks
+type HookDefinition struct {
+	// How long the hook can run for, like 5m
+	Timeout string `json:"timeout"`
+}
+
+// HookTimeout returns how long the plugin's hook of a name can run for, or 0
+// if it can run for as long as it likes
+func (def *Definition) HookTimeout(name string) (time.Duration, error) {
+	hook, ok := def.Hooks[name]
+	if !ok || hook.Timeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(hook.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timeout for %s hook: %v", name, err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("Invalid timeout for %s hook: timeout must be positive, got %q", name, hook.Timeout)
+	}
+	return timeout, nil
+}
+
+// IsExecutableHook returns whether the plugin's hook of a name should be run
+// directly rather than sourced
+func (def *Definition) IsExecutableHook(name string) bool {
+	for _, hook := range def.ExecutableHooks {
+		if hook == name {
+			return true
+		}
+	}
+	return false
 }
 
 // ParseDefinition parses either yaml or json bytes into a Definition
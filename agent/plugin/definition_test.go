@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"testing"
+	"time"
 
 	"github.com/qri-io/jsonschema"
 	"github.com/stretchr/testify/assert"
@@ -37,6 +38,31 @@ func TestDefinitionParsesYaml(t *testing.T) {
 	assert.Equal(t, def.Requirements, []string{`docker`, `docker-compose`})
 }
 
+func TestDefinitionParsesExecutableHooks(t *testing.T) {
+	def, err := ParseDefinition([]byte("name: test-plugin\nexecutable_hooks:\n  - environment\n  - command\n"))
+
+	assert.NoError(t, err)
+	assert.True(t, def.IsExecutableHook("environment"))
+	assert.True(t, def.IsExecutableHook("command"))
+	assert.False(t, def.IsExecutableHook("post-command"))
+}
+
+func TestDefinitionParsesHookTimeouts(t *testing.T) {
+	def, err := ParseDefinition([]byte("name: test-plugin\nhooks:\n  pre-exit:\n    timeout: 90s\n  command:\n    timeout: soon\n"))
+	assert.NoError(t, err)
+
+	timeout, err := def.HookTimeout("pre-exit")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	timeout, err = def.HookTimeout("post-command")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	_, err = def.HookTimeout("command")
+	assert.EqualError(t, err, `Invalid timeout for command hook: time: invalid duration "soon"`)
+}
+
 func TestDefinitionValidationFailsIfDependenciesNotMet(t *testing.T) {
 	validator := &Validator{
 		commandExists: func(cmd string) bool {
@@ -28,6 +28,10 @@ type Plugin struct {
 	// Whether the plugin refers to a vendored path
 	Vendored bool
 
+	// The expected SHA-256 of the plugin's archive, for plugins that are
+	// downloaded as a tarball rather than cloned
+	SHA256 string
+
 	// Configuration for the plugin
 	Configuration map[string]interface{}
 }
@@ -35,6 +39,8 @@ type Plugin struct {
 var (
 	locationSchemeRegex = regexp.MustCompile(`^[a-z\+]+://`)
 	vendoredRegex       = regexp.MustCompile(`^\.`)
+	archiveRegex        = regexp.MustCompile(`\.(tar\.gz|tgz)$`)
+	sha256Regex         = regexp.MustCompile(`^sha256=([0-9a-f]{64})$`)
 )
 
 func CreatePlugin(location string, config map[string]interface{}) (*Plugin, error) {
@@ -58,9 +64,25 @@ func CreatePlugin(location string, config map[string]interface{}) (*Plugin, erro
 		plugin.Authentication = u.User.String()
 	}
 
+	// Archives aren't versioned like repositories, so they have to be
+	// pinned to their contents instead
+	if plugin.IsArchive() {
+		m := sha256Regex.FindStringSubmatch(plugin.Version)
+		if m == nil {
+			return nil, fmt.Errorf("Plugin archive %q must end with a checksum, like #sha256=<hex digest>", location)
+		}
+		plugin.SHA256 = m[1]
+	}
+
 	return plugin, nil
 }
 
+// IsArchive returns whether the plugin is a tarball to download, either from
+// a URL or a file:// path, rather than a repository to clone
+func (p *Plugin) IsArchive() bool {
+	return !p.Vendored && archiveRegex.MatchString(p.Location)
+}
+
 // Given a JSON structure, convert it to an array of plugins
 func CreateFromJSON(j string) ([]*Plugin, error) {
 	// Use more versatile number decoding
@@ -138,6 +160,7 @@ func (p *Plugin) Name() string {
 
 		// Clean up the name
 		name = strings.ToLower(name)
+		name = archiveRegex.ReplaceAllString(name, "")
 		name = regexp.MustCompile(`\s+`).ReplaceAllString(name, " ")
 		name = regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAllString(name, "-")
 		name = strings.Replace(name, "-buildkite-plugin-git", "", -1)
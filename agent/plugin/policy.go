@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// Policy restricts the plugins an agent will run to those from allowed
+// repositories. A plugin is denied if it matches any of the deny rules, or if
+// there are allow rules and it matches none of them. For example:
+//
+//	allow:
+//	  - repository: https://github.com/my-org/*
+//	  - repository: https://github.com/buildkite-plugins/docker-compose-buildkite-plugin
+//	    version: ">= 3.0.0, < 4"
+//	deny:
+//	  - repository: https://github.com/my-org/experimental-*
+type Policy struct {
+	Allow []PolicyRule `yaml:"allow"`
+	Deny  []PolicyRule `yaml:"deny"`
+}
+
+// PolicyRule matches plugins by their repository, and optionally their version
+type PolicyRule struct {
+	// A glob matched against the plugin's repository, without any
+	// credentials. As with path.Match, * doesn't match a /.
+	Repository string `yaml:"repository"`
+
+	// Either a glob matched against the plugin's version, like "v3.*", or a
+	// comma separated list of comparisons, like ">= 3.0.0, < 4". Empty
+	// matches any version.
+	Version string `yaml:"version"`
+}
+
+// LoadPolicy reads and validates a plugins policy from a YAML file
+func LoadPolicy(filename string) (*Policy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(b)
+}
+
+// ParsePolicy parses and validates a plugins policy
+func ParsePolicy(b []byte) (*Policy, error) {
+	var policy Policy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+
+	for _, rules := range [][]PolicyRule{policy.Allow, policy.Deny} {
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// Check returns an error naming the plugin and the reason if the policy
+// doesn't allow it
+func (policy *Policy) Check(p *Plugin) error {
+	// Credentials aren't part of where a plugin comes from
+	withoutAuth := *p
+	withoutAuth.Authentication = ""
+
+	repository, err := withoutAuth.Repository()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range policy.Deny {
+		if rule.matches(repository, p.Version) {
+			return fmt.Errorf("Plugin %q from %s is denied by the agent's plugins policy (%s)", p.Label(), repository, rule)
+		}
+	}
+
+	if len(policy.Allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range policy.Allow {
+		if rule.matches(repository, p.Version) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Plugin %q from %s isn't allowed by the agent's plugins policy", p.Label(), repository)
+}
+
+func (rule PolicyRule) String() string {
+	if rule.Version != "" {
+		return fmt.Sprintf("repository %q, version %q", rule.Repository, rule.Version)
+	}
+	return fmt.Sprintf("repository %q", rule.Repository)
+}
+
+func (rule PolicyRule) validate() error {
+	if rule.Repository == "" {
+		return fmt.Errorf("Plugins policy rule is missing a repository")
+	}
+	if _, err := path.Match(rule.Repository, ""); err != nil {
+		return fmt.Errorf("Invalid repository pattern %q in plugins policy: %v", rule.Repository, err)
+	}
+
+	if isVersionComparison(rule.Version) {
+		if _, err := parseVersionComparisons(rule.Version); err != nil {
+			return fmt.Errorf("Invalid version constraint %q in plugins policy: %v", rule.Version, err)
+		}
+	} else if _, err := path.Match(rule.Version, ""); err != nil {
+		return fmt.Errorf("Invalid version pattern %q in plugins policy: %v", rule.Version, err)
+	}
+
+	return nil
+}
+
+func (rule PolicyRule) matches(repository, version string) bool {
+	if ok, _ := path.Match(rule.Repository, repository); !ok {
+		return false
+	}
+
+	if rule.Version == "" {
+		return true
+	}
+
+	if !isVersionComparison(rule.Version) {
+		ok, _ := path.Match(rule.Version, version)
+		return ok
+	}
+
+	comparisons, _ := parseVersionComparisons(rule.Version)
+	for _, c := range comparisons {
+		if !c.matches(version) {
+			return false
+		}
+	}
+	return true
+}
+
+type versionComparison struct {
+	op      string
+	version []int
+}
+
+func isVersionComparison(constraint string) bool {
+	return strings.ContainsAny(constraint, "<>=!")
+}
+
+func parseVersionComparisons(constraint string) ([]versionComparison, error) {
+	var comparisons []versionComparison
+
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+
+		var op string
+		for _, candidate := range []string{">=", "<=", "!=", "=", ">", "<"} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("expected a comparison like \">= 1.2.0\", got %q", part)
+		}
+
+		version, ok := parseVersion(strings.TrimSpace(strings.TrimPrefix(part, op)))
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a version number", part)
+		}
+
+		comparisons = append(comparisons, versionComparison{op: op, version: version})
+	}
+
+	return comparisons, nil
+}
+
+// matches returns whether a plugin version satisfies the comparison. Versions
+// that aren't numbers, such as branch names, never do.
+func (c versionComparison) matches(version string) bool {
+	parsed, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+
+	cmp := compareVersions(parsed, c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// parseVersion parses a version like "v1.2.3" into its numbers
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(version, "v")
+	if version == "" {
+		return nil, false
+	}
+
+	var parsed []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parsed = append(parsed, n)
+	}
+
+	return parsed, true
+}
+
+// compareVersions compares two versions, with missing numbers treated as 0
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
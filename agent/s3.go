@@ -3,6 +3,7 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 
@@ -17,7 +18,17 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 )
 
-const regionHintEnvVar = "BUILDKITE_S3_DEFAULT_REGION"
+const (
+	regionHintEnvVar = "BUILDKITE_S3_DEFAULT_REGION"
+
+	// An endpoint for an S3 compatible store, like MinIO or Ceph RGW, such as
+	// http://localhost:9000
+	endpointEnvVar = "BUILDKITE_S3_ENDPOINT"
+
+	// Whether to address buckets in the path of the endpoint rather than its
+	// host name, which S3 compatible stores often need
+	forcePathStyleEnvVar = "BUILDKITE_S3_FORCE_PATH_STYLE"
+)
 
 type buildkiteEnvProvider struct {
 	retrieved bool
@@ -65,6 +76,11 @@ func awsS3Session(region string) (*session.Session, error) {
 
 	sess.Config.Region = aws.String(region)
 
+	if endpoint := os.Getenv(endpointEnvVar); endpoint != "" {
+		sess.Config.Endpoint = aws.String(endpoint)
+	}
+	sess.Config.S3ForcePathStyle = aws.Bool(s3ForcePathStyle())
+
 	sess.Config.Credentials = credentials.NewChainCredentials(
 		[]credentials.Provider{
 			&buildkiteEnvProvider{},
@@ -98,6 +114,16 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
 		}
 
+		sess = session
+	} else if endpoint := os.Getenv(endpointEnvVar); endpoint != "" {
+		// S3 compatible stores can't be asked where a bucket lives like S3
+		// can, and most of them don't care about regions anyway
+		l.Debug("Using S3 endpoint %q from environment variable %q", endpoint, endpointEnvVar)
+		session, err := awsS3Session("us-east-1")
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
+		}
+
 		sess = session
 	} else {
 		// Otherwise, use the current region (or a guess) to dynamically find
@@ -154,3 +180,29 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 
 	return s3client, nil
 }
+
+// s3ForcePathStyle returns whether buckets should be addressed in the path of
+// the endpoint, like http://localhost:9000/my-bucket, rather than its host name
+func s3ForcePathStyle() bool {
+	return strings.ToLower(os.Getenv(forcePathStyleEnvVar)) == "true"
+}
+
+// s3BucketURL returns the URL of a bucket on an S3 endpoint, addressed either
+// by its path or its host name
+func s3BucketURL(endpoint, bucket string, pathStyle bool) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("expected an endpoint URL like https://s3.example.com, got %q", endpoint)
+	}
+
+	if pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+
+	return u, nil
+}
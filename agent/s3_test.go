@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setFakeS3Env points the S3 client at a fake S3 server
+func setFakeS3Env(t *testing.T, endpoint string) {
+	t.Setenv("BUILDKITE_S3_ENDPOINT", endpoint)
+	t.Setenv("BUILDKITE_S3_FORCE_PATH_STYLE", "true")
+	t.Setenv("BUILDKITE_S3_ACCESS_KEY_ID", "llamas")
+	t.Setenv("BUILDKITE_S3_SECRET_ACCESS_KEY", "alpacas")
+	t.Setenv("BUILDKITE_S3_DEFAULT_REGION", "")
+	t.Setenv("BUILDKITE_S3_ACCESS_URL", "")
+}
+
+func TestS3BucketURL(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		endpoint  string
+		pathStyle bool
+		expected  string
+	}{
+		{"http://localhost:9000", true, "http://localhost:9000/my-bucket"},
+		{"http://localhost:9000/", true, "http://localhost:9000/my-bucket"},
+		{"https://minio.example.com/s3", true, "https://minio.example.com/s3/my-bucket"},
+		{"https://minio.example.com", false, "https://my-bucket.minio.example.com"},
+	} {
+		u, err := s3BucketURL(tc.endpoint, "my-bucket", tc.pathStyle)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, u.String())
+	}
+
+	_, err := s3BucketURL("minio.example.com", "my-bucket", true)
+	assert.Error(t, err)
+}
+
+func TestS3UploaderURLWithCustomEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		pathStyle   string
+		destination string
+		expected    string
+	}{
+		{"true", "s3://my-bucket", "https://minio.example.com/my-bucket/llamas.txt"},
+		{"true", "s3://my-bucket/builds/1", "https://minio.example.com/my-bucket/builds/1/llamas.txt"},
+		{"false", "s3://my-bucket/builds/1", "https://my-bucket.minio.example.com/builds/1/llamas.txt"},
+	} {
+		t.Setenv("BUILDKITE_S3_ENDPOINT", "https://minio.example.com")
+		t.Setenv("BUILDKITE_S3_FORCE_PATH_STYLE", tc.pathStyle)
+		t.Setenv("BUILDKITE_S3_ACCESS_URL", "")
+
+		bucketName, bucketPath := ParseS3Destination(tc.destination)
+		uploader := &S3Uploader{BucketName: bucketName, BucketPath: bucketPath}
+
+		assert.Equal(t, tc.expected, uploader.URL(&api.Artifact{Path: "llamas.txt"}))
+	}
+}
+
+func TestS3ArtifactsWithCustomEndpoint(t *testing.T) {
+	s3 := newFakeS3("my-bucket")
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/builds/") {
+			s3.ServeHTTP(rw, req)
+			return
+		}
+
+		// The Buildkite API, which finds the artifact that was uploaded
+		fmt.Fprint(rw, `[{
+			"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+			"file_size": 6,
+			"absolute_path": "llamas.txt",
+			"path": "llamas.txt",
+			"upload_destination": "s3://my-bucket/builds/1"
+		}]`)
+	}))
+	defer server.Close()
+
+	setFakeS3Env(t, server.URL)
+	t.Setenv("BUILDKITE_S3_ACL", "private")
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{Destination: "s3://my-bucket/builds/1"})
+	require.NoError(t, err)
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(src, []byte("llamas"), 0600))
+
+	artifact := &api.Artifact{AbsolutePath: src, Path: "llamas.txt", ContentType: "text/plain"}
+	require.NoError(t, uploader.Upload(artifact))
+
+	data, ok := s3.Object("my-bucket", "builds/1/llamas.txt")
+	require.True(t, ok, "expected the artifact to be uploaded")
+	assert.Equal(t, "llamas", string(data))
+	assert.Equal(t, server.URL+"/my-bucket/builds/1/llamas.txt", uploader.URL(artifact))
+
+	dest := t.TempDir()
+	downloader := NewArtifactDownloader(logger.Discard, api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	}), ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dest,
+	})
+	require.NoError(t, downloader.Download())
+
+	data, err = ioutil.ReadFile(filepath.Join(dest, "llamas.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+}
+
+func TestS3ClientWithCustomEndpointChecksTheBucketExists(t *testing.T) {
+	server := httptest.NewServer(newFakeS3("my-bucket"))
+	defer server.Close()
+
+	setFakeS3Env(t, server.URL)
+
+	_, err := NewS3Client(logger.Discard, "not-my-bucket")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NoSuchBucket")
+}
+
+func TestS3MultipartUploadsAreResumed(t *testing.T) {
+	withoutUploadRetryDelays(t)
+
+	s3 := newFakeS3("my-bucket")
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	setFakeS3Env(t, server.URL)
+	t.Setenv("BUILDKITE_S3_ACL", "private")
+	t.Setenv("BUILDKITE_JOB_TMPDIR", t.TempDir())
+	t.Setenv(uploadPartSizeEnvVar, strconv.Itoa(s3MinPartSize))
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{Destination: "s3://my-bucket/builds/1"})
+	require.NoError(t, err)
+
+	// Three parts, the last of them smaller
+	contents := bytes.Repeat([]byte("llamas"), (2*s3MinPartSize+1024)/6)
+	src := filepath.Join(t.TempDir(), "llamas.bin")
+	require.NoError(t, ioutil.WriteFile(src, contents, 0600))
+	artifact := &api.Artifact{AbsolutePath: src, Path: "llamas.bin", ContentType: "application/octet-stream"}
+
+	s3.FailPart = func(part int) bool { return part == 2 }
+	require.Error(t, uploader.Upload(artifact))
+
+	_, ok := s3.Object("my-bucket", "builds/1/llamas.bin")
+	require.False(t, ok, "expected the upload not to be complete")
+
+	s3.FailPart = nil
+	s3.UploadedParts = nil
+	require.NoError(t, uploader.Upload(artifact))
+
+	// Only the part that failed is uploaded again
+	assert.Equal(t, []int{2}, s3.UploadedParts)
+
+	data, ok := s3.Object("my-bucket", "builds/1/llamas.bin")
+	require.True(t, ok, "expected the artifact to be uploaded")
+	assert.True(t, bytes.Equal(contents, data), "expected the artifact to be uploaded intact")
+}
+
+func TestS3MultipartUploadsThatAreGivenUpOnAreAborted(t *testing.T) {
+	withoutUploadRetryDelays(t)
+
+	s3 := newFakeS3("my-bucket")
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	setFakeS3Env(t, server.URL)
+	t.Setenv("BUILDKITE_S3_ACL", "private")
+	t.Setenv("BUILDKITE_JOB_TMPDIR", t.TempDir())
+	t.Setenv(uploadPartSizeEnvVar, strconv.Itoa(s3MinPartSize))
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{Destination: "s3://my-bucket/builds/1"})
+	require.NoError(t, err)
+
+	contents := bytes.Repeat([]byte("llamas"), (2*s3MinPartSize+1024)/6)
+	src := filepath.Join(t.TempDir(), "llamas.bin")
+	require.NoError(t, ioutil.WriteFile(src, contents, 0600))
+	artifact := &api.Artifact{AbsolutePath: src, Path: "llamas.bin", ContentType: "application/octet-stream"}
+
+	s3.FailPart = func(part int) bool { return part == 2 }
+	require.Error(t, uploader.Upload(artifact))
+	require.Equal(t, 1, s3.Uploads())
+
+	state, ok := inProgressMultipartUpload("s3://my-bucket/builds/1/llamas.bin")
+	require.True(t, ok, "expected the upload to be in progress")
+
+	uploader.abort(artifact)
+	assert.Equal(t, 0, s3.Uploads())
+
+	// And it's started again next time
+	_, ok = inProgressMultipartUpload("s3://my-bucket/builds/1/llamas.bin")
+	assert.False(t, ok, "expected the upload to be forgotten")
+	_, err = os.Stat(state.path)
+	assert.True(t, os.IsNotExist(err), "expected the upload's state to be removed")
+}
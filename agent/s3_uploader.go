@@ -2,6 +2,7 @@ package agent
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -13,6 +14,13 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 )
 
+// S3 parts must be at least 5MiB, other than the last, and there can be no
+// more than 10,000 of them
+const (
+	s3MinPartSize = 5 * 1024 * 1024
+	s3MaxParts    = 10000
+)
+
 type S3UploaderConfig struct {
 	// The destination which includes the S3 bucket name and the path.
 	// For example, s3://my-bucket-name/foo/bar
@@ -71,6 +79,13 @@ func (u *S3Uploader) URL(artifact *api.Artifact) string {
 
 	if os.Getenv("BUILDKITE_S3_ACCESS_URL") != "" {
 		baseUrl = os.Getenv("BUILDKITE_S3_ACCESS_URL")
+	} else if endpoint := os.Getenv(endpointEnvVar); endpoint != "" {
+		bucketURL, err := s3BucketURL(endpoint, u.BucketName, s3ForcePathStyle())
+		if err == nil {
+			bucketURL.Path = strings.TrimSuffix(bucketURL.Path, "/") + "/" + strings.TrimPrefix(u.artifactPath(artifact), "/")
+			return bucketURL.String()
+		}
+		u.logger.Warn("Invalid %s (%v)", endpointEnvVar, err)
 	}
 
 	url, _ := url.Parse(baseUrl)
@@ -87,15 +102,30 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 		return err
 	}
 
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploaderWithClient(u.client)
-
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
 	f, err := os.Open(artifact.AbsolutePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Large files are uploaded in parts that can be resumed
+	partSize, err := uploadPartSize(info.Size(), s3MinPartSize, s3MaxParts)
+	if err != nil {
+		return err
+	}
+	if info.Size() > partSize {
+		return u.uploadMultipart(artifact, f, info, partSize, permission)
+	}
+
+	// Create an uploader with the session and default options
+	uploader := s3manager.NewUploaderWithClient(u.client)
 
 	// Upload the file to S3.
 	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
@@ -117,6 +147,140 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 	return err
 }
 
+// uploadMultipart uploads a file in parts, resuming a previous upload of it
+// if there was one
+func (u *S3Uploader) uploadMultipart(artifact *api.Artifact, f *os.File, info os.FileInfo, partSize int64, permission string) error {
+	key := u.artifactPath(artifact)
+
+	concurrency, err := uploadPartConcurrency()
+	if err != nil {
+		return err
+	}
+
+	state := loadMultipartUploadState(u.logger, "s3://"+u.BucketName+"/"+key, info, partSize)
+	if state.UploadID != "" {
+		if err := u.resumeMultipart(key, state); err != nil {
+			u.logger.Warn("Can't resume uploading \"%s\", starting again (%v)", key, err)
+			state.UploadID = ""
+		}
+	}
+
+	if state.UploadID == "" {
+		params := &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(u.BucketName),
+			Key:         aws.String(key),
+			ContentType: aws.String(artifact.ContentType),
+			ACL:         aws.String(permission),
+		}
+		if u.serverSideEncryptionEnabled() {
+			params.ServerSideEncryption = aws.String("AES256")
+		}
+
+		out, err := u.client.CreateMultipartUpload(params)
+		if err != nil {
+			return err
+		}
+		state.Start(aws.StringValue(out.UploadId))
+	}
+
+	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s` in %d parts", key, permission, state.PartCount())
+
+	err = uploadParts(u.logger, f, state, concurrency, func(part int, r *io.SectionReader) (string, error) {
+		out, err := u.client.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(u.BucketName),
+			Key:           aws.String(key),
+			UploadId:      aws.String(state.UploadID),
+			PartNumber:    aws.Int64(int64(part)),
+			ContentLength: aws.Int64(r.Size()),
+			Body:          r,
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(out.ETag), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	completed := make([]*s3.CompletedPart, 0, state.PartCount())
+	for part := 1; part <= state.PartCount(); part++ {
+		etag, _ := state.Part(part)
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int64(int64(part)),
+		})
+	}
+
+	_, err = u.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return err
+	}
+
+	state.Remove()
+	return nil
+}
+
+// abort aborts a multipart upload of an artifact that's been given up on, so
+// that S3 doesn't keep its parts
+func (u *S3Uploader) abort(artifact *api.Artifact) {
+	key := u.artifactPath(artifact)
+
+	state, ok := inProgressMultipartUpload("s3://" + u.BucketName + "/" + key)
+	if !ok {
+		return
+	}
+	defer state.Remove()
+
+	if state.UploadID == "" {
+		return
+	}
+
+	u.logger.Debug("Aborting upload of \"%s\"", key)
+	_, err := u.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(state.UploadID),
+	})
+	if err != nil {
+		u.logger.Warn("Failed to abort upload of \"%s\", its parts are left in the bucket (%v)", key, err)
+	}
+}
+
+// resumeMultipart checks which of the parts of a previous upload S3 still has,
+// so that only the others are uploaded
+func (u *S3Uploader) resumeMultipart(key string, state *multipartUploadState) error {
+	uploaded := map[int]string{}
+
+	err := u.client.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(u.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(state.UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			uploaded[int(aws.Int64Value(part.PartNumber))] = aws.StringValue(part.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for part, etag := range state.Parts {
+		if uploaded[part] != etag {
+			delete(state.Parts, part)
+		}
+	}
+
+	u.logger.Debug("Resuming upload of \"%s\" with %d of %d parts uploaded", key, len(state.Parts), state.PartCount())
+	return nil
+}
+
 func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
 	parts := []string{u.BucketPath, artifact.Path}
 
@@ -12,3 +12,16 @@ type Uploader interface {
 	// The actual uploading of the file
 	Upload(*api.Artifact) error
 }
+
+// retryingUploader is implemented by uploaders that retry their own uploads,
+// which the artifact uploader doesn't retry again
+type retryingUploader interface {
+	retriesUploads()
+}
+
+// abortingUploader is implemented by uploaders that leave parts of uploads
+// behind for them to be resumed, which are aborted once the artifact uploader
+// gives up on uploading an artifact
+type abortingUploader interface {
+	abort(*api.Artifact)
+}
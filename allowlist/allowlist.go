@@ -0,0 +1,129 @@
+// Package allowlist restricts the commands an agent runs to those that match
+// the patterns in an allowlist file.
+package allowlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Allowlist is a list of patterns that commands must match to be run. The
+// file has one pattern per line, and blank lines and lines starting with #
+// are ignored. Patterns wrapped in slashes are regular expressions, and
+// anything else is a glob, where * matches any characters, including spaces
+// and slashes, and ? matches any one character, except for the characters the
+// shell uses to run other commands, which are listed in globExcludes. That
+// stops a glob like "scripts/*.sh *" allowing "scripts/test.sh; curl … | sh".
+// Regular expressions can match them, if they really need to. Either way, a
+// pattern has to match the whole of a command line. For example:
+//
+//	# Our build scripts, with any arguments
+//	scripts/*.sh *
+//	make test
+//	/make (lint|build)( -j[0-9]+)?/
+type Allowlist struct {
+	patterns []*regexp.Regexp
+}
+
+// Load reads an allowlist from a file
+func Load(filename string) (*Allowlist, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse reads an allowlist, returning an error for any invalid patterns
+func Parse(r io.Reader) (*Allowlist, error) {
+	list := &Allowlist{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var expr string
+		if len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			expr = line[1 : len(line)-1]
+		} else {
+			expr = globToRegexp(line)
+		}
+
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q on line %d: %v", line, lineNum, err)
+		}
+		list.patterns = append(list.patterns, regexp.MustCompile(`\A(?:`+expr+`)\z`))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Allowed returns whether a single command line matches any of the patterns
+func (list *Allowlist) Allowed(line string) bool {
+	for _, pattern := range list.patterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error for the first line of a command that isn't allowed.
+// Blank lines and comments are ignored.
+func (list *Allowlist) Check(command string) error {
+	for _, line := range Lines(command) {
+		if !list.Allowed(line) {
+			return fmt.Errorf("This agent is only allowed to run commands that match its command allowlist, and %q doesn't match any of them", line)
+		}
+	}
+	return nil
+}
+
+// Lines returns the lines of a command that are checked against an
+// allowlist, without surrounding whitespace, blank lines or comments
+func Lines(command string) []string {
+	var lines []string
+	for _, line := range strings.Split(command, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// globExcludes are the characters that the wildcards in globs don't match:
+// those that separate, pipe or background commands, substitute the output of
+// one command into another, redirect, or continue a command on the next line
+const globExcludes = ";&|$`()<>\\\n"
+
+func globToRegexp(glob string) string {
+	class := `[^` + regexp.QuoteMeta(globExcludes) + `]`
+
+	var expr strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(class + `*`)
+		case '?':
+			expr.WriteString(class)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return expr.String()
+}
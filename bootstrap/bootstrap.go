@@ -6,14 +6,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/allowlist"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/experiments"
@@ -49,6 +53,22 @@ type Bootstrap struct {
 
 	// A channel to track cancellation
 	cancelCh chan struct{}
+
+	// Serializes adding hosts to known_hosts during plugin checkouts
+	knownHostsMu sync.Mutex
+
+	// The exit status of the first hook that soft-failed, which the job exits
+	// with if nothing else fails it
+	softFailExitCode int
+
+	// The hooks that last changed each environment variable
+	envProvenance envProvenance
+
+	// The job's own temporary directory, removed at the end of the bootstrap
+	jobTmpdir string
+
+	// The git mirror the checkout is a worktree of, if it is one
+	worktreeMirror string
 }
 
 // New returns a new Bootstrap instance
@@ -93,6 +113,14 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 	}()
 
+	// Exit with the status of a hook that soft-failed, including in tear down,
+	// if nothing else failed
+	defer func() {
+		if exitCode == 0 && b.softFailExitCode != 0 {
+			exitCode = b.softFailExitCode
+		}
+	}()
+
 	// Tear down the environment (and fire pre-exit hook) before we exit
 	defer func() {
 		if err = b.tearDown(ctx); err != nil {
@@ -216,6 +244,17 @@ type HookConfig struct {
 	Env            env.Environment
 	SpanAttributes map[string]string
 	PluginName     string
+
+	// Whether the hook is run directly rather than sourced, which hooks that
+	// are programs or non-shell scripts are regardless
+	Executable bool
+
+	// How long the hook can run for, as well as any timeout the agent sets
+	Timeout time.Duration
+
+	// The name of the script in the hook's directory, like 10-security in
+	// environment.d, for hooks made up of more than one script
+	Script string
 }
 
 func (b *Bootstrap) tracingImplementationSpecificHookScope(scope string) string {
@@ -255,6 +294,10 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 		hookName += " " + hookCfg.PluginName
 	}
 	hookName += " " + hookCfg.Name
+	if hookCfg.Script != "" {
+		hookName += " (" + hookCfg.Script + ")"
+		span.AddAttributes(map[string]string{"hook.script": hookCfg.Script})
+	}
 
 	if !utils.FileExists(hookCfg.Path) {
 		if b.Debug {
@@ -268,15 +311,6 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 	redactors := b.setupRedactors()
 	defer redactors.Flush()
 
-	// We need a script to wrap the hook script so that we can snaffle the changed
-	// environment variables
-	script, err := hook.NewScriptWrapper(hook.WithHookPath(hookCfg.Path))
-	if err != nil {
-		b.shell.Errorf("Error creating hook script: %v", err)
-		return err
-	}
-	defer script.Close()
-
 	cleanHookPath := hookCfg.Path
 
 	// Show a relative path if we can
@@ -287,6 +321,22 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 		}
 	}
 
+	// Hooks that can't be sourced are run directly, and write the changes
+	// they make to files instead
+	if hookCfg.Executable || hook.IsExecutable(hookCfg.Path) {
+		err = b.executeExecutableHook(ctx, hookCfg, hookName, cleanHookPath, redactors)
+		return err
+	}
+
+	// We need a script to wrap the hook script so that we can snaffle the changed
+	// environment variables
+	script, err := hook.NewScriptWrapper(hook.WithHookPath(hookCfg.Path))
+	if err != nil {
+		b.shell.Errorf("Error creating hook script: %v", err)
+		return err
+	}
+	defer script.Close()
+
 	// Show the hook runner in debug, but the thing being run otherwise 💅🏻
 	if b.Debug {
 		b.shell.Commentf("A hook runner was written to \"%s\" with the following:", script.Path())
@@ -296,17 +346,8 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 	}
 
 	// Run the wrapper script
-	if err = b.shell.RunScript(ctx, script.Path(), hookCfg.Env); err != nil {
-		exitCode := shell.GetExitCode(err)
-		b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", exitCode))
-
-		// Give a simpler error if it's just a shell exit error
-		if shell.IsExitError(err) {
-			return &shell.ExitError{
-				Code:    exitCode,
-				Message: fmt.Sprintf("The %s hook exited with status %d", hookName, exitCode),
-			}
-		}
+	if err = b.runHookScript(ctx, hookCfg, hookName, script.Path(), hookCfg.Env); err != nil {
+		err = b.applyHookFailurePolicy(hookCfg, hookName, b.hookFailed(hookName, err))
 		return err
 	}
 
@@ -331,13 +372,63 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 	} else {
 		// Hook exited successfully (and not early!) We have an environment and
 		// wd change we can apply to our subsequent phases
-		b.applyEnvironmentChanges(changes, redactors)
+		b.applyEnvironmentChanges(hookName, changes, redactors)
+	}
+
+	return nil
+}
+
+// executeExecutableHook runs a hook directly, applying the changes it wrote
+// to the files it was given
+func (b *Bootstrap) executeExecutableHook(ctx context.Context, hookCfg HookConfig, hookName, cleanHookPath string, redactors redaction.RedactorMux) error {
+	wrapper, err := hook.NewExecutableWrapper(hookCfg.Path)
+	if err != nil {
+		b.shell.Errorf("Error creating hook environment files: %v", err)
+		return err
+	}
+	defer wrapper.Close()
+
+	b.shell.Promptf("%s", process.FormatCommand(cleanHookPath, []string{}))
+
+	if err := b.runHookScript(ctx, hookCfg, hookName, hookCfg.Path, hookCfg.Env.Merge(wrapper.Env())); err != nil {
+		return b.applyHookFailurePolicy(hookCfg, hookName, b.hookFailed(hookName, err))
+	}
+
+	// Store the last hook exit code for subsequent steps
+	b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", "0")
+
+	changes, err := wrapper.Changes(b.shell.Env.Merge(hookCfg.Env))
+	if err != nil {
+		return err
 	}
 
+	b.applyEnvironmentChanges(hookName, changes, redactors)
 	return nil
 }
 
-func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, redactors redaction.RedactorMux) {
+// hookFailed stores the exit status of a hook that failed for subsequent
+// steps, and returns a simpler error if it's just a shell exit error
+func (b *Bootstrap) hookFailed(hookName string, err error) error {
+	exitCode := shell.GetExitCode(err)
+	b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", exitCode))
+
+	if timeoutErr, ok := err.(*hookTimeoutError); ok {
+		return &shell.ExitError{
+			Code:    exitCode,
+			Message: fmt.Sprintf("The %s hook timed out after %s", hookName, timeoutErr.timeout),
+		}
+	}
+
+	if shell.IsExitError(err) {
+		return &shell.ExitError{
+			Code:    exitCode,
+			Message: fmt.Sprintf("The %s hook exited with status %d", hookName, exitCode),
+		}
+	}
+	return err
+}
+
+func (b *Bootstrap) applyEnvironmentChanges(hookName string, changes hook.HookScriptChanges, redactors redaction.RedactorMux) {
 	if afterWd, err := changes.GetAfterWd(); err == nil {
 		if afterWd != b.shell.Getwd() {
 			_ = b.shell.Chdir(afterWd)
@@ -351,9 +442,13 @@ func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, reda
 
 	mergedEnv := b.shell.Env.Apply(changes.Diff)
 
+	// Keep track of which hook changed what, for working out where variables
+	// came from later
+	b.envProvenance.record(hookName, changes.Diff)
+
 	// reset output redactors based on new environment variable values
 	redactors.Flush()
-	redactors.Reset(redaction.GetValuesToRedact(b.shell, b.Config.RedactedVars, mergedEnv))
+	redactors.Reset(b.valuesToRedact(mergedEnv))
 
 	// First, let see any of the environment variables are supposed
 	// to change the bootstrap configuration at run time.
@@ -398,29 +493,40 @@ func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, reda
 }
 
 func (b *Bootstrap) hasGlobalHook(name string) bool {
-	_, err := b.globalHookPath(name)
+	_, err := b.globalHookPaths(name)
 	return err == nil
 }
 
-// Returns the absolute path to a global hook, or os.ErrNotExist if none is found
-func (b *Bootstrap) globalHookPath(name string) (string, error) {
-	return hook.Find(b.HooksPath, name)
+// Returns the absolute paths to a global hook and the scripts in its hook
+// directory, like environment.d, or os.ErrNotExist if none are found
+func (b *Bootstrap) globalHookPaths(name string) ([]string, error) {
+	return hook.FindAll(b.HooksPath, name)
 }
 
-// Executes a global hook if one exists
+// Executes a global hook and the scripts in its hook directory if they exist,
+// stopping at the first that fails
 func (b *Bootstrap) executeGlobalHook(ctx context.Context, name string) error {
 	if !b.hasGlobalHook(name) {
 		return nil
 	}
-	p, err := b.globalHookPath(name)
+	paths, err := b.globalHookPaths(name)
 	if err != nil {
 		return err
 	}
-	return b.executeHook(ctx, HookConfig{
-		Scope: "global",
-		Name:  name,
-		Path:  p,
-	})
+	for _, p := range paths {
+		hookCfg := HookConfig{
+			Scope: "global",
+			Name:  name,
+			Path:  p,
+		}
+		if filepath.Base(filepath.Dir(p)) == name+".d" {
+			hookCfg.Script = filepath.Base(p)
+		}
+		if err := b.executeHook(ctx, hookCfg); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Returns the absolute path to a local hook, or os.ErrNotExist if none is found
@@ -503,6 +609,11 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 	// Create an empty env for us to keep track of our env changes in
 	b.shell.Env = env.FromSlice(os.Environ())
 
+	// Git credentials are only given to git during checkout, so they shouldn't
+	// be visible to hooks or the command
+	b.shell.Env.Remove("BUILDKITE_GIT_CREDENTIALS")
+	b.shell.Env.Remove("BUILDKITE_GIT_CREDENTIALS_FILE")
+
 	// Add the $BUILDKITE_BIN_PATH to the $PATH if we've been given one
 	if b.BinPath != "" {
 		path, _ := b.shell.Env.Get("PATH")
@@ -549,6 +660,11 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 	// Disable any interactive Git/SSH prompting
 	b.shell.Env.Set("GIT_TERMINAL_PROMPT", "0")
 
+	// Before any hooks run, so they don't write to the shared temp directory
+	if err = b.createJobTmpdir(); err != nil {
+		return fmt.Errorf("Failed to create the job's temporary directory: %v", err)
+	}
+
 	// It's important to do this before checking out plugins, in case you want
 	// to use the global environment hook to whitelist the plugins that are
 	// allowed to be used.
@@ -562,6 +678,12 @@ func (b *Bootstrap) tearDown(ctx context.Context) error {
 	var err error
 	defer func() { span.FinishWithError(err) }()
 
+	// Last of all, even if the pre-exit hooks fail, as they can use it too
+	defer b.removeJobTmpdir()
+
+	// After the pre-exit hooks, which can change the environment too
+	defer b.reportEnvProvenance()
+
 	if err = b.executeGlobalHook(ctx, "pre-exit"); err != nil {
 		return err
 	}
@@ -628,6 +750,24 @@ func (b *Bootstrap) preparePlugins() error {
 		b.shell.Commentf("Parsed %d plugins", len(b.plugins))
 	}
 
+	// Vendored plugins are part of the repository, so it's only plugins
+	// from elsewhere that the policy applies to
+	if b.PluginsPolicyFile != "" {
+		policy, err := plugin.LoadPolicy(b.PluginsPolicyFile)
+		if err != nil {
+			return errors.Wrap(err, "Failed to load the plugins policy")
+		}
+
+		for _, p := range b.plugins {
+			if p.Vendored {
+				continue
+			}
+			if err := policy.Check(p); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -677,9 +817,7 @@ func (b *Bootstrap) PluginPhase(ctx context.Context) error {
 		return nil
 	}
 
-	checkouts := []*pluginCheckout{}
-
-	// Checkout and validate plugins that aren't vendored
+	plugins := []*plugin.Plugin{}
 	for _, p := range b.plugins {
 		if p.Vendored {
 			if b.Debug {
@@ -687,18 +825,44 @@ func (b *Bootstrap) PluginPhase(ctx context.Context) error {
 			}
 			continue
 		}
+		plugins = append(plugins, p)
+	}
 
-		checkout, err := b.checkoutPlugin(p)
-		if err != nil {
-			return errors.Wrapf(err, "Failed to checkout plugin %s", p.Name())
+	// Checkout plugins that aren't vendored concurrently, each with a
+	// buffered shell so that their output can be shown one plugin at a time
+	results := b.checkoutPlugins(plugins)
+
+	checkouts := []*pluginCheckout{}
+	var checkoutErr error
+
+	// Show the output and validate plugins in the order they were declared,
+	// which is the order their hooks run in
+	for i, p := range plugins {
+		result := results[i]
+		<-result.done
+
+		b.shell.Headerf("Checking out plugin %s", p.Label())
+		result.shell.Flush()
+
+		if checkoutErr != nil {
+			continue
 		}
 
-		err = b.validatePluginCheckout(checkout)
-		if err != nil {
-			return err
+		if result.err != nil {
+			checkoutErr = errors.Wrapf(result.err, "Failed to checkout plugin %s", p.Name())
+			continue
+		}
+
+		if err := b.validatePluginCheckout(result.checkout); err != nil {
+			checkoutErr = err
+			continue
 		}
 
-		checkouts = append(checkouts, checkout)
+		checkouts = append(checkouts, result.checkout)
+	}
+
+	if checkoutErr != nil {
+		return checkoutErr
 	}
 
 	// Store the checkouts for future use
@@ -708,6 +872,57 @@ func (b *Bootstrap) PluginPhase(ctx context.Context) error {
 	return b.executePluginHook(ctx, "environment", checkouts)
 }
 
+// How many plugins are checked out at the same time
+const maxConcurrentPluginCheckouts = 4
+
+// pluginCheckoutResult is a plugin checkout that's running, or done once the
+// done channel is closed
+type pluginCheckoutResult struct {
+	shell    *shell.Shell
+	checkout *pluginCheckout
+	err      error
+	done     chan struct{}
+}
+
+// checkoutPlugins starts checking out plugins, up to
+// maxConcurrentPluginCheckouts at a time, returning their results in the
+// same order as the plugins
+func (b *Bootstrap) checkoutPlugins(plugins []*plugin.Plugin) []*pluginCheckoutResult {
+	results := make([]*pluginCheckoutResult, len(plugins))
+	slots := make(chan struct{}, maxConcurrentPluginCheckouts)
+
+	// Plugin locks don't stop the same process checking out a plugin twice,
+	// so the same plugin waits for the previous checkout of it to finish
+	previous := map[string]*pluginCheckoutResult{}
+
+	for i, p := range plugins {
+		result := &pluginCheckoutResult{
+			shell: b.shell.Buffered(),
+			done:  make(chan struct{}),
+		}
+		results[i] = result
+
+		id, _ := p.Identifier()
+		wait := previous[id]
+		previous[id] = result
+
+		go func(p *plugin.Plugin) {
+			defer close(result.done)
+
+			if wait != nil {
+				<-wait.done
+			}
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result.checkout, result.err = b.checkoutPlugin(result.shell, p)
+		}(p)
+	}
+
+	return results
+}
+
 // VendoredPluginPhase is where plugins that are included in the
 // checked out code are added
 func (b *Bootstrap) VendoredPluginPhase(ctx context.Context) error {
@@ -771,6 +986,11 @@ func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkout
 			return err
 		}
 
+		timeout, err := b.pluginDefinition(p).HookTimeout(name)
+		if err != nil {
+			return fmt.Errorf("Plugin %s has an invalid definition: %v", p.Plugin.Name(), err)
+		}
+
 		env, _ := p.ConfigurationToEnvironment()
 		err = b.executeHook(ctx, HookConfig{
 			Scope:      "plugin",
@@ -778,6 +998,8 @@ func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkout
 			Path:       hookPath,
 			Env:        env,
 			PluginName: p.Plugin.Name(),
+			Executable: b.pluginDefinition(p).IsExecutableHook(name),
+			Timeout:    timeout,
 			SpanAttributes: map[string]string{
 				"plugin.name":        p.Plugin.Name(),
 				"plugin.version":     p.Plugin.Version,
@@ -793,6 +1015,26 @@ func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkout
 	return nil
 }
 
+// pluginDefinition returns a plugin's definition, loading it if it hasn't been
+// already. Plugins without a definition, or with one that can't be loaded when
+// plugin validation is off, get an empty one.
+func (b *Bootstrap) pluginDefinition(checkout *pluginCheckout) *plugin.Definition {
+	if checkout.Definition != nil {
+		return checkout.Definition
+	}
+
+	def, err := plugin.LoadDefinitionFromDir(checkout.CheckoutDir)
+	if err != nil {
+		if err != plugin.ErrDefinitionNotFound && b.Debug {
+			b.shell.Commentf("Failed to load plugin definition for %s: %v", checkout.Plugin.Name(), err)
+		}
+		def = &plugin.Definition{}
+	}
+
+	checkout.Definition = def
+	return def
+}
+
 // If any plugin has a hook by this name
 func (b *Bootstrap) hasPluginHook(name string) bool {
 	for _, p := range b.pluginCheckouts {
@@ -804,7 +1046,7 @@ func (b *Bootstrap) hasPluginHook(name string) bool {
 }
 
 // Checkout a given plugin to the plugins directory and return that directory
-func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
+func (b *Bootstrap) checkoutPlugin(sh *shell.Shell, p *plugin.Plugin) (*pluginCheckout, error) {
 	// Make sure we have a plugin path before trying to do anything
 	if b.PluginsPath == "" {
 		return nil, fmt.Errorf("Can't checkout plugin without a `plugins-path`")
@@ -835,7 +1077,7 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	// Try and lock this particular plugin while we check it out (we create
 	// the file outside of the plugin directory so git clone doesn't have
 	// a cry about the directory not being empty)
-	pluginCheckoutHook, err := b.shell.LockFile(filepath.Join(b.PluginsPath, id+".lock"), time.Minute*5)
+	pluginCheckoutHook, err := sh.LockFile(filepath.Join(b.PluginsPath, id+".lock"), time.Minute*5)
 	if err != nil {
 		return nil, err
 	}
@@ -855,36 +1097,88 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	// tradeoff is favourable for just blowing away an existing clone if we want least-hassle
 	// guarantee that the user will get the latest version of their plugin branch/tag/whatever.
 	if b.Config.PluginsAlwaysCloneFresh && utils.FileExists(pluginDirectory) {
-		b.shell.Commentf("BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH is true; removing previous checkout of plugin %s", p.Label())
+		sh.Commentf("BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH is true; removing previous checkout of plugin %s", p.Label())
 		err = os.RemoveAll(pluginDirectory)
 		if err != nil {
-			b.shell.Errorf("Oh no, something went wrong removing %s", pluginDirectory)
+			sh.Errorf("Oh no, something went wrong removing %s", pluginDirectory)
+			return nil, err
+		}
+	}
+
+	// Archives, and plugins in the plugin store, are extracted rather than
+	// cloned. They aren't locked, as locks are commits which archives don't
+	// have, and they can't move like a tag or branch can.
+	if archive, ok := b.pluginStoreArchive(p); ok || p.IsArchive() {
+		if utils.FileExists(pluginDirectory) {
+			sh.Commentf("Plugin %q already extracted", p.Label())
+			return checkout, nil
+		}
+
+		if err := b.extractPluginArchive(sh, p, archive, id, pluginDirectory); err != nil {
+			return nil, err
+		}
+
+		return checkout, nil
+	}
+
+	repo, err := p.Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	// When plugins are locked, the version is pinned to the commit it first
+	// resolved to, and an existing checkout is only used if it's at that
+	// commit, so that moving a tag or branch doesn't change the plugin
+	var locked *pluginLock
+	version := p.Version
+	if b.pluginLockingEnabled() {
+		if locked, err = b.lockedPlugin(sh, p); err != nil {
 			return nil, err
 		}
+
+		if locked != nil {
+			version = locked.Commit
+		} else if commit := b.resolvePluginVersion(sh, repo, p.Version); commit != "" {
+			version = commit
+		}
+
+		if utils.FileExists(pluginGitDirectory) && version != p.Version {
+			headCommit, err := gitRevParseInWorkingDirectory(sh, pluginDirectory, "HEAD")
+			if err != nil || strings.TrimSpace(headCommit) != version {
+				sh.Commentf("Existing checkout of plugin %q isn't at %s, removing it", p.Label(), version)
+				if err := os.RemoveAll(pluginDirectory); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
 	if utils.FileExists(pluginGitDirectory) {
 		// It'd be nice to show the current commit of the plugin, so
 		// let's figure that out.
-		headCommit, err := gitRevParseInWorkingDirectory(b.shell, pluginDirectory, "--short=7", "HEAD")
+		headCommit, err := gitRevParseInWorkingDirectory(sh, pluginDirectory, "--short=7", "HEAD")
 		if err != nil {
-			b.shell.Commentf("Plugin %q already checked out (can't `git rev-parse HEAD` plugin git directory)", p.Label())
+			sh.Commentf("Plugin %q already checked out (can't `git rev-parse HEAD` plugin git directory)", p.Label())
 		} else {
-			b.shell.Commentf("Plugin %q already checked out (%s)", p.Label(), strings.TrimSpace(headCommit))
+			sh.Commentf("Plugin %q already checked out (%s)", p.Label(), strings.TrimSpace(headCommit))
+		}
+
+		if b.pluginLockingEnabled() {
+			if err := b.checkPluginLock(sh, p, pluginDirectory, locked); err != nil {
+				return nil, err
+			}
 		}
 
 		return checkout, nil
 	}
 
-	b.shell.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, pluginDirectory)
-
-	repo, err := p.Repository()
-	if err != nil {
-		return nil, err
-	}
+	sh.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, pluginDirectory)
 
 	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(b.shell, repo)
+		// known_hosts locks don't stop other plugin checkouts in this process
+		b.knownHostsMu.Lock()
+		addRepositoryHostToSSHKnownHosts(sh, repo)
+		b.knownHostsMu.Unlock()
 	}
 
 	// Make the directory
@@ -894,34 +1188,41 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	}
 
 	// Switch to the plugin directory
-	b.shell.Commentf("Switching to the temporary plugin directory")
-	previousWd := b.shell.Getwd()
-	if err = b.shell.Chdir(tempDir); err != nil {
+	sh.Commentf("Switching to the temporary plugin directory")
+	previousWd := sh.Getwd()
+	if err = sh.Chdir(tempDir); err != nil {
 		return nil, err
 	}
 	// Switch back to the previous working directory
-	defer b.shell.Chdir(previousWd)
+	defer sh.Chdir(previousWd)
 
 	// Plugin clones shouldn't use custom GitCloneFlags
 	err = roko.NewRetrier(
 		roko.WithMaxAttempts(3),
 		roko.WithStrategy(roko.Constant(2*time.Second)),
 	).Do(func(r *roko.Retrier) error {
-		return b.shell.Run("git", "clone", "-v", "--", repo, ".")
+		return sh.Run("git", "clone", "-v", "--", repo, ".")
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	// Switch to the version if we need to
-	if p.Version != "" {
-		b.shell.Commentf("Checking out `%s`", p.Version)
-		if err = b.shell.Run("git", "checkout", "-f", p.Version); err != nil {
+	if version != "" {
+		sh.Commentf("Checking out `%s`", version)
+		if err = sh.Run("git", "checkout", "-f", version); err != nil {
 			return nil, err
 		}
 	}
 
-	b.shell.Commentf("Moving temporary plugin directory to final location")
+	// Only a checkout that matches its lock makes it to the final location
+	if b.pluginLockingEnabled() {
+		if err := b.checkPluginLock(sh, p, tempDir, locked); err != nil {
+			return nil, err
+		}
+	}
+
+	sh.Commentf("Moving temporary plugin directory to final location")
 	err = os.Rename(tempDir, pluginDirectory)
 	if err != nil {
 		return nil, err
@@ -1023,10 +1324,16 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 		if err = b.executePluginHook(ctx, "checkout", b.pluginCheckouts); err != nil {
 			return err
 		}
+		if err = b.verifyHookCheckout(); err != nil {
+			return err
+		}
 	case b.hasGlobalHook("checkout"):
 		if err = b.executeGlobalHook(ctx, "checkout"); err != nil {
 			return err
 		}
+		if err = b.verifyHookCheckout(); err != nil {
+			return err
+		}
 	default:
 		if b.Config.Repository != "" {
 			err = roko.NewRetrier(
@@ -1047,6 +1354,10 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 					b.shell.Warningf("Checkout was cancelled")
 					r.Break()
 
+				case isCommitVerificationError(err):
+					b.shell.Errorf("Commit signature verification failed! %s", err)
+					r.Break()
+
 				default:
 					b.shell.Warningf("Checkout failed! %s (%s)", err, r)
 
@@ -1057,6 +1368,7 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 						case gitErrorClone:
 						case gitErrorClean:
 						case gitErrorCleanSubmodules:
+						case gitErrorSparseCheckout:
 							// do nothing, this will fall through to destroy the checkout
 
 						default:
@@ -1090,6 +1402,14 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	// Work out which paths this build changes, for `if_changed` and generators
+	if b.ChangedPathsBase != "" && b.Config.Repository != "" {
+		b.shell.Headerf("Finding changed paths")
+		if err := b.exportChangedPaths(); err != nil {
+			b.shell.Warningf("Failed to find changed paths: %v", err)
+		}
+	}
+
 	// Store the current value of BUILDKITE_BUILD_CHECKOUT_PATH, so we can detect if
 	// one of the post-checkout hooks changed it.
 	previousCheckoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
@@ -1142,9 +1462,12 @@ func hasGitCommit(sh *shell.Shell, gitDir string, commit string) bool {
 	return true
 }
 
-func (b *Bootstrap) updateGitMirror() (string, error) {
+// updateGitMirror clones or updates the mirror of a repository so that it has
+// the commit, returning the mirror's directory. The mirror is updated by
+// fetching the refspecs, or everything the mirror tracks if there are none.
+func (b *Bootstrap) updateGitMirror(repository, commit string, refSpecs ...string) (string, error) {
 	// Create a unique directory for the repository mirror
-	mirrorDir := filepath.Join(b.Config.GitMirrorsPath, dirForRepository(b.Repository))
+	mirrorDir := filepath.Join(b.Config.GitMirrorsPath, dirForRepository(repository))
 
 	// Create the mirrors path if it doesn't exist
 	if baseDir := filepath.Dir(mirrorDir); !utils.FileExists(baseDir) {
@@ -1155,6 +1478,11 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 		}
 	}
 
+	// Return to the current directory afterwards, as submodule mirrors are
+	// updated from within the checkout
+	wd := b.shell.Getwd()
+	defer func() { _ = b.shell.Chdir(wd) }()
+
 	b.shell.Chdir(b.Config.GitMirrorsPath)
 
 	lockTimeout := time.Second * time.Duration(b.GitMirrorsLockTimeout)
@@ -1174,7 +1502,7 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	if !utils.FileExists(mirrorDir) {
 		b.shell.Commentf("Cloning a mirror of the repository to %q", mirrorDir)
 		flags := "--mirror " + b.GitCloneMirrorFlags
-		if err := gitClone(b.shell, flags, b.Repository, mirrorDir); err != nil {
+		if err := gitClone(b.shell, flags, repository, mirrorDir); err != nil {
 			b.shell.Commentf("Removing mirror dir %q due to failed clone", mirrorDir)
 			if err := os.RemoveAll(mirrorDir); err != nil {
 				b.shell.Errorf("Failed to remove \"%s\" (%s)", mirrorDir, err)
@@ -1189,8 +1517,8 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	mirrorCloneLock.Unlock()
 
 	// Check if the mirror has a commit, this is atomic so should be safe to do
-	if hasGitCommit(b.shell, mirrorDir, b.Commit) {
-		b.shell.Commentf("Commit %q exists in mirror", b.Commit)
+	if hasGitCommit(b.shell, mirrorDir, commit) {
+		b.shell.Commentf("Commit %q exists in mirror", commit)
 		return mirrorDir, nil
 	}
 
@@ -1206,33 +1534,375 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	defer mirrorUpdateLock.Unlock()
 
 	// Check again after we get a lock, in case the other process has already updated
-	if hasGitCommit(b.shell, mirrorDir, b.Commit) {
-		b.shell.Commentf("Commit %q exists in mirror", b.Commit)
+	if hasGitCommit(b.shell, mirrorDir, commit) {
+		b.shell.Commentf("Commit %q exists in mirror", commit)
 		return mirrorDir, nil
 	}
 
-	b.shell.Commentf("Updating existing repository mirror to find commit %s", b.Commit)
+	b.shell.Commentf("Updating existing repository mirror to find commit %s", commit)
 
 	// Update the origin of the repository so we can gracefully handle repository renames
-	if err := b.shell.Run("git", "--git-dir", mirrorDir, "remote", "set-url", "origin", b.Repository); err != nil {
+	if err := b.shell.Run("git", "--git-dir", mirrorDir, "remote", "set-url", "origin", repository); err != nil {
 		return "", err
 	}
 
+	// Fetch from the upstream repository into the mirror.
+	fetchArgs := append([]string{"--git-dir", mirrorDir, "fetch", "origin"}, refSpecs...)
+	if err := b.shell.Run("git", fetchArgs...); err != nil {
+		return "", err
+	}
+
+	return mirrorDir, nil
+}
+
+// buildRefSpec returns the build branch, or the pull request head for GitHub
+func (b *Bootstrap) buildRefSpec() string {
 	if b.PullRequest != "false" && strings.Contains(b.PipelineProvider, "github") {
-		b.shell.Commentf("Fetch and mirror pull request head from GitHub")
-		refspec := fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
-		// Fetch the PR head from the upstream repository into the mirror.
-		if err := b.shell.Run("git", "--git-dir", mirrorDir, "fetch", "origin", refspec); err != nil {
+		return fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
+	}
+	return b.Branch
+}
+
+// addGitWorktree makes the checkout directory a worktree of the mirror, unless
+// it already is one. The worktrees of a mirror are shared by every agent that
+// uses it, so they're only changed while holding the mirror's update lock.
+func (b *Bootstrap) addGitWorktree(mirrorDir string) error {
+	checkoutDir := b.shell.Getwd()
+	dotGit := filepath.Join(checkoutDir, ".git")
+
+	if worktreeDir, ok := gitWorktreeDir(dotGit); ok && utils.FileExists(worktreeDir) {
+		if isWorktreeOf(worktreeDir, mirrorDir) {
+			b.shell.Commentf("Using existing worktree of %s", mirrorDir)
+			return nil
+		}
+	}
+
+	// git will only create a worktree in an empty directory
+	if entries, err := ioutil.ReadDir(checkoutDir); err != nil || len(entries) > 0 {
+		b.shell.Commentf("Existing checkout isn't a worktree of %s, removing it", mirrorDir)
+		if err := b.removeCheckoutDir(); err != nil {
+			return err
+		}
+		if err := b.createCheckoutDir(); err != nil {
+			return err
+		}
+	}
+
+	if b.Debug {
+		b.shell.Commentf("Acquiring mirror repository update lock")
+	}
+
+	lockTimeout := time.Second * time.Duration(b.GitMirrorsLockTimeout)
+	mirrorUpdateLock, err := b.shell.LockFile(mirrorDir+".updatelock", lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer mirrorUpdateLock.Unlock()
+
+	// Forget about worktrees that have since been removed, such as a previous
+	// one in this directory
+	if err := b.shell.Run("git", "--git-dir", mirrorDir, "worktree", "prune"); err != nil {
+		return err
+	}
+
+	if err := b.shell.Run("git", "--git-dir", mirrorDir, "worktree", "add", "--detach", "--no-checkout", checkoutDir); err != nil {
+		return &gitError{error: err, Type: gitErrorClone}
+	}
+
+	return nil
+}
+
+// withMirrorLock runs f while holding the update lock of the git mirror that
+// the checkout is a worktree of, if it is one. A worktree's objects, refs,
+// config and submodules are kept in the mirror, and shared with every other
+// agent using it, so anything that changes them has to hold the lock.
+func (b *Bootstrap) withMirrorLock(f func() error) error {
+	if b.worktreeMirror == "" {
+		return f()
+	}
+
+	if b.Debug {
+		b.shell.Commentf("Acquiring mirror repository update lock")
+	}
+
+	lockTimeout := time.Second * time.Duration(b.GitMirrorsLockTimeout)
+	mirrorUpdateLock, err := b.shell.LockFile(b.worktreeMirror+".updatelock", lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer mirrorUpdateLock.Unlock()
+
+	return f()
+}
+
+// isWorktreeOf returns whether a worktree's state is kept within a repository
+func isWorktreeOf(worktreeDir, gitDir string) bool {
+	// git records the real path, which may differ from the configured one
+	if resolved, err := filepath.EvalSymlinks(gitDir); err == nil {
+		gitDir = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(worktreeDir); err == nil {
+		worktreeDir = resolved
+	}
+
+	return filepath.Dir(worktreeDir) == filepath.Join(gitDir, "worktrees")
+}
+
+// PrefetchGitMirror clones or updates the mirror of a repository with all of
+// its refs, with the same locking and git credentials as a checkout. It's used
+// to warm up mirrors before jobs need them.
+func PrefetchGitMirror(sh *shell.Shell, conf Config, repository string) (string, error) {
+	b := &Bootstrap{Config: conf, shell: sh}
+
+	if len(b.GitCredentials) > 0 || b.GitCredentialsFile != "" {
+		restore, err := b.useGitCredentialHelper()
+		if err != nil {
 			return "", err
 		}
+		defer restore()
+	}
+
+	return b.updateGitMirror(repository, "")
+}
+
+// checkoutSubmodulesFromMirrors initialises the submodules in dir, and then
+// the submodules within them, with a reference to a mirror of each one,
+// creating or updating the mirrors with the same locking as the main
+// repository's mirror. Failing to use a mirror isn't fatal, as the submodule
+// will be fetched from origin instead.
+func (b *Bootstrap) checkoutSubmodulesFromMirrors(dir string, submodules []gitSubmodule, sparseCheckoutPaths []string) {
+	for _, submodule := range submodules {
+		if submodule.Path == "" {
+			continue
+		}
+		path := filepath.ToSlash(filepath.Join(dir, submodule.Path))
+
+		if len(sparseCheckoutPaths) > 0 && !pathWithinAny(path, sparseCheckoutPaths) {
+			continue
+		}
+
+		// Relative URLs are resolved against the superproject's remote, which
+		// isn't something we can mirror by URL
+		if strings.HasPrefix(submodule.URL, "./") || strings.HasPrefix(submodule.URL, "../") {
+			b.shell.Commentf("Submodule %s has a relative URL, so it will be fetched from origin rather than a mirror", path)
+			continue
+		}
+
+		var mirrorDir string
+		if b.Config.GitMirrorsSkipUpdate {
+			mirrorDir = filepath.Join(b.Config.GitMirrorsPath, dirForRepository(submodule.URL))
+			if !utils.FileExists(mirrorDir) {
+				b.shell.Commentf("No existing mirror found for submodule %s at %s, it will be fetched from origin.", submodule.URL, mirrorDir)
+				continue
+			}
+		} else {
+			// The commit the superproject expects the submodule to be at
+			commit, _ := b.shell.RunAndCapture("git", gitArgsIn(dir, "rev-parse", "HEAD:"+submodule.Path)...)
+
+			// Submodules aren't built from a particular branch, so fetch everything
+			var err error
+			mirrorDir, err = b.updateGitMirror(submodule.URL, commit)
+			if err != nil {
+				b.shell.Warningf("Failed to update mirror for submodule %s, it will be fetched from origin: %v", submodule.URL, err)
+				continue
+			}
+		}
+
+		if err := markGitMirrorUsed(mirrorDir); err != nil {
+			b.shell.Warningf("Failed to mark mirror %q as used: %v", mirrorDir, err)
+		}
+
+		if err := b.withMirrorLock(func() error {
+			return b.shell.Run("git", gitArgsIn(dir, "submodule", "update", "--init", "--force", "--reference", mirrorDir, "--", submodule.Path)...)
+		}); err != nil {
+			b.shell.Warningf("Failed to initialise submodule %s from mirror: %v", path, err)
+			continue
+		}
+
+		// Submodules can have submodules of their own
+		if utils.FileExists(filepath.Join(b.shell.Getwd(), path, ".gitmodules")) {
+			nested, err := gitEnumerateSubmoduleURLs(b.shell, path)
+			if err != nil {
+				b.shell.Warningf("Failed to enumerate git submodules of %s: %v", path, err)
+				continue
+			}
+			b.checkoutSubmodulesFromMirrors(path, nested, nil)
+		}
+	}
+}
+
+// gitArgsIn returns the arguments to run a git command in dir, or in the
+// current directory if it's empty
+func gitArgsIn(dir string, args ...string) []string {
+	if dir == "" {
+		return args
+	}
+	return append([]string{"-C", dir}, args...)
+}
+
+// checkoutLFSObjects fetches the LFS objects for HEAD into the shared LFS
+// storage, and then replaces the pointer files in the checkout with them
+func (b *Bootstrap) checkoutLFSObjects(sparseCheckoutPaths []string) error {
+	storagePath := b.GitLFSStoragePath
+	if storagePath == "" && b.GitMirrorsPath != "" {
+		storagePath = filepath.Join(b.GitMirrorsPath, "lfs")
+	}
+
+	if storagePath != "" {
+		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+		if err := os.MkdirAll(storagePath, 0777); err != nil {
+			return err
+		}
+		if err := b.withMirrorLock(func() error {
+			return b.shell.Run("git", "config", "--local", "lfs.storage", storagePath)
+		}); err != nil {
+			return err
+		}
+	}
+
+	include := gitSparseCheckoutPaths(b.GitLFSInclude)
+	if len(include) == 0 {
+		include = sparseCheckoutPaths
+	}
+
+	b.shell.Commentf("Fetching Git LFS objects")
+	if err := gitLFSFetch(b.shell, include, gitSparseCheckoutPaths(b.GitLFSExclude)); err != nil {
+		return err
+	}
+
+	return gitLFSCheckout(b.shell)
+}
+
+// pathWithinAny returns whether a path is one of, or is inside one of, dirs
+func pathWithinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// useGitCredentialHelper configures git to get credentials from the agent's
+// own credential helper, instead of any configured on the host, until the
+// returned func is called. The helper only finds the credentials through a
+// file that's removed afterwards, as they can't be passed through the
+// environment safely.
+func (b *Bootstrap) useGitCredentialHelper() (func(), error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the agent for the git credential helper: %v", err)
+	}
+
+	credentialsFile := b.GitCredentialsFile
+	if len(b.GitCredentials) > 0 {
+		if credentialsFile, err = agent.WriteGitCredentialsFile("", b.GitCredentials, b.GitCredentialsFile); err != nil {
+			return nil, fmt.Errorf("Failed to write git credentials file: %v", err)
+		}
+	}
+
+	// Keep the credentials out of git's output
+	redactors := b.setupRedactors()
+
+	existing, _ := b.shell.Env.Get("GIT_CONFIG_PARAMETERS")
+	vars := map[string]*string{
+		// An empty helper clears any configured on the host
+		"GIT_CONFIG_PARAMETERS": stringPtr(gitConfigParameters(existing,
+			"credential.helper=",
+			"credential.helper=!"+shellwords.QuotePosix(exe)+" git-credentials",
+		)),
+		"BUILDKITE_GIT_CREDENTIALS":      nil,
+		"BUILDKITE_GIT_CREDENTIALS_FILE": &credentialsFile,
+	}
+
+	previous := map[string]*string{}
+	for k, v := range vars {
+		if value, exists := b.shell.Env.Get(k); exists {
+			previous[k] = &value
+		} else {
+			previous[k] = nil
+		}
+		setOrRemoveEnv(b.shell.Env, k, v)
+	}
+
+	return func() {
+		redactors.Flush()
+		for k, v := range previous {
+			setOrRemoveEnv(b.shell.Env, k, v)
+		}
+		if credentialsFile != b.GitCredentialsFile {
+			if err := os.Remove(credentialsFile); err != nil {
+				b.shell.Warningf("Failed to remove git credentials file: %v", err)
+			}
+		}
+	}, nil
+}
+
+// setOrRemoveEnv sets an environment variable, or removes it if value is nil
+func setOrRemoveEnv(environment env.Environment, name string, value *string) {
+	if value != nil {
+		environment.Set(name, *value)
 	} else {
-		// Fetch the build branch from the upstream repository into the mirror.
-		if err := b.shell.Run("git", "--git-dir", mirrorDir, "fetch", "origin", b.Branch); err != nil {
-			return "", err
+		environment.Remove(name)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// gitCredentialSecrets returns the configured git credentials and their
+// passwords, so they can be redacted from the job's output. Credentials in a
+// file that can't be read are left for the credential helper to complain about.
+func (b *Bootstrap) gitCredentialSecrets() []string {
+	entries := append([]string{}, b.GitCredentials...)
+	if b.GitCredentialsFile != "" {
+		if contents, err := ioutil.ReadFile(b.GitCredentialsFile); err == nil {
+			for _, line := range strings.Split(string(contents), "\n") {
+				line = strings.TrimSpace(line)
+				if line != "" && !strings.HasPrefix(line, "#") {
+					entries = append(entries, line)
+				}
+			}
 		}
 	}
 
-	return mirrorDir, nil
+	var secrets []string
+	for _, entry := range entries {
+		secrets = append(secrets, entry)
+		if u, err := url.Parse(entry); err == nil {
+			if password, ok := u.User.Password(); ok {
+				secrets = append(secrets, password)
+			}
+		}
+	}
+
+	// Short values would redact too much
+	var redactable []string
+	for _, secret := range secrets {
+		if len(secret) >= redaction.RedactLengthMin {
+			redactable = append(redactable, secret)
+		}
+	}
+	return redactable
+}
+
+// isSparseCheckout returns whether an existing checkout has been limited by a
+// previous sparse checkout. Fresh clones never are. The .git of a worktree is
+// a file, and its sparse checkout is kept with the rest of its state in the
+// mirror.
+func (b *Bootstrap) isSparseCheckout(dotGit string) bool {
+	gitDir := dotGit
+	if worktreeDir, ok := gitWorktreeDir(dotGit); ok {
+		gitDir = worktreeDir
+	}
+
+	if !utils.FileExists(filepath.Join(gitDir, "info", "sparse-checkout")) {
+		return false
+	}
+
+	sparse, _ := b.shell.RunAndCapture("git", "config", "--bool", "core.sparseCheckout")
+	return sparse == "true"
 }
 
 // defaultCheckoutPhase is called by the CheckoutPhase if no global or plugin checkout
@@ -1251,6 +1921,14 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		addRepositoryHostToSSHKnownHosts(b.shell, b.Repository)
 	}
 
+	if len(b.GitCredentials) > 0 || b.GitCredentialsFile != "" {
+		restore, err := b.useGitCredentialHelper()
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
 	var mirrorDir string
 
 	// If we can, get a mirror of the git repository to use for reference later
@@ -1270,13 +1948,19 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 				mirrorDir = ""
 			}
 		} else {
-			mirrorDir, err = b.updateGitMirror()
+			mirrorDir, err = b.updateGitMirror(b.Repository, b.Commit, b.buildRefSpec())
 			if err != nil {
 				return err
 			}
 		}
 
 		b.shell.Env.Set("BUILDKITE_REPO_MIRROR", mirrorDir)
+
+		if mirrorDir != "" {
+			if err := markGitMirrorUsed(mirrorDir); err != nil {
+				b.shell.Warningf("Failed to mark mirror %q as used: %v", mirrorDir, err)
+			}
+		}
 	}
 
 	// Make sure the build directory exists and that we change directory into it
@@ -1284,14 +1968,109 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		return err
 	}
 
+	sparseCheckoutPaths := gitSparseCheckoutPaths(b.GitSparseCheckoutPaths)
+
+	var useWorktree bool
+	b.worktreeMirror = ""
+	switch b.GitCheckoutStrategy {
+	case "", gitCheckoutStrategyClone:
+	case gitCheckoutStrategyWorktree:
+		if mirrorDir == "" {
+			b.shell.Warningf("The worktree checkout strategy needs a git mirror, falling back to a clone")
+		} else if b.RefSpec != "" {
+			b.shell.Commentf("Custom refspecs aren't fetched into git mirrors, falling back to a clone")
+		} else {
+			useWorktree = true
+			b.worktreeMirror = mirrorDir
+			span.AddAttributes(map[string]string{"checkout.strategy": gitCheckoutStrategyWorktree})
+		}
+	default:
+		b.shell.Warningf("Unknown checkout strategy %q, expected %q or %q, falling back to a clone",
+			b.GitCheckoutStrategy, gitCheckoutStrategyClone, gitCheckoutStrategyWorktree)
+	}
+
+	checkoutMode := b.GitCheckoutMode
+	modeCloneFlags, modeFetchFlags, modeErr := gitCheckoutModeFlags(checkoutMode)
+	if modeErr != nil {
+		b.shell.Warningf("%v, falling back to a full checkout", modeErr)
+		checkoutMode = gitCheckoutModeFull
+	}
+
+	// Partial clones don't mix well with --reference, and the mirror already
+	// has all of the objects locally, so there's nothing to save
+	if mirrorDir != "" && (checkoutMode == gitCheckoutModeBlobless || checkoutMode == gitCheckoutModeTreeless) {
+		b.shell.Commentf("Ignoring %s checkout mode as objects are shared with the git mirror", checkoutMode)
+		checkoutMode, modeCloneFlags = gitCheckoutModeFull, ""
+	}
+
+	// Nor is there anything to fetch into a worktree, it has the mirror's
+	if useWorktree && checkoutMode != "" && checkoutMode != gitCheckoutModeFull {
+		b.shell.Commentf("Ignoring %s checkout mode as the checkout is a worktree of the git mirror", checkoutMode)
+		checkoutMode, modeCloneFlags, modeFetchFlags = gitCheckoutModeFull, "", ""
+	}
+
+	if modeCloneFlags != "" || modeFetchFlags != "" {
+		span.AddAttributes(map[string]string{"checkout.mode": checkoutMode})
+	}
+
 	gitCloneFlags := b.GitCloneFlags
 	if mirrorDir != "" {
 		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
 	}
+	if modeCloneFlags != "" {
+		gitCloneFlags += " " + modeCloneFlags
+	}
+
+	// With a sparse checkout there's no point checking out the whole default
+	// branch during the clone, as we're about to limit and replace it
+	if len(sparseCheckoutPaths) > 0 {
+		gitCloneFlags += " --no-checkout"
+	}
 
 	// Does the git directory exist?
 	existingGitDir := filepath.Join(b.shell.Getwd(), ".git")
-	if utils.FileExists(existingGitDir) {
+
+	// A checkout that borrowed objects from a mirror that's since been removed
+	// is beyond repair, so start again from a fresh clone
+	if hasMissingAlternates(existingGitDir) {
+		b.shell.Warningf("Existing checkout refers to a git mirror that no longer exists, removing it")
+		if err := b.removeCheckoutDir(); err != nil {
+			return err
+		}
+		if err := b.createCheckoutDir(); err != nil {
+			return err
+		}
+	}
+
+	// A worktree shares its repository with the mirror, so it can't be
+	// reused as a clone
+	if _, isWorktree := gitWorktreeDir(existingGitDir); isWorktree && !useWorktree {
+		b.shell.Commentf("Existing checkout is a worktree of a git mirror, removing it")
+		if err := b.removeCheckoutDir(); err != nil {
+			return err
+		}
+		if err := b.createCheckoutDir(); err != nil {
+			return err
+		}
+	}
+
+	// LFS objects are fetched in one go after the checkout, rather than one
+	// at a time by the smudge filter during the clone or checkout, so that
+	// they're fetched into the shared LFS storage
+	if b.GitLFS {
+		if skipSmudge, exists := b.shell.Env.Get("GIT_LFS_SKIP_SMUDGE"); exists {
+			defer b.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", skipSmudge)
+		} else {
+			defer b.shell.Env.Remove("GIT_LFS_SKIP_SMUDGE")
+		}
+		b.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", "1")
+	}
+
+	if useWorktree {
+		if err := b.addGitWorktree(mirrorDir); err != nil {
+			return err
+		}
+	} else if utils.FileExists(existingGitDir) {
 		// Update the origin of the repository so we can gracefully handle repository renames
 		if err := b.shell.Run("git", "remote", "set-url", "origin", b.Repository); err != nil {
 			return err
@@ -1302,6 +2081,25 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	// Configure the sparse checkout before anything is checked out, so that
+	// a changed set of paths (or removing them all) reconfigures an existing
+	// checkout too
+	if len(sparseCheckoutPaths) > 0 {
+		b.shell.Commentf("Limiting checkout to %s", strings.Join(sparseCheckoutPaths, ", "))
+		if err := b.withMirrorLock(func() error {
+			return gitSparseCheckoutSet(b.shell, sparseCheckoutPaths)
+		}); err != nil {
+			return err
+		}
+	} else if b.isSparseCheckout(existingGitDir) {
+		b.shell.Commentf("Restoring full checkout, BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS is empty")
+		if err := b.withMirrorLock(func() error {
+			return gitSparseCheckoutDisable(b.shell)
+		}); err != nil {
+			return err
+		}
+	}
+
 	// Git clean prior to checkout, we do this even if submodules have been
 	// disabled to ensure previous submodules are cleaned up
 	if hasGitSubmodules(b.shell) {
@@ -1315,11 +2113,23 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 	}
 
 	gitFetchFlags := b.GitFetchFlags
+	if modeFetchFlags != "" {
+		gitFetchFlags += " " + modeFetchFlags
+	}
 
-	// If a refspec is provided then use it instead.
-	// For example, `refs/not/a/head`
-	if b.RefSpec != "" {
+	// The refspecs fetched, in case a shallow fetch needs deepening
+	var fetchedRefSpecs []string
+
+	// A worktree has the objects and refs the mirror was updated with, so
+	// there's nothing to fetch
+	if useWorktree {
+		b.shell.Commentf("Using commits from the git mirror")
+
+		// If a refspec is provided then use it instead.
+		// For example, `refs/not/a/head`
+	} else if b.RefSpec != "" {
 		b.shell.Commentf("Fetch and checkout custom refspec")
+		fetchedRefSpecs = []string{b.RefSpec}
 		if err := gitFetch(b.shell, gitFetchFlags, "origin", b.RefSpec); err != nil {
 			return err
 		}
@@ -1331,6 +2141,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 	} else if b.PullRequest != "false" && strings.Contains(b.PipelineProvider, "github") {
 		b.shell.Commentf("Fetch and checkout pull request head from GitHub")
 		refspec := fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
+		fetchedRefSpecs = []string{refspec}
 
 		if err := gitFetch(b.shell, gitFetchFlags, "origin", refspec); err != nil {
 			return err
@@ -1351,19 +2162,42 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// support fetching a specific commit so we fall back to fetching all heads
 		// and tags, hoping that the commit is included.
 	} else {
+		fetchedRefSpecs = []string{b.Commit}
 		if err := gitFetch(b.shell, gitFetchFlags, "origin", b.Commit); err != nil {
 			// By default `git fetch origin` will only fetch tags which are
 			// reachable from a fetches branch. git 1.9.0+ changed `--tags` to
 			// fetch all tags in addition to the default refspec, but pre 1.9.0 it
 			// excludes the default refspec.
 			gitFetchRefspec, _ := b.shell.RunAndCapture("git", "config", "remote.origin.fetch")
+			fetchedRefSpecs = []string{gitFetchRefspec, "+refs/tags/*:refs/tags/*"}
 			if err := gitFetch(b.shell, gitFetchFlags, "origin", gitFetchRefspec, "+refs/tags/*:refs/tags/*"); err != nil {
 				return err
 			}
 		}
 	}
 
-	if b.Commit == "HEAD" {
+	// A shallow fetch may not reach back as far as the commit, in which case we
+	// deepen it rather than fail the checkout. The deepening fetches can't
+	// also use --depth.
+	if checkoutMode == gitCheckoutModeShallow && b.Commit != "HEAD" {
+		if err := gitDeepenToCommit(b.shell, b.GitFetchFlags, "origin", b.Commit, fetchedRefSpecs...); err != nil {
+			return err
+		}
+	}
+
+	if useWorktree {
+		// Always detach, a branch can only be checked out in one worktree
+		ref := b.Commit
+		if ref == "HEAD" {
+			ref = b.buildRefSpec()
+			if !strings.HasPrefix(ref, "refs/") {
+				ref = "refs/heads/" + ref
+			}
+		}
+		if err := gitCheckout(b.shell, "-f --detach", ref); err != nil {
+			return err
+		}
+	} else if b.Commit == "HEAD" {
 		if err := gitCheckout(b.shell, "-f", "FETCH_HEAD"); err != nil {
 			return err
 		}
@@ -1373,6 +2207,18 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if b.GitVerifySignatures != "" {
+		if err := b.verifyCommitSignatures(); err != nil {
+			return err
+		}
+	}
+
+	if b.GitLFS {
+		if err := b.checkoutLFSObjects(sparseCheckoutPaths); err != nil {
+			return err
+		}
+	}
+
 	var gitSubmodules bool
 	if !b.GitSubmodules && hasGitSubmodules(b.shell) {
 		b.shell.Warningf("This repository has submodules, but submodules are disabled at an agent level")
@@ -1387,29 +2233,46 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// is only available in git version 1.8.1, so
 		// if the call fails, continue the bootstrap
 		// script, and show an informative error.
-		if err := b.shell.Run("git", "submodule", "sync", "--recursive"); err != nil {
+		if err := b.withMirrorLock(func() error {
+			return b.shell.Run("git", "submodule", "sync", "--recursive")
+		}); err != nil {
 			gitVersionOutput, _ := b.shell.RunAndCapture("git", "--version")
 			b.shell.Warningf("Failed to recursively sync git submodules. This is most likely because you have an older version of git installed (" + gitVersionOutput + ") and you need version 1.8.1 and above. If you're using submodules, it's highly recommended you upgrade if you can.")
 		}
 
 		// Checking for submodule repositories
-		submoduleRepos, err := gitEnumerateSubmoduleURLs(b.shell)
+		submodules, err := gitEnumerateSubmoduleURLs(b.shell, "")
 		if err != nil {
 			b.shell.Warningf("Failed to enumerate git submodules: %v", err)
 		} else {
-			for _, repository := range submoduleRepos {
+			for _, submodule := range submodules {
 				// submodules might need their fingerprints verified too
-				if b.SSHKeyscan {
-					addRepositoryHostToSSHKnownHosts(b.shell, repository)
+				if b.SSHKeyscan && submodule.URL != "" {
+					addRepositoryHostToSSHKnownHosts(b.shell, submodule.URL)
 				}
 			}
 		}
 
-		if err := b.shell.Run("git", "submodule", "update", "--init", "--recursive", "--force"); err != nil {
-			return err
+		// Initialise each submodule referencing its own mirror first, so that
+		// only objects missing from the mirror are fetched from origin
+		if mirrorDir != "" && err == nil {
+			b.checkoutSubmodulesFromMirrors("", submodules, sparseCheckoutPaths)
+		}
+
+		// Only initialise submodules within the sparse checkout, if there is one
+		submoduleUpdateArgs := []string{"submodule", "update", "--init", "--recursive", "--force"}
+		if len(sparseCheckoutPaths) > 0 {
+			submoduleUpdateArgs = append(submoduleUpdateArgs, "--")
+			submoduleUpdateArgs = append(submoduleUpdateArgs, sparseCheckoutPaths...)
 		}
 
-		if err := b.shell.Run("git", "submodule", "foreach", "--recursive", "git reset --hard"); err != nil {
+		// A worktree's submodules are kept in the mirror's modules directory
+		if err := b.withMirrorLock(func() error {
+			if err := b.shell.Run("git", submoduleUpdateArgs...); err != nil {
+				return err
+			}
+			return b.shell.Run("git", "submodule", "foreach", "--recursive", "git reset --hard")
+		}); err != nil {
 			return err
 		}
 	}
@@ -1594,6 +2457,17 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 		return fmt.Errorf("The command phase has no `command` to execute. Provide a `command` field in your step configuration, or define a `command` hook in a step plug-in, your repository `.buildkite/hooks`, or agent `hooks-path`.")
 	}
 
+	// Check each line of the command against the allowlist, if there is one
+	if b.CommandAllowlist != "" {
+		list, err := allowlist.Load(b.CommandAllowlist)
+		if err != nil {
+			return fmt.Errorf("Failed to load the command allowlist: %v", err)
+		}
+		if err := list.Check(b.Command); err != nil {
+			return err
+		}
+	}
+
 	scriptFileName := strings.Replace(b.Command, "\n", "", -1)
 	pathToCommand, err := filepath.Abs(filepath.Join(b.shell.Getwd(), scriptFileName))
 	commandIsScript := err == nil && utils.FileExists(pathToCommand)
@@ -1906,12 +2780,18 @@ func (b *Bootstrap) ignoredEnv() []string {
 	return ignored
 }
 
+// valuesToRedact returns the values of environment variables matching the
+// RedactedVars configuration, and the configured git credentials
+func (b *Bootstrap) valuesToRedact(environment map[string]string) []string {
+	return append(redaction.GetValuesToRedact(b.shell, b.Config.RedactedVars, environment), b.gitCredentialSecrets()...)
+}
+
 // setupRedactors wraps shell output and logging in Redactor if any redaction
 // is necessary based on RedactedVars configuration and the existence of
 // matching environment vars.
 // redaction.RedactorMux (possibly empty) is returned so the caller can `defer redactor.Flush()`
 func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
-	valuesToRedact := redaction.GetValuesToRedact(b.shell, b.Config.RedactedVars, b.shell.Env)
+	valuesToRedact := b.valuesToRedact(b.shell.Env)
 	if len(valuesToRedact) == 0 {
 		return nil
 	}
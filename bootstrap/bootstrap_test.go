@@ -2,6 +2,8 @@ package bootstrap
 
 import (
 	"context"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
@@ -9,6 +11,7 @@ import (
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/opentracer"
 )
 
@@ -120,3 +123,28 @@ func TestStartTracing_Datadog(t *testing.T) {
 	assert.Equal(t, spanImpl.Span, opentracing.SpanFromContext(ctx))
 	stopper()
 }
+
+func TestPathWithinAny(t *testing.T) {
+	dirs := []string{"app", "lib/shared"}
+
+	assert.True(t, pathWithinAny("app", dirs))
+	assert.True(t, pathWithinAny("app/vendor/thing", dirs))
+	assert.True(t, pathWithinAny("lib/shared/sub", dirs))
+	assert.False(t, pathWithinAny("application", dirs))
+	assert.False(t, pathWithinAny("lib", dirs))
+}
+
+func TestPreparePluginsEnforcesPolicy(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.yml")
+	require.NoError(t, ioutil.WriteFile(policy, []byte("allow:\n  - repository: https://github.com/my-org/*\n"), 0600))
+
+	b := New(Config{
+		Plugins:           `[{"./.buildkite/plugins/vendored":{}},{"github.com/my-org/deploy#v1.0.0":{}},{"github.com/someone-else/plugin#v1.0.0":{}}]`,
+		PluginsEnabled:    true,
+		PluginsPolicyFile: policy,
+	})
+	b.shell = shell.NewTestShell(t)
+
+	err := b.preparePlugins()
+	assert.EqualError(t, err, `Plugin "github.com/someone-else/plugin#v1.0.0" from https://github.com/someone-else/plugin isn't allowed by the agent's plugins policy`)
+}
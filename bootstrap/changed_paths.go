@@ -0,0 +1,155 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Finds the merge-base between HEAD and the pull request's base branch
+	changedPathsBasePullRequest = "pull-request"
+
+	// Reads a commit from build meta-data, e.g. meta-data:last-green-commit
+	changedPathsBaseMetaDataPrefix = "meta-data:"
+)
+
+// exportChangedPaths works out which files have changed in the checkout compared
+// to a base revision, writes them to a file (one path per line) and exports the
+// path to that file as BUILDKITE_CHANGED_PATHS_FILE. This is used by `pipeline
+// upload` to filter steps with `if_changed`, and is available to any custom
+// pipeline generators. Paths containing a line break can't be written that way,
+// so if any have changed nothing is exported, and steps aren't filtered.
+//
+// ChangedPathsBase is a comma-separated list of strategies that are tried in
+// order until one of them resolves to a commit:
+//
+//	pull-request      the merge-base of HEAD and the pull request's base branch
+//	meta-data:<key>   a commit stored in the build meta-data under <key>
+//	<revision>        any other git revision, e.g. HEAD~1 or origin/main
+func (b *Bootstrap) exportChangedPaths() error {
+	base, strategy, err := b.resolveChangedPathsBase()
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		b.shell.Warningf("Couldn't find a base revision from %q, steps with if_changed will not be filtered", b.ChangedPathsBase)
+		return nil
+	}
+
+	b.shell.Commentf("Comparing changes against %s (%s)", base, strategy)
+
+	paths, err := gitDiffNameOnly(b.shell, base)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if strings.ContainsAny(p, "\r\n") {
+			return fmt.Errorf("Changed path %q contains a line break, so can't be written one per line", p)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "buildkite-changed-paths-")
+	if err != nil {
+		return err
+	}
+
+	// Track the directory so we can remove it at the end of the bootstrap
+	b.cleanupDirs = append(b.cleanupDirs, dir)
+
+	var contents string
+	if len(paths) > 0 {
+		contents = strings.Join(paths, "\n") + "\n"
+	}
+
+	file := filepath.Join(dir, "changed-paths")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		return err
+	}
+
+	b.shell.Commentf("Found %d changed paths, written to %s", len(paths), file)
+	if b.Debug {
+		for _, p := range paths {
+			b.shell.Printf("%s", p)
+		}
+	}
+
+	b.shell.Env.Set("BUILDKITE_CHANGED_PATHS_BASE_COMMIT", base)
+	b.shell.Env.Set("BUILDKITE_CHANGED_PATHS_FILE", file)
+	return nil
+}
+
+// resolveChangedPathsBase returns the commit to compare against and the name of
+// the strategy that found it. An empty commit means no strategy applied.
+func (b *Bootstrap) resolveChangedPathsBase() (string, string, error) {
+	for _, strategy := range strings.Split(b.ChangedPathsBase, ",") {
+		strategy = strings.TrimSpace(strategy)
+
+		switch {
+		case strategy == "":
+			continue
+
+		case strategy == changedPathsBasePullRequest:
+			baseBranch, _ := b.shell.Env.Get("BUILDKITE_PULL_REQUEST_BASE_BRANCH")
+			if b.PullRequest == "" || b.PullRequest == "false" || baseBranch == "" {
+				if b.Debug {
+					b.shell.Commentf("Not a pull request, skipping %s", strategy)
+				}
+				continue
+			}
+
+			if err := b.withMirrorLock(func() error {
+				return gitFetch(b.shell, b.GitFetchFlags, "origin", baseBranch)
+			}); err != nil {
+				return "", "", err
+			}
+
+			mergeBase, err := b.shell.RunAndCapture("git", "merge-base", "HEAD", "FETCH_HEAD")
+			if err != nil {
+				return "", "", fmt.Errorf("Failed to find merge-base with %q: %v", baseBranch, err)
+			}
+			return mergeBase, fmt.Sprintf("merge-base with %s", baseBranch), nil
+
+		case strings.HasPrefix(strategy, changedPathsBaseMetaDataPrefix):
+			key := strings.TrimPrefix(strategy, changedPathsBaseMetaDataPrefix)
+			if err := b.shell.Run("buildkite-agent", "meta-data", "exists", key); err != nil {
+				if b.Debug {
+					b.shell.Commentf("No meta-data for %q, skipping %s", key, strategy)
+				}
+				continue
+			}
+
+			commit, err := b.shell.RunAndCapture("buildkite-agent", "meta-data", "get", key)
+			if err != nil {
+				return "", "", err
+			}
+			if commit == "" {
+				continue
+			}
+
+			// The commit may not have been fetched as part of the checkout
+			if !hasGitCommit(b.shell, ".git", commit) {
+				if err := b.withMirrorLock(func() error {
+					return gitFetch(b.shell, b.GitFetchFlags, "origin", commit)
+				}); err != nil {
+					return "", "", err
+				}
+			}
+			return commit, strategy, nil
+
+		default:
+			commit, err := b.shell.RunAndCapture("git", "rev-parse", "--verify", "--quiet", strategy+"^{commit}")
+			if err != nil || commit == "" {
+				if b.Debug {
+					b.shell.Commentf("Couldn't resolve %q, skipping", strategy)
+				}
+				continue
+			}
+			return commit, strategy, nil
+		}
+	}
+
+	return "", "", nil
+}
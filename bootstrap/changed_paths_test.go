@@ -0,0 +1,73 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// commitChangedPaths creates a repository with an initial commit, and a second
+// commit adding the given files
+func commitChangedPaths(t *testing.T, files ...string) string {
+	t.Helper()
+
+	repo := t.TempDir()
+	git := func(args ...string) {
+		args = append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	git("init", "--quiet")
+	git("commit", "--quiet", "--allow-empty", "-m", "Initial commit")
+	for _, file := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(repo, file)), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(repo, file), []byte("changed"), 0600))
+	}
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "Change some files")
+
+	return repo
+}
+
+func TestExportChangedPaths(t *testing.T) {
+	t.Parallel()
+
+	repo := commitChangedPaths(t, "app/main.go", "README.md")
+
+	sh := shell.NewTestShell(t)
+	require.NoError(t, sh.Chdir(repo))
+
+	b := &Bootstrap{Config: Config{ChangedPathsBase: "HEAD~1"}, shell: sh}
+	require.NoError(t, b.exportChangedPaths())
+	defer os.RemoveAll(b.cleanupDirs[0])
+
+	file, exists := sh.Env.Get("BUILDKITE_CHANGED_PATHS_FILE")
+	require.True(t, exists)
+
+	contents, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "README.md\napp/main.go\n", string(contents))
+}
+
+func TestExportChangedPathsRejectsPathsWithLineBreaks(t *testing.T) {
+	t.Parallel()
+
+	repo := commitChangedPaths(t, "app/main.go", "two\nlines.txt")
+
+	sh := shell.NewTestShell(t)
+	require.NoError(t, sh.Chdir(repo))
+
+	b := &Bootstrap{Config: Config{ChangedPathsBase: "HEAD~1"}, shell: sh}
+	assert.EqualError(t, b.exportChangedPaths(), `Changed path "two\nlines.txt" contains a line break, so can't be written one per line`)
+
+	_, exists := sh.Env.Get("BUILDKITE_CHANGED_PATHS_FILE")
+	assert.False(t, exists)
+}
@@ -0,0 +1,108 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+// envChange is the last change a hook made to an environment variable. Only
+// the name of the variable is kept, never its value, so that secrets can't
+// leak through it.
+type envChange struct {
+	Hook   string `json:"hook"`
+	Change string `json:"change"`
+}
+
+// envProvenance records which hook last added, changed or removed each
+// environment variable, like "PATH changed by global environment hook"
+type envProvenance struct {
+	changes map[string]envChange
+}
+
+// record notes the changes a hook made to the environment
+func (p *envProvenance) record(hookName string, diff env.Diff) {
+	if p.changes == nil {
+		p.changes = map[string]envChange{}
+	}
+
+	for name := range diff.Added {
+		p.changes[name] = envChange{Hook: hookName, Change: "added"}
+	}
+	for name := range diff.Changed {
+		p.changes[name] = envChange{Hook: hookName, Change: "changed"}
+	}
+	for name := range diff.Removed {
+		p.changes[name] = envChange{Hook: hookName, Change: "removed"}
+	}
+}
+
+// names returns the names of the variables hooks have changed, in order
+func (p *envProvenance) names() []string {
+	names := make([]string, 0, len(p.changes))
+	for name := range p.changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MarshalJSON returns an object of variable names to their last change
+func (p *envProvenance) MarshalJSON() ([]byte, error) {
+	if p.changes == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(p.changes)
+}
+
+// reportEnvProvenance shows which hooks last changed each environment
+// variable if BUILDKITE_DEBUG_ENV is on, and always writes them to the
+// env-provenance-file
+func (b *Bootstrap) reportEnvProvenance() {
+	if b.DebugEnv {
+		b.shell.Headerf("Environment variables changed by hooks")
+
+		names := b.envProvenance.names()
+		if len(names) == 0 {
+			b.shell.Commentf("No hooks changed any environment variables")
+		}
+		for _, name := range names {
+			change := b.envProvenance.changes[name]
+			b.shell.Printf("%s %s by the %s hook", name, change.Change, change.Hook)
+		}
+	}
+
+	path := b.envProvenanceFile()
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(&b.envProvenance, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		b.shell.Warningf("Failed to write environment variable changes to %q: %v", path, err)
+	}
+}
+
+// envProvenanceFile returns where to write which hooks changed each
+// environment variable. Unless the agent is configured with somewhere, it's
+// in the agent's directory within the build path, which jobs can't change,
+// and which each job on the agent overwrites.
+func (b *Bootstrap) envProvenanceFile() string {
+	if b.EnvProvenanceFile != "" {
+		return b.EnvProvenanceFile
+	}
+	if b.BuildPath == "" {
+		return ""
+	}
+	return filepath.Join(b.BuildPath, dirForAgentName(b.AgentName), "env-provenance.json")
+}
@@ -0,0 +1,40 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvProvenanceRecordsTheLastChange(t *testing.T) {
+	t.Parallel()
+
+	var p envProvenance
+
+	data, err := json.Marshal(&p)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(data))
+
+	p.record("global environment", env.Diff{
+		Added:   map[string]string{"AWS_PROFILE": "ci", "DOCKER_HOST": "tcp://docker"},
+		Changed: map[string]env.DiffPair{"PATH": {Old: "/bin", New: "/opt/bin:/bin"}},
+	})
+	p.record("plugin docker-compose environment", env.Diff{
+		Changed: map[string]env.DiffPair{"PATH": {Old: "/opt/bin:/bin", New: "/docker/bin:/opt/bin:/bin"}},
+		Removed: map[string]struct{}{"DOCKER_HOST": {}},
+	})
+
+	assert.Equal(t, []string{"AWS_PROFILE", "DOCKER_HOST", "PATH"}, p.names())
+
+	data, err = json.Marshal(&p)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"AWS_PROFILE": {"hook": "global environment", "change": "added"},
+		"DOCKER_HOST": {"hook": "plugin docker-compose environment", "change": "removed"},
+		"PATH": {"hook": "plugin docker-compose environment", "change": "changed"}
+	}`, string(data))
+	assert.NotContains(t, string(data), "/bin")
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -21,6 +23,9 @@ const (
 	gitErrorFetch
 	gitErrorClean
 	gitErrorCleanSubmodules
+	gitErrorSparseCheckout
+	gitErrorLFS
+	gitErrorVerifyCommit
 )
 
 type gitError struct {
@@ -130,33 +135,298 @@ func gitFetch(sh shellRunner, gitFetchFlags, repository string, refSpec ...strin
 	return nil
 }
 
-func gitEnumerateSubmoduleURLs(sh *shell.Shell) ([]string, error) {
-	urls := []string{}
+// gitSparseCheckoutSet enables cone-mode sparse checkout, limiting the working
+// tree to the given directories (and all files in the top-level directory).
+// Running it on a checkout with a different set of paths reconfigures it.
+func gitSparseCheckoutSet(sh shellRunner, paths []string) error {
+	if err := sh.Run("git", "sparse-checkout", "init", "--cone"); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	commandArgs := []string{"sparse-checkout", "set", "--"}
+	commandArgs = append(commandArgs, paths...)
+
+	if err := sh.Run("git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	return nil
+}
+
+// gitSparseCheckoutDisable restores the full working tree
+func gitSparseCheckoutDisable(sh shellRunner) error {
+	if err := sh.Run("git", "sparse-checkout", "disable"); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	return nil
+}
+
+// gitSparseCheckoutPaths splits a list of paths separated by commas or newlines,
+// ignoring blank entries and leading or trailing slashes
+func gitSparseCheckoutPaths(paths string) []string {
+	result := []string{}
+	for _, p := range strings.FieldsFunc(paths, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if p = strings.Trim(strings.TrimSpace(p), "/"); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+const (
+	gitCheckoutModeFull     = "full"
+	gitCheckoutModeShallow  = "shallow"
+	gitCheckoutModeBlobless = "blobless"
+	gitCheckoutModeTreeless = "treeless"
+)
+
+const (
+	gitCheckoutStrategyClone    = "clone"
+	gitCheckoutStrategyWorktree = "worktree"
+)
+
+// gitWorktreeDir returns the directory within the main repository that holds
+// the state of a worktree, read from the .git file that git leaves in the
+// worktree. It returns false if the .git isn't that of a worktree.
+func gitWorktreeDir(dotGit string) (string, bool) {
+	info, err := os.Stat(dotGit)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+
+	contents, err := ioutil.ReadFile(dotGit)
+	if err != nil || !bytes.HasPrefix(contents, []byte("gitdir:")) {
+		return "", false
+	}
+
+	dir := strings.TrimSpace(strings.TrimPrefix(string(contents), "gitdir:"))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(dotGit), dir)
+	}
+
+	// Submodules have a .git file too, but theirs points into modules/
+	if filepath.Base(filepath.Dir(dir)) != "worktrees" {
+		return "", false
+	}
+
+	return dir, true
+}
+
+// gitCheckoutModeFlags returns the extra flags to pass to "git clone" and
+// "git fetch" for a checkout mode. An empty mode is the same as a full one.
+func gitCheckoutModeFlags(mode string) (cloneFlags, fetchFlags string, err error) {
+	switch mode {
+	case "", gitCheckoutModeFull:
+		return "", "", nil
+	case gitCheckoutModeShallow:
+		return "--depth=1", "--depth=1", nil
+	case gitCheckoutModeBlobless:
+		// Partial clone filters are remembered by the remote config, so
+		// subsequent fetches don't need them
+		return "--filter=blob:none", "", nil
+	case gitCheckoutModeTreeless:
+		return "--filter=tree:0", "", nil
+	default:
+		return "", "", fmt.Errorf("Unknown checkout mode %q, expected one of %q, %q, %q or %q",
+			mode, gitCheckoutModeFull, gitCheckoutModeShallow, gitCheckoutModeBlobless, gitCheckoutModeTreeless)
+	}
+}
+
+// gitShallowDeepenSteps are how many commits to add to a shallow fetch at a
+// time while looking for a commit, before giving up and fetching everything
+var gitShallowDeepenSteps = []int{50, 500, 5000}
+
+// gitDeepenToCommit incrementally deepens a shallow fetch of the refspecs
+// until the commit is available locally, finally unshallowing the repository
+// if it's still missing. It's a no-op if the commit is already there.
+func gitDeepenToCommit(sh *shell.Shell, gitFetchFlags, repository, commit string, refSpec ...string) error {
+	if !gitCheckRefFormat(commit) {
+		return fmt.Errorf("%q is not a valid git ref format", commit)
+	}
 
+	for _, depth := range gitShallowDeepenSteps {
+		if hasGitCommit(sh, ".git", commit) || !gitIsShallow(sh) {
+			return nil
+		}
+
+		sh.Commentf("Commit %s isn't in the shallow history, deepening by %d commits", commit, depth)
+		if err := gitFetch(sh, fmt.Sprintf("%s --deepen=%d", gitFetchFlags, depth), repository, refSpec...); err != nil {
+			return err
+		}
+	}
+
+	if hasGitCommit(sh, ".git", commit) || !gitIsShallow(sh) {
+		return nil
+	}
+
+	sh.Commentf("Commit %s still isn't in the shallow history, fetching the complete history", commit)
+	return gitFetch(sh, gitFetchFlags+" --unshallow", repository, refSpec...)
+}
+
+// gitIsShallow returns whether the local repository has shallow history
+func gitIsShallow(sh *shell.Shell) bool {
+	output, err := sh.RunAndCapture("git", "rev-parse", "--is-shallow-repository")
+	return err == nil && output == "true"
+}
+
+// gitLFSFetch downloads the LFS objects needed by HEAD, limited to paths that
+// match the include patterns and don't match the exclude patterns
+func gitLFSFetch(sh shellRunner, include, exclude []string) error {
+	commandArgs := []string{"lfs", "fetch"}
+	if len(include) > 0 {
+		commandArgs = append(commandArgs, "--include="+strings.Join(include, ","))
+	}
+	if len(exclude) > 0 {
+		commandArgs = append(commandArgs, "--exclude="+strings.Join(exclude, ","))
+	}
+
+	if err := sh.Run("git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorLFS}
+	}
+
+	return nil
+}
+
+// gitLFSCheckout replaces LFS pointer files in the working tree with the
+// objects that have been fetched
+func gitLFSCheckout(sh shellRunner) error {
+	if err := sh.Run("git", "lfs", "checkout"); err != nil {
+		return &gitError{error: err, Type: gitErrorLFS}
+	}
+
+	return nil
+}
+
+// gitConfigParameters formats configuration, given as key=value, for
+// GIT_CONFIG_PARAMETERS. That's how git passes `-c` options on to the git
+// commands it runs itself, such as for submodules, so setting it is the same
+// as passing `-c` to every git command.
+func gitConfigParameters(existing string, params ...string) string {
+	quoted := make([]string, 0, len(params)+1)
+	if existing != "" {
+		quoted = append(quoted, existing)
+	}
+	for _, p := range params {
+		quoted = append(quoted, "'"+strings.Replace(p, "'", `'\''`, -1)+"'")
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// gitVerifyCommit checks the GPG or SSH signature of a commit, with
+// configuration, given as key=value, that overrides the repository's
+func gitVerifyCommit(sh shellRunner, config []string, commit string) error {
+	if !gitCheckRefFormat(commit) {
+		return fmt.Errorf("%q is not a valid git ref format", commit)
+	}
+
+	commandArgs := []string{}
+	for _, c := range config {
+		commandArgs = append(commandArgs, "-c", c)
+	}
+	commandArgs = append(commandArgs, "verify-commit", commit)
+
+	if err := sh.Run("git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorVerifyCommit}
+	}
+
+	return nil
+}
+
+// gitRevList returns the commits reachable from HEAD but not from base
+func gitRevList(sh *shell.Shell, base string) ([]string, error) {
+	if !gitCheckRefFormat(base) {
+		return nil, fmt.Errorf("%q is not a valid git ref format", base)
+	}
+
+	output, err := sh.RunAndCapture("git", "rev-list", base+"..HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(output), nil
+}
+
+// gitSubmodule is a submodule declared in .gitmodules
+type gitSubmodule struct {
+	Name string
+	Path string
+	URL  string
+}
+
+// gitEnumerateSubmoduleURLs returns the submodules declared in the
+// .gitmodules file in dir, in the order they're declared, with their URLs and
+// paths relative to dir
+func gitEnumerateSubmoduleURLs(sh *shell.Shell, dir string) ([]gitSubmodule, error) {
 	// The output of this command looks like:
+	// submodule.bitbucket-git-docker-example.path\nvendor/docker-example\0
 	// submodule.bitbucket-git-docker-example.url\ngit@bitbucket.org:lox24/docker-example.git\0
-	// submodule.bitbucket-https-docker-example.url\nhttps://lox24@bitbucket.org/lox24/docker-example.git\0
-	// submodule.github-git-docker-example.url\ngit@github.com:buildkite/docker-example.git\0
+	// submodule.github-https-docker-example.path\nvendor/docker-example-https\0
 	// submodule.github-https-docker-example.url\nhttps://github.com/buildkite/docker-example.git\0
 	output, err := sh.RunAndCapture(
-		"git", "config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url")
+		"git", "config", "--file", filepath.Join(dir, ".gitmodules"), "--null", "--get-regexp", "submodule\\..+\\.(path|url)")
 	if err != nil {
 		return nil, err
 	}
 
-	// splits lines on null-bytes to gracefully handle line endings and repositories with newlines
-	lines := strings.Split(strings.TrimRight(output, "\x00"), "\x00")
+	submodules := []gitSubmodule{}
+	index := map[string]int{}
 
-	// process each line
-	for _, line := range lines {
+	// splits lines on null-bytes to gracefully handle line endings and repositories with newlines
+	for _, line := range strings.Split(strings.TrimRight(output, "\x00"), "\x00") {
 		tokens := strings.SplitN(line, "\n", 2)
 		if len(tokens) != 2 {
 			return nil, fmt.Errorf("Failed to parse .gitmodules line %q", line)
 		}
-		urls = append(urls, tokens[1])
+
+		// The name can contain dots, so take the key from the end
+		key := strings.TrimPrefix(tokens[0], "submodule.")
+		dot := strings.LastIndex(key, ".")
+		if dot < 0 {
+			return nil, fmt.Errorf("Failed to parse .gitmodules line %q", line)
+		}
+		name, attr := key[:dot], key[dot+1:]
+
+		i, ok := index[name]
+		if !ok {
+			i = len(submodules)
+			index[name] = i
+			submodules = append(submodules, gitSubmodule{Name: name})
+		}
+
+		switch attr {
+		case "path":
+			submodules[i].Path = tokens[1]
+		case "url":
+			submodules[i].URL = tokens[1]
+		}
+	}
+
+	return submodules, nil
+}
+
+// gitDiffNameOnly returns the paths of the files that differ between the base
+// revision and HEAD, relative to the root of the repository
+func gitDiffNameOnly(sh *shell.Shell, base string) ([]string, error) {
+	if !gitCheckRefFormat(base) {
+		return nil, fmt.Errorf("%q is not a valid git ref format", base)
+	}
+
+	// -z keeps paths with unusual characters intact, instead of quoting them
+	output, err := sh.RunAndCapture("git", "diff", "--name-only", "--no-renames", "-z", base, "HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, p := range strings.Split(output, "\x00") {
+		if p != "" {
+			paths = append(paths, p)
+		}
 	}
 
-	return urls, nil
+	return paths, nil
 }
 
 func gitRevParseInWorkingDirectory(sh *shell.Shell, workingDirectory string, extraRevParseArgs ...string) (string, error) {
@@ -0,0 +1,282 @@
+package bootstrap
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// GitMirrorsGCConfig configures the maintenance of the git mirrors directory
+type GitMirrorsGCConfig struct {
+	// Path where the repository mirrors are stored
+	Path string
+
+	// Evict the least recently used mirrors until the total size of the
+	// mirrors is no more than this many bytes. Zero means no limit.
+	MaxSize int64
+
+	// Evict mirrors that haven't been used by a checkout for this long. Zero
+	// means no limit.
+	MaxAge time.Duration
+}
+
+// The mirror locks are only tried once, so that mirrors that are in use are
+// skipped rather than waited for
+const gitMirrorsGCLockTimeout = 0
+
+// gitMirror is a mirror found in the git mirrors directory
+type gitMirror struct {
+	Dir      string
+	LastUsed time.Time
+	Size     int64
+}
+
+// GCGitMirrors runs git's own maintenance over each mirror in the git mirrors
+// directory, prunes refs that no longer exist upstream, and then removes the
+// least recently used mirrors if they're older or larger than configured.
+//
+// It takes the same locks as the checkout, so mirrors that are being cloned or
+// updated are skipped rather than waited for, and mirrors with worktrees
+// checked out aren't removed.
+func GCGitMirrors(sh *shell.Shell, cfg GitMirrorsGCConfig) error {
+	mirrors, err := findGitMirrors(cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	var kept []gitMirror
+	var total int64
+
+	for _, mirror := range mirrors {
+		if cfg.MaxAge > 0 && time.Since(mirror.LastUsed) > cfg.MaxAge {
+			sh.Commentf("Removing mirror %q, last used %s", mirror.Dir, mirror.LastUsed.Format(time.RFC3339))
+			if err := removeGitMirror(sh, mirror.Dir); err != nil {
+				sh.Warningf("Failed to remove mirror %q: %v", mirror.Dir, err)
+				kept = append(kept, mirror)
+				total += mirror.Size
+			}
+			continue
+		}
+
+		if err := maintainGitMirror(sh, mirror.Dir); err != nil {
+			sh.Warningf("Skipping maintenance of mirror %q: %v", mirror.Dir, err)
+		} else if size, err := dirSize(mirror.Dir); err == nil {
+			mirror.Size = size
+		}
+
+		kept = append(kept, mirror)
+		total += mirror.Size
+	}
+
+	if cfg.MaxSize <= 0 || total <= cfg.MaxSize {
+		return nil
+	}
+
+	// Evict the least recently used mirrors first
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].LastUsed.Before(kept[j].LastUsed)
+	})
+
+	for _, mirror := range kept {
+		if total <= cfg.MaxSize {
+			break
+		}
+
+		sh.Commentf("Removing mirror %q, mirrors are using %d bytes of %d", mirror.Dir, total, cfg.MaxSize)
+		if err := removeGitMirror(sh, mirror.Dir); err != nil {
+			sh.Warningf("Failed to remove mirror %q: %v", mirror.Dir, err)
+			continue
+		}
+		total -= mirror.Size
+	}
+
+	if total > cfg.MaxSize {
+		return fmt.Errorf("Mirrors are still using %d bytes, more than the limit of %d", total, cfg.MaxSize)
+	}
+
+	return nil
+}
+
+// markGitMirrorUsed records that a checkout has used a mirror, so that the
+// least recently used ones can be evicted first
+func markGitMirrorUsed(mirrorDir string) error {
+	path := mirrorDir + ".lastused"
+	now := time.Now()
+
+	if err := os.Chtimes(path, now, now); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(path, nil, 0666)
+}
+
+// findGitMirrors returns the mirrors in the git mirrors directory, along with
+// when they were last used and how big they are
+func findGitMirrors(path string) ([]gitMirror, error) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var mirrors []gitMirror
+	for _, entry := range entries {
+		dir := filepath.Join(path, entry.Name())
+
+		// Lock files and markers live alongside the bare repositories
+		if !entry.IsDir() || !utils.FileExists(filepath.Join(dir, "HEAD")) {
+			continue
+		}
+
+		mirror := gitMirror{Dir: dir, LastUsed: entry.ModTime()}
+		if info, err := os.Stat(dir + ".lastused"); err == nil {
+			mirror.LastUsed = info.ModTime()
+		}
+		if mirror.Size, err = dirSize(dir); err != nil {
+			return nil, err
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	return mirrors, nil
+}
+
+// maintainGitMirror prunes stale refs and worktrees from a mirror and lets git
+// repack and clean it up if it needs to
+func maintainGitMirror(sh *shell.Shell, mirrorDir string) error {
+	updateLock, err := sh.LockFile(mirrorDir+".updatelock", gitMirrorsGCLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer updateLock.Unlock()
+
+	if err := sh.Run("git", "--git-dir", mirrorDir, "remote", "prune", "origin"); err != nil {
+		sh.Warningf("Failed to prune stale refs from mirror %q: %v", mirrorDir, err)
+	}
+
+	// Forget about the worktrees of checkouts that have been removed
+	if err := sh.Run("git", "--git-dir", mirrorDir, "worktree", "prune"); err != nil {
+		sh.Warningf("Failed to prune worktrees of mirror %q: %v", mirrorDir, err)
+	}
+
+	// git maintenance was added in git 2.29, fall back to gc on older versions
+	if err := sh.Run("git", "--git-dir", mirrorDir, "maintenance", "run", "--auto"); err != nil {
+		return sh.Run("git", "--git-dir", mirrorDir, "gc", "--auto")
+	}
+
+	return nil
+}
+
+// removeGitMirror removes a mirror if nothing is cloning or updating it, and
+// no checkouts are worktrees of it
+func removeGitMirror(sh *shell.Shell, mirrorDir string) error {
+	cloneLock, err := sh.LockFile(mirrorDir+".clonelock", gitMirrorsGCLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer cloneLock.Unlock()
+
+	updateLock, err := sh.LockFile(mirrorDir+".updatelock", gitMirrorsGCLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer updateLock.Unlock()
+
+	worktrees, err := gitMirrorWorktrees(sh, mirrorDir)
+	if err != nil {
+		return err
+	}
+	if len(worktrees) > 0 {
+		return fmt.Errorf("it has a worktree checked out at %q", worktrees[0])
+	}
+
+	if err := os.RemoveAll(mirrorDir); err != nil {
+		return err
+	}
+
+	if err := os.Remove(mirrorDir + ".lastused"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// gitMirrorWorktrees returns the paths of the worktrees of a mirror that are
+// still checked out
+func gitMirrorWorktrees(sh *shell.Shell, mirrorDir string) ([]string, error) {
+	out, err := sh.RunAndCapture("git", "--git-dir", mirrorDir, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each worktree is a "worktree <path>" line followed by its attributes,
+	// the first of them being the mirror itself
+	var worktrees []string
+	for _, line := range strings.Split(out, "\n") {
+		path := strings.TrimPrefix(line, "worktree ")
+		if path == line || filepath.Clean(path) == filepath.Clean(mirrorDir) {
+			continue
+		}
+		if utils.FileExists(path) {
+			worktrees = append(worktrees, path)
+		}
+	}
+
+	return worktrees, nil
+}
+
+// hasMissingAlternates returns whether a checkout refers to objects in another
+// repository, such as a git mirror, that no longer exists
+func hasMissingAlternates(gitDir string) bool {
+	f, err := os.Open(filepath.Join(gitDir, "objects", "info", "alternates"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		alternate := strings.TrimSpace(scanner.Text())
+		if alternate == "" || strings.HasPrefix(alternate, "#") {
+			continue
+		}
+		if !filepath.IsAbs(alternate) {
+			alternate = filepath.Join(gitDir, "objects", alternate)
+		}
+		if !utils.FileExists(alternate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dirSize returns the total size of the files within a directory
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can disappear from under us as git repacks
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
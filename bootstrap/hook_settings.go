@@ -0,0 +1,266 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+)
+
+// What happens to the job when a hook fails
+const (
+	hookFailurePolicyFail     = "fail"
+	hookFailurePolicyWarn     = "warn"
+	hookFailurePolicySoftFail = "soft-fail"
+)
+
+// hookFailurePolicy is what happens to the job when a hook fails. Soft-failed
+// hooks let the job carry on, but it exits with the hook's exit status, or a
+// given exit status, if nothing else fails it.
+type hookFailurePolicy struct {
+	Action   string
+	ExitCode int
+}
+
+func parseHookFailurePolicy(s string) (hookFailurePolicy, error) {
+	action, code, hasCode := strings.Cut(s, ":")
+
+	switch action {
+	case hookFailurePolicyFail, hookFailurePolicyWarn:
+		if hasCode {
+			return hookFailurePolicy{}, fmt.Errorf("only %s takes an exit status, got %q", hookFailurePolicySoftFail, s)
+		}
+		return hookFailurePolicy{Action: action}, nil
+
+	case hookFailurePolicySoftFail:
+		policy := hookFailurePolicy{Action: action}
+		if hasCode {
+			exitCode, err := strconv.Atoi(code)
+			if err != nil || exitCode <= 0 || exitCode > 255 {
+				return hookFailurePolicy{}, fmt.Errorf("expected an exit status from 1 to 255, got %q", code)
+			}
+			policy.ExitCode = exitCode
+		}
+		return policy, nil
+	}
+
+	return hookFailurePolicy{}, fmt.Errorf("expected %s, %s or %s[:<exit status>], got %q",
+		hookFailurePolicyFail, hookFailurePolicyWarn, hookFailurePolicySoftFail, s)
+}
+
+func parseHookTimeout(s string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive, got %q", s)
+	}
+	return timeout, nil
+}
+
+// parseHookSettings parses settings like pre-command=5m into a map of the
+// hook they're for to their value
+func parseHookSettings(settings []string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, setting := range settings {
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("expected <hook>=<value>, got %q", setting)
+		}
+		parsed[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
+// ValidateHookSettings checks hook timeouts and failure policies can be parsed
+func ValidateHookSettings(timeouts, policies []string) error {
+	parsed, err := parseHookSettings(timeouts)
+	if err != nil {
+		return fmt.Errorf("Invalid hook timeout: %v", err)
+	}
+	for name, value := range parsed {
+		if _, err := parseHookTimeout(value); err != nil {
+			return fmt.Errorf("Invalid timeout for %s hook: %v", name, err)
+		}
+	}
+
+	parsed, err = parseHookSettings(policies)
+	if err != nil {
+		return fmt.Errorf("Invalid hook failure policy: %v", err)
+	}
+	for name, value := range parsed {
+		if _, err := parseHookFailurePolicy(value); err != nil {
+			return fmt.Errorf("Invalid failure policy for %s hook: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// hookSetting finds the most specific setting for a hook. Settings are for
+// hooks of a name, like pre-exit, which can be limited to a plugin by its
+// name, like docker-compose:pre-exit, or to a scope, like global:pre-exit.
+func hookSetting(settings map[string]string, hookCfg HookConfig) (string, bool) {
+	keys := []string{hookCfg.Scope + ":" + hookCfg.Name, hookCfg.Name}
+	if hookCfg.PluginName != "" {
+		keys = append([]string{hookCfg.PluginName + ":" + hookCfg.Name}, keys...)
+	}
+
+	for _, key := range keys {
+		if value, ok := settings[key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// hookTimeout returns how long a hook can run for, the shorter of the agent's
+// timeout and the hook's own, or 0 if there isn't one
+func (b *Bootstrap) hookTimeout(hookCfg HookConfig) (time.Duration, error) {
+	settings, err := parseHookSettings(b.HookTimeouts)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid hook timeout: %v", err)
+	}
+
+	timeout := hookCfg.Timeout
+	if value, ok := hookSetting(settings, hookCfg); ok {
+		agentTimeout, err := parseHookTimeout(value)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid timeout for %s hook: %v", hookCfg.Name, err)
+		}
+		if timeout == 0 || agentTimeout < timeout {
+			timeout = agentTimeout
+		}
+	}
+
+	return timeout, nil
+}
+
+// hookFailurePolicy returns what happens to the job when a hook fails
+func (b *Bootstrap) hookFailurePolicy(hookCfg HookConfig) (hookFailurePolicy, error) {
+	settings, err := parseHookSettings(b.HookFailurePolicies)
+	if err != nil {
+		return hookFailurePolicy{}, fmt.Errorf("Invalid hook failure policy: %v", err)
+	}
+
+	value, ok := hookSetting(settings, hookCfg)
+	if !ok {
+		return hookFailurePolicy{Action: hookFailurePolicyFail}, nil
+	}
+
+	policy, err := parseHookFailurePolicy(value)
+	if err != nil {
+		return hookFailurePolicy{}, fmt.Errorf("Invalid failure policy for %s hook: %v", hookCfg.Name, err)
+	}
+	return policy, nil
+}
+
+// hookTimeoutError is returned for hooks that were stopped for running for
+// longer than their timeout
+type hookTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *hookTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s: %v", e.timeout, e.err)
+}
+
+// Cause returns the error the hook exited with, for its exit status
+func (e *hookTimeoutError) Cause() error {
+	return e.err
+}
+
+// runHookScript runs a hook's script, stopping it if it runs for longer than
+// its timeout
+func (b *Bootstrap) runHookScript(ctx context.Context, hookCfg HookConfig, hookName, path string, environ env.Environment) error {
+	timeout, err := b.hookTimeout(hookCfg)
+	if err != nil {
+		return err
+	}
+
+	if timeout == 0 {
+		return b.shell.RunScript(ctx, path, environ)
+	}
+
+	stop := b.startHookTimeout(hookName, timeout)
+	err = b.shell.RunScript(ctx, path, environ)
+	if stop() {
+		return &hookTimeoutError{timeout: timeout, err: err}
+	}
+	return err
+}
+
+// startHookTimeout interrupts the running hook if it's still running after
+// the timeout, and terminates it if it's still running after the cancel grace
+// period, as when a job is cancelled. The returned function stops the timer,
+// returning whether the hook timed out.
+func (b *Bootstrap) startHookTimeout(hookName string, timeout time.Duration) func() bool {
+	done := make(chan struct{})
+	timedOut := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-done:
+			timedOut <- false
+			return
+		case <-time.After(timeout):
+		}
+
+		b.shell.Warningf("The %s hook has been running for longer than its timeout of %s, interrupting it", hookName, timeout)
+		b.shell.Interrupt()
+
+		select {
+		case <-done:
+		case <-time.After(b.CancelGracePeriod):
+			b.shell.Warningf("The %s hook hasn't stopped after %s, terminating it", hookName, b.CancelGracePeriod)
+			b.shell.Terminate()
+			<-done
+		}
+		timedOut <- true
+	}()
+
+	return func() bool {
+		close(done)
+		return <-timedOut
+	}
+}
+
+// applyHookFailurePolicy returns the error a failed hook fails the job with,
+// or nil if its policy is to carry on
+func (b *Bootstrap) applyHookFailurePolicy(hookCfg HookConfig, hookName string, err error) error {
+	policy, policyErr := b.hookFailurePolicy(hookCfg)
+	if policyErr != nil {
+		return policyErr
+	}
+
+	switch policy.Action {
+	case hookFailurePolicyWarn:
+		b.shell.Warningf("%v, continuing as the %s hook's failure policy is %s", err, hookName, policy.Action)
+		return nil
+
+	case hookFailurePolicySoftFail:
+		exitCode := policy.ExitCode
+		if exitCode == 0 {
+			exitCode = shell.GetExitCode(err)
+		}
+		if exitCode <= 0 {
+			exitCode = 1
+		}
+
+		b.shell.Warningf("%v, continuing as the %s hook's failure policy is %s, the job will exit with status %d",
+			err, hookName, policy.Action, exitCode)
+
+		if b.softFailExitCode == 0 {
+			b.softFailExitCode = exitCode
+		}
+		return nil
+	}
+
+	return err
+}
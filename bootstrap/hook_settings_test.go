@@ -0,0 +1,74 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHookFailurePolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		policy   string
+		expected hookFailurePolicy
+		err      string
+	}{
+		{"fail", hookFailurePolicy{Action: "fail"}, ""},
+		{"warn", hookFailurePolicy{Action: "warn"}, ""},
+		{"soft-fail", hookFailurePolicy{Action: "soft-fail"}, ""},
+		{"soft-fail:3", hookFailurePolicy{Action: "soft-fail", ExitCode: 3}, ""},
+		{"soft-fail:0", hookFailurePolicy{}, `expected an exit status from 1 to 255, got "0"`},
+		{"warn:3", hookFailurePolicy{}, `only soft-fail takes an exit status, got "warn:3"`},
+		{"ignore", hookFailurePolicy{}, `expected fail, warn or soft-fail[:<exit status>], got "ignore"`},
+	} {
+		policy, err := parseHookFailurePolicy(tc.policy)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.policy)
+			continue
+		}
+		assert.NoError(t, err, tc.policy)
+		assert.Equal(t, tc.expected, policy, tc.policy)
+	}
+}
+
+func TestValidateHookSettings(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, ValidateHookSettings(
+		[]string{"pre-command=10m", "global:pre-exit=30s"},
+		[]string{"post-command=warn", "docker-compose:pre-exit=soft-fail:2"},
+	))
+
+	assert.EqualError(t, ValidateHookSettings([]string{"pre-command"}, nil),
+		`Invalid hook timeout: expected <hook>=<value>, got "pre-command"`)
+	assert.EqualError(t, ValidateHookSettings([]string{"pre-command=-1s"}, nil),
+		`Invalid timeout for pre-command hook: timeout must be positive, got "-1s"`)
+	assert.EqualError(t, ValidateHookSettings(nil, []string{"post-command=retry"}),
+		`Invalid failure policy for post-command hook: expected fail, warn or soft-fail[:<exit status>], got "retry"`)
+}
+
+func TestHookTimeoutUsesMostSpecificSetting(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{
+		HookTimeouts: []string{"pre-exit=10m", "plugin:pre-exit=5m", "docker-compose:pre-exit=1m"},
+	}}
+
+	for _, tc := range []struct {
+		hookCfg  HookConfig
+		expected time.Duration
+	}{
+		{HookConfig{Name: "pre-exit", Scope: "global"}, 10 * time.Minute},
+		{HookConfig{Name: "pre-exit", Scope: "plugin", PluginName: "docker"}, 5 * time.Minute},
+		{HookConfig{Name: "pre-exit", Scope: "plugin", PluginName: "docker-compose"}, time.Minute},
+		{HookConfig{Name: "pre-exit", Scope: "plugin", PluginName: "docker", Timeout: 30 * time.Second}, 30 * time.Second},
+		{HookConfig{Name: "pre-exit", Scope: "plugin", PluginName: "docker", Timeout: time.Hour}, 5 * time.Minute},
+		{HookConfig{Name: "command", Scope: "global"}, 0},
+	} {
+		timeout, err := b.hookTimeout(tc.hookCfg)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, timeout, "%+v", tc.hookCfg)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -235,7 +237,10 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 			{"fetch", "-v", "--", "origin", "master"},
 			{"checkout", "-f", "FETCH_HEAD"},
 			{"submodule", "sync", "--recursive"},
-			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url"},
+			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
+			{"rev-parse", "HEAD:" + filepath.Base(submoduleRepo.Path)},
+			{"clone", "--mirror", "-v", "--", submoduleRepo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"submodule", "update", "--init", "--force", "--reference", matchSubDir(tester.GitMirrorsDir), "--", filepath.Base(submoduleRepo.Path)},
 			{"submodule", "update", "--init", "--recursive", "--force"},
 			{"submodule", "foreach", "--recursive", "git reset --hard"},
 			{"clean", "-fdq"},
@@ -250,7 +255,7 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 			{"fetch", "-v", "--", "origin", "master"},
 			{"checkout", "-f", "FETCH_HEAD"},
 			{"submodule", "sync", "--recursive"},
-			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url"},
+			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
 			{"submodule", "update", "--init", "--recursive", "--force"},
 			{"submodule", "foreach", "--recursive", "git reset --hard"},
 			{"clean", "-fdq"},
@@ -392,6 +397,294 @@ func TestCheckingOutShallowCloneOfLocalGitProject(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutSparseCheckoutOfLocalGitProject(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=app, lib/",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	if experiments.IsEnabled(`git-mirrors`) {
+		git.ExpectAll([][]interface{}{
+			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--no-checkout", "--", tester.Repo.Path, "."},
+			{"sparse-checkout", "init", "--cone"},
+			{"sparse-checkout", "set", "--", "app", "lib"},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	} else {
+		git.ExpectAll([][]interface{}{
+			{"clone", "-v", "--no-checkout", "--", tester.Repo.Path, "."},
+			{"sparse-checkout", "init", "--cone"},
+			{"sparse-checkout", "set", "--", "app", "lib"},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWithGitLFS(t *testing.T) {
+	t.Parallel()
+
+	if experiments.IsEnabled(`git-mirrors`) {
+		t.Skip("LFS storage defaults to within the git mirrors path")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	lfsStorage := t.TempDir()
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_LFS=true",
+		"BUILDKITE_GIT_LFS_INCLUDE=assets/",
+		"BUILDKITE_GIT_LFS_STORAGE_PATH=" + lfsStorage,
+	}
+
+	localGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Actually execute git commands, except for git-lfs which may not be installed
+	git := tester.MustMock(t, "git")
+
+	// The smudge filter mustn't fetch objects during the clone, outside of
+	// the shared LFS storage
+	git.Expect("clone", "-v", "--", tester.Repo.Path, ".").AndCallFunc(func(c *bintest.Call) {
+		if skipSmudge := c.GetEnv("GIT_LFS_SKIP_SMUDGE"); skipSmudge != "1" {
+			t.Errorf("Expected GIT_LFS_SKIP_SMUDGE=1 during clone, got %q", skipSmudge)
+		}
+		c.Passthrough(localGit)
+	})
+
+	for _, args := range [][]interface{}{
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"config", "--local", "lfs.storage", lfsStorage},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	} {
+		git.Expect(args...).AndPassthroughToLocalCommand(localGit)
+	}
+	git.Expect("lfs", "fetch", "--include=assets").AndExitWith(0)
+	git.Expect("lfs", "checkout").AndExitWith(0)
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWorktreeOfGitMirror(t *testing.T) {
+	// t.Parallel() cannot be used with experiments.Enable()
+	defer experimentWithUndo("git-mirrors")()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CHECKOUT_STRATEGY=worktree",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]interface{}{
+		{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "worktree", "prune"},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "worktree", "add", "--detach", "--no-checkout", tester.CheckoutDir()},
+		{"clean", "-fdq"},
+		{"checkout", "-f", "--detach", "refs/heads/master"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	// The checkout has no repository of its own
+	info, err := os.Stat(filepath.Join(tester.CheckoutDir(), ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("Expected .git in the checkout to be a file pointing to the mirror")
+	}
+}
+
+func TestCheckingOutWorktreeOfGitMirrorRestoresAFullCheckout(t *testing.T) {
+	// t.Parallel() cannot be used with experiments.Enable()
+	defer experimentWithUndo("git-mirrors")()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	for _, path := range []string{"app/app.txt", "lib/lib.txt"} {
+		if err := os.MkdirAll(filepath.Join(tester.Repo.Path, filepath.Dir(path)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tester.Repo.Path, path), []byte(path), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := tester.Repo.Add(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tester.Repo.Commit("Add app and lib"); err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CHECKOUT_STRATEGY=worktree",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+	}
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(0)
+
+	// The first job only checks out app
+	tester.RunAndCheck(t, append(env, "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=app")...)
+
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "lib", "lib.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expected lib to be left out of the sparse checkout, got %v", err)
+	}
+
+	// The next reuses the worktree, and checks out everything
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(0)
+	tester.RunAndCheck(t, env...)
+
+	if !strings.Contains(tester.Output, "Restoring full checkout") {
+		t.Fatalf("Expected the full checkout to be restored, got %s", tester.Output)
+	}
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "lib", "lib.txt")); err != nil {
+		t.Fatalf("Expected lib to be checked out: %v", err)
+	}
+}
+
+func TestCheckingOutNestedSubmodulesFromGitMirrors(t *testing.T) {
+	// t.Parallel() cannot be used with experiments.Enable()
+	defer experimentWithUndo("git-mirrors")()
+
+	// Git for windows seems to struggle with local submodules in the temp dir
+	if runtime.GOOS == `windows` {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Submodules are cloned from local paths, which git no longer allows by default
+	allowFile := []string{"-c", "protocol.file.allow=always"}
+
+	inner, err := createTestGitRespository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	outer, err := createTestGitRespository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.Close()
+
+	for _, step := range []struct {
+		repo *gitRepository
+		args []string
+	}{
+		{outer, append(allowFile, "submodule", "add", inner.Path, "inner")},
+		{outer, []string{"commit", "-am", "Add inner submodule"}},
+		{tester.Repo, append(allowFile, "submodule", "add", outer.Path, "outer")},
+		{tester.Repo, []string{"commit", "-am", "Add outer submodule"}},
+	} {
+		if out, err := step.repo.Execute(step.args...); err != nil {
+			t.Fatalf("git %v failed: %s", step.args, out)
+		}
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t,
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+	)
+
+	// Both submodules were checked out using mirrors of their own
+	for _, repo := range []*gitRepository{outer, inner} {
+		mirror := filepath.Join(tester.GitMirrorsDir, regexp.MustCompile("[[:^alnum:]]").ReplaceAllString(repo.Path, "-"))
+		if _, err := os.Stat(mirror); err != nil {
+			t.Errorf("Expected a mirror of %s: %v", repo.Path, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "outer", "inner", "test.txt")); err != nil {
+		t.Errorf("Expected the nested submodule to be checked out: %v", err)
+	}
+}
+
 func TestCheckingOutSetsCorrectGitMetadataAndSendsItToBuildkite(t *testing.T) {
 	t.Parallel()
 
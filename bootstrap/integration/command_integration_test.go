@@ -1,7 +1,11 @@
 package integration
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/bintest/v3"
@@ -72,3 +76,108 @@ func TestPreExitHooksRunsAfterCommandFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestCommandsAreCheckedAgainstTheAllowlist(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	for _, tc := range []struct {
+		name    string
+		command string
+		allowed bool
+	}{
+		{"allowed", "llamas --rock\nalpacas", true},
+		{"not allowed", "llamas --rock\nalpacas; rm -rf /", false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			allowlist := filepath.Join(tester.HooksDir, "allowlist")
+			if err := ioutil.WriteFile(allowlist, []byte("# Only llamas and alpacas\nllamas *\n/alpacas( --spit)?/\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			llamas := tester.MustMock(t, "llamas")
+			alpacas := tester.MustMock(t, "alpacas")
+
+			env := []string{
+				"BUILDKITE_COMMAND=" + tc.command,
+				"BUILDKITE_COMMAND_ALLOWLIST=" + allowlist,
+			}
+
+			if tc.allowed {
+				llamas.Expect("--rock").Once()
+				alpacas.Expect().Once()
+				tester.RunAndCheck(t, env...)
+				return
+			}
+
+			llamas.Expect().NotCalled()
+			alpacas.Expect().NotCalled()
+
+			if err := tester.Run(t, env...); err == nil {
+				t.Fatal("Expected the bootstrap to fail because the command isn't allowed")
+			}
+			if !strings.Contains(tester.Output, `"alpacas; rm -rf /" doesn't match any of them`) {
+				t.Fatalf("Expected the output to say which command isn't allowed, got %s", tester.Output)
+			}
+			tester.CheckMocks(t)
+		})
+	}
+}
+
+func TestJobsHaveTheirOwnTemporaryDirectory(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	root, err := ioutil.TempDir("", "job-tmpdir-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Leave a read-only directory behind, like Go's module cache, and fail in
+	// pre-exit, neither of which should stop it being removed
+	command := `echo "$TMPDIR $BUILDKITE_JOB_TMPDIR" > "` + filepath.Join(tester.HooksDir, "tmpdir") + `"` +
+		` && mkdir -p "$TMPDIR/mod/cache" && touch "$TMPDIR/mod/cache/file" && chmod -R a-w "$TMPDIR/mod"`
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "pre-exit"), []byte("#!/bin/bash\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tester.Run(t, "BUILDKITE_COMMAND="+command, "BUILDKITE_JOB_TMPDIR_ROOT="+root); err == nil {
+		t.Fatal("Expected the bootstrap to fail because of the pre-exit hook")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tester.HooksDir, "tmpdir"))
+	if err != nil {
+		t.Fatalf("Expected the command to record its temporary directory: %v\n%s", err, tester.Output)
+	}
+
+	dirs := strings.Fields(string(data))
+	if len(dirs) != 2 || dirs[0] != dirs[1] || filepath.Dir(dirs[0]) != root {
+		t.Fatalf("Expected TMPDIR and BUILDKITE_JOB_TMPDIR to be the same directory in %s, got %q", root, data)
+	}
+
+	if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+		t.Fatalf("Expected the job's temporary directory to be removed, got %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package integration
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -170,6 +173,51 @@ func TestDirectoryPassesBetweenHooks(t *testing.T) {
 	tester.RunAndCheck(t, "MY_CUSTOM_ENV=1")
 }
 
+func TestExecutableHooksChangeEnvironmentWithJSON(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Not implemented for windows yet")
+	}
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 isn't available")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	var script = []string{
+		"#!/usr/bin/env python3",
+		"import json, os",
+		`os.makedirs("mysubdir", exist_ok=True)`,
+		`with open(os.environ["BUILDKITE_HOOK_ENV_FILE"], "w") as f:`,
+		`    json.dump({"LLAMAS": "rock", "MY_CUSTOM_SUBDIR": os.path.abspath("mysubdir")}, f)`,
+		`with open(os.environ["BUILDKITE_HOOK_WORKING_DIR_FILE"], "w") as f:`,
+		`    json.dump(os.path.abspath("mysubdir"), f)`,
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "pre-command"), []byte(strings.Join(script, "\n")), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `LLAMAS=rock`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else if c.GetEnv("MY_CUSTOM_SUBDIR") != c.Dir {
+			fmt.Fprintf(c.Stderr, "Expected current dir to be %q, got %q\n", c.GetEnv("MY_CUSTOM_SUBDIR"), c.Dir)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	tester.RunAndCheck(t, "MY_CUSTOM_ENV=1")
+}
+
 func TestDirectoryPassesBetweenHooksIgnoredUnderExit(t *testing.T) {
 	t.Parallel()
 
@@ -504,3 +552,267 @@ func TestPreExitHooksFireAfterCancel(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestHooksAreInterruptedAfterTheirTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "pre-command"),
+		[]byte("#!/bin/bash\nsleep 30\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").NotCalled()
+	tester.ExpectGlobalHook("pre-exit").Once()
+
+	start := time.Now()
+	if err = tester.Run(t, "BUILDKITE_HOOK_TIMEOUTS=pre-command=1s", "BUILDKITE_CANCEL_GRACE_PERIOD=1"); err == nil {
+		t.Fatal("Expected the bootstrap to fail because the pre-command hook timed out")
+	}
+
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("Expected the pre-command hook to be stopped after its timeout, took %s", elapsed)
+	}
+
+	if !strings.Contains(tester.Output, "The global pre-command hook timed out after 1s") {
+		t.Fatalf("Expected the output to say the hook timed out, got %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestHookFailurePolicies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		policy       string
+		expectedCode int
+	}{
+		{"warn", "pre-command=warn", 0},
+		{"scoped warn", "global:pre-command=warn", 0},
+		{"soft-fail", "pre-command=soft-fail", 5},
+		{"soft-fail with exit status", "pre-command=soft-fail:3", 3},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			tester.ExpectGlobalHook("pre-command").Once().AndExitWith(5)
+			tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+			tester.ExpectGlobalHook("pre-exit").Once()
+
+			err = tester.Run(t, "BUILDKITE_HOOK_FAILURE_POLICIES="+tc.policy)
+			if exitCode := shell.GetExitCode(err); exitCode != tc.expectedCode {
+				t.Fatalf("Expected an exit code of %d, got %d", tc.expectedCode, exitCode)
+			}
+
+			tester.CheckMocks(t)
+		})
+	}
+}
+
+func TestHookFailurePoliciesOnlyApplyToTheirHooks(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("pre-command").Once().AndExitWith(5)
+	tester.ExpectGlobalHook("command").NotCalled()
+
+	err = tester.Run(t, "BUILDKITE_HOOK_FAILURE_POLICIES=local:pre-command=warn,post-command=warn")
+	if exitCode := shell.GetExitCode(err); exitCode != 5 {
+		t.Fatalf("Expected an exit code of %d, got %d", 5, exitCode)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestGlobalHookDirectoriesRunInOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	hooks := map[string]string{
+		"environment":                "#!/bin/bash\nexport LLAMAS=platform\n",
+		"environment.d/20-team":      "#!/bin/bash\nexport LLAMAS=\"$LLAMAS,team\"\n",
+		"environment.d/10-security":  "#!/bin/bash\nexport LLAMAS=\"$LLAMAS,security\"\n",
+		"environment.d/.10-security": "#!/bin/bash\nexit 1\n",
+	}
+	for name, script := range hooks {
+		path := filepath.Join(tester.HooksDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `LLAMAS=platform,security,team`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	tester.RunAndCheck(t)
+
+	for _, header := range []string{
+		"Running global environment hook",
+		"Running global environment (10-security) hook",
+		"Running global environment (20-team) hook",
+	} {
+		if !strings.Contains(tester.Output, header) {
+			t.Fatalf("Expected the output to contain %q, got %s", header, tester.Output)
+		}
+	}
+}
+
+func TestGlobalHookDirectoriesReplaceCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	dir := filepath.Join(tester.HooksDir, "command.d")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "10-exit"), []byte("#!/bin/bash\nexit 7\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	err = tester.Run(t, "BUILDKITE_COMMAND=true")
+	if exitCode := shell.GetExitCode(err); exitCode != 7 {
+		t.Fatalf("Expected an exit code of %d, got %d", 7, exitCode)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestEnvironmentChangesAreTracedToTheirHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	hooks := map[string]string{
+		"environment": "#!/bin/bash\nexport LLAMAS=rock\nexport ALPACAS=meh\n",
+		"pre-command": "#!/bin/bash\nexport ALPACAS=ok\nexport SECRET_TOKEN=hunter2hunter2\n",
+	}
+	for name, script := range hooks {
+		if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, name), []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	provenanceFile := filepath.Join(tester.HooksDir, "env-provenance.json")
+
+	tester.RunAndCheck(t, "BUILDKITE_DEBUG_ENV=true", "BUILDKITE_ENV_PROVENANCE_FILE="+provenanceFile)
+
+	for _, line := range []string{
+		"Environment variables changed by hooks",
+		"ALPACAS changed by the global pre-command hook",
+		"LLAMAS added by the global environment hook",
+	} {
+		if !strings.Contains(tester.Output, line) {
+			t.Fatalf("Expected the output to contain %q, got %s", line, tester.Output)
+		}
+	}
+
+	data, err := ioutil.ReadFile(provenanceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var provenance map[string]struct{ Hook, Change string }
+	if err := json.Unmarshal(data, &provenance); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := provenance["SECRET_TOKEN"]; got.Hook != "global pre-command" || got.Change != "added" {
+		t.Fatalf("Expected SECRET_TOKEN to be added by the global pre-command hook, got %+v", got)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Fatalf("Expected the provenance file not to contain values, got %s", data)
+	}
+}
+
+func TestEnvironmentChangesAreWrittenToTheBuildPathByDefault(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	hook := "#!/bin/bash\nexport LLAMAS=rock\n"
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "environment"), []byte(hook), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.RunAndCheck(t)
+
+	data, err := ioutil.ReadFile(filepath.Join(tester.BuildDir, "test-agent", "env-provenance.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var provenance map[string]struct{ Hook, Change string }
+	if err := json.Unmarshal(data, &provenance); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := provenance["LLAMAS"]; got.Hook != "global environment" || got.Change != "added" {
+		t.Fatalf("Expected LLAMAS to be added by the global environment hook, got %+v", got)
+	}
+}
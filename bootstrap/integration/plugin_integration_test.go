@@ -1,9 +1,12 @@
 package integration
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,6 +14,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/bintest/v3"
 )
@@ -77,6 +81,62 @@ func TestRunningPlugins(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestRunningExecutablePluginHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin hooks in this test are bash scripts")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// As it's run rather than sourced, the export doesn't reach later hooks
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export LEAKED=yes",
+			`echo '{"OSTRICH_EGGS":"quite_large"}' > "$BUILDKITE_HOOK_ENV_FILE"`,
+		},
+	})
+	if err := os.Chmod(filepath.Join(p.Path, "hooks", "environment"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p.Path, "plugin.yml"), []byte("name: ostrich\nexecutable_hooks:\n  - environment\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit("Run the environment hook directly"); err != nil {
+		t.Fatal(err)
+	}
+	if p.versionTag, err = p.RevParse("HEAD"); err != nil {
+		t.Fatal(err)
+	}
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `OSTRICH_EGGS=quite_large`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else if c.GetEnv("LEAKED") != "" {
+			fmt.Fprintf(c.Stderr, "Expected LEAKED to be unset, got %q\n", c.GetEnv("LEAKED"))
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+json)
+}
+
 func TestExitCodesPropagateOutFromPlugins(t *testing.T) {
 	t.Parallel()
 
@@ -211,6 +271,75 @@ func TestOverlappingPluginHooks(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestPluginsCheckedOutConcurrentlyKeepTheirOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin hooks in this test are bash scripts")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Each plugin appends to the same variable, so the result shows the
+	// order their environment hooks ran in
+	var testPlugins []*testPlugin
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		testPlugins = append(testPlugins, createTestPlugin(t, map[string][]string{
+			"environment": {
+				"#!/bin/bash",
+				`export PLUGIN_ORDER="${PLUGIN_ORDER}` + name + `"`,
+			},
+		}))
+	}
+
+	// The same plugin twice is only checked out once at a time
+	testPlugins = append(testPlugins, testPlugins[0])
+
+	pluginsJSON, err := json.Marshal(testPlugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `PLUGIN_ORDER=abcdefa`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+string(pluginsJSON))
+
+	// Each plugin's output is shown together, under its own header
+	for _, p := range testPlugins[:6] {
+		header := fmt.Sprintf("~~~ Checking out plugin %s", pluginLabel(t, mustPluginJSON(t, p)))
+		i := strings.Index(tester.Output, header)
+		if i < 0 {
+			t.Fatalf("Expected %q in output:\n%s", header, tester.Output)
+		}
+
+		section := tester.Output[i+len(header):]
+		if next := strings.Index(section, "~~~ "); next >= 0 {
+			section = section[:next]
+		}
+		if !strings.Contains(section, p.Path) {
+			t.Errorf("Expected the output under %q to be about %s:\n%s", header, p.Path, section)
+		}
+	}
+}
+
+func mustPluginJSON(t *testing.T, p *testPlugin) string {
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return json
+}
+
 func TestPluginCloneRetried(t *testing.T) {
 	if runtime.GOOS == `windows` {
 		t.Skip("Not passing on windows, needs investigation")
@@ -491,6 +620,364 @@ func TestModifiedPluginWithForcePull(t *testing.T) {
 	tester2.RunAndCheck(t, env...)
 }
 
+func TestPluginsLockedInBuildMetaData(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=quite_large",
+		},
+	})
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "buildkite:plugin-lock:" + pluginIdentifier(t, json)
+	commit := strings.TrimSpace(p.versionTag)
+	tree, err := p.RevParse("HEAD^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first job to use the plugin records what it resolved to, and reads
+	// it back in case another job recorded something else at the same time
+	lock := fmt.Sprintf(`{"commit":%q,"tree":%q}`, commit, strings.TrimSpace(tree))
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", key).AndExitWith(1)
+	agent.Expect("meta-data", "set", key, lock).AndExitWith(0)
+	agent.Expect("meta-data", "exists", key).AndExitWith(0)
+	agent.Expect("meta-data", "get", key).AndWriteToStdout(lock).AndExitWith(0)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(0)
+
+	env := []string{
+		`BUILDKITE_PLUGINS=` + json,
+		`BUILDKITE_PLUGINS_LOCK=true`,
+	}
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestPluginsLockedByAnotherJobAtTheSameTime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin hooks in this test are bash scripts")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=quite_large",
+		},
+	})
+	p.gitRepository.CreateBranch("something-moving")
+	p.versionTag = "something-moving"
+
+	// Another job locks the plugin to this commit...
+	commit, err := p.RevParse("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := p.RevParse("HEAD^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherLock := fmt.Sprintf(`{"commit":%q,"tree":%q}`, strings.TrimSpace(commit), strings.TrimSpace(tree))
+
+	// ...just as the branch moves on, so this job resolves it to another one
+	modifyTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=huge_actually",
+		},
+	}, p)
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "buildkite:plugin-lock:" + pluginIdentifier(t, json)
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.Expect("meta-data", "exists", key).AndExitWith(1)
+	agent.Expect("meta-data", "set", key, bintest.MatchAny()).AndExitWith(0)
+	agent.Expect("meta-data", "exists", key).AndExitWith(0)
+	agent.Expect("meta-data", "get", key).AndWriteToStdout(otherLock).AndExitWith(0)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(0)
+
+	// The other job's lock wins
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `OSTRICH_EGGS=quite_large`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+json, `BUILDKITE_PLUGINS_LOCK=true`)
+}
+
+func TestPluginsLockfileRefusesMovedVersions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin hooks in this test are bash scripts")
+	}
+	t.Parallel()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=quite_large",
+		},
+	})
+	p.gitRepository.CreateBranch("something-fixed")
+	p.versionTag = "something-fixed"
+
+	commit, err := p.RevParse("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := p.RevParse("HEAD^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the branch on after it was locked
+	modifyTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=huge_actually",
+		},
+	}, p)
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeLockfile := func(t *testing.T, commit, tree string) string {
+		lockfile := filepath.Join(t.TempDir(), "plugins.lock")
+		data := fmt.Sprintf(`{"plugins":{%q:{"commit":%q,"tree":%q}}}`,
+			pluginLabel(t, json), strings.TrimSpace(commit), strings.TrimSpace(tree))
+		if err := ioutil.WriteFile(lockfile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return lockfile
+	}
+
+	t.Run("locked commit is used", func(t *testing.T) {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tester.Close()
+
+		tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+			if err := bintest.ExpectEnv(t, c.Env, `OSTRICH_EGGS=quite_large`); err != nil {
+				fmt.Fprintf(c.Stderr, "%v\n", err)
+				c.Exit(1)
+			} else {
+				c.Exit(0)
+			}
+		})
+
+		tester.RunAndCheck(t,
+			`BUILDKITE_PLUGINS=`+json,
+			`BUILDKITE_PLUGINS_LOCKFILE=`+writeLockfile(t, commit, tree),
+		)
+	})
+
+	t.Run("mismatched tree is refused", func(t *testing.T) {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tester.Close()
+
+		err = tester.Run(t,
+			`BUILDKITE_PLUGINS=`+json,
+			`BUILDKITE_PLUGINS_LOCKFILE=`+writeLockfile(t, commit, strings.Repeat("0", 40)),
+		)
+		if err == nil {
+			t.Fatal("Expected the bootstrap to fail")
+		}
+		if !strings.Contains(tester.Output, "but is locked to commit") {
+			t.Fatalf("Expected the output to explain the lock mismatch:\n%s", tester.Output)
+		}
+	})
+}
+
+func TestRunningPluginsFromArchives(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin hooks in this test are bash scripts")
+	}
+	t.Parallel()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=quite_large",
+		},
+	})
+	archive, sum := archiveTestPlugin(t, p)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/plugins/ostrich.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, archive)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name     string
+		location string
+	}{
+		{"url", server.URL + "/plugins/ostrich.tar.gz#sha256=" + sum},
+		{"file", "file://" + filepath.ToSlash(archive) + "#sha256=" + sum},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+				if err := bintest.ExpectEnv(t, c.Env, `OSTRICH_EGGS=quite_large`); err != nil {
+					fmt.Fprintf(c.Stderr, "%v\n", err)
+					c.Exit(1)
+				} else {
+					c.Exit(0)
+				}
+			})
+
+			tester.RunAndCheck(t, fmt.Sprintf(`BUILDKITE_PLUGINS=[{%q:{}}]`, tc.location))
+		})
+	}
+}
+
+func TestPluginArchivesAreCheckedAgainstTheirChecksum(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=quite_large",
+		},
+	})
+	archive, _ := archiveTestPlugin(t, p)
+
+	location := "file://" + filepath.ToSlash(archive) + "#sha256=" + strings.Repeat("0", 64)
+	err = tester.Run(t, fmt.Sprintf(`BUILDKITE_PLUGINS=[{%q:{}}]`, location))
+	if err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+	if !strings.Contains(tester.Output, "expected "+strings.Repeat("0", 64)) {
+		t.Fatalf("Expected the output to explain the checksum mismatch:\n%s", tester.Output)
+	}
+}
+
+func TestRunningPluginsFromPluginStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin hooks in this test are bash scripts")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export OSTRICH_EGGS=quite_large",
+		},
+	})
+	archive, _ := archiveTestPlugin(t, p)
+
+	store := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(store, "ostrich"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(archive, filepath.Join(store, "ostrich", "v1.0.0.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `OSTRICH_EGGS=quite_large`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	// There's no such repository, so this only works without a clone
+	tester.RunAndCheck(t,
+		`BUILDKITE_PLUGINS=[{"github.com/buildkite-plugins/ostrich-buildkite-plugin#v1.0.0":{}}]`,
+		`BUILDKITE_PLUGINS_STORE_PATH=`+store,
+	)
+}
+
+// archiveTestPlugin makes a tarball of a test plugin, returning its path and
+// sha256
+func archiveTestPlugin(t *testing.T, p *testPlugin) (string, string) {
+	archive := filepath.Join(t.TempDir(), "plugin.tar.gz")
+	if _, err := p.Execute("archive", "--format=tar.gz", "--prefix=plugin-1.0.0/", "-o", archive, "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive, fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func pluginIdentifier(t *testing.T, json string) string {
+	plugins, err := plugin.CreateFromJSON(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := plugins[0].Identifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func pluginLabel(t *testing.T, json string) string {
+	plugins, err := plugin.CreateFromJSON(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugins[0].Label()
+}
+
 type testPlugin struct {
 	*gitRepository
 
@@ -0,0 +1,55 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// createJobTmpdir creates a directory for the job's temporary files that only
+// the agent's user can access, and points TMPDIR at it so that jobs don't
+// leave files, or credentials, in a temporary directory shared with others
+func (b *Bootstrap) createJobTmpdir() error {
+	root := b.JobTmpdirRoot
+	if root == "" {
+		root = os.TempDir()
+	}
+
+	dir, err := ioutil.TempDir(root, "buildkite-job-tmp-"+b.JobID+"-")
+	if err != nil {
+		return err
+	}
+	b.jobTmpdir = dir // TempDir creates it 0700, whatever the umask
+
+	b.shell.Env.Set("TMPDIR", dir)
+	b.shell.Env.Set("BUILDKITE_JOB_TMPDIR", dir)
+	return nil
+}
+
+// removeJobTmpdir removes the job's temporary directory and everything in it
+func (b *Bootstrap) removeJobTmpdir() {
+	if b.jobTmpdir == "" {
+		return
+	}
+
+	if err := removeAllWritable(b.jobTmpdir); err != nil {
+		b.shell.Warningf("Failed to remove the job's temporary directory %s: %v", b.jobTmpdir, err)
+	}
+}
+
+// removeAllWritable removes a directory like os.RemoveAll, but also removes
+// directories that have been made read-only, like Go's module cache
+func removeAllWritable(dir string) error {
+	if err := os.RemoveAll(dir); err == nil {
+		return nil
+	}
+
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			_ = os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(dir)
+}
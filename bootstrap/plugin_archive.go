@@ -0,0 +1,281 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/roko"
+)
+
+// Versions are used as file names in the plugin store, so they can't be paths
+var pluginStoreVersionRegex = regexp.MustCompile(`\A[A-Za-z0-9_.+-]+\z`)
+
+// pluginStoreArchive returns the path to a plugin's archive in the plugin
+// store, like docker-compose/v4.0.0.tar.gz, if there is one
+func (b *Bootstrap) pluginStoreArchive(p *plugin.Plugin) (string, bool) {
+	if b.PluginsStorePath == "" || p.IsArchive() || p.Name() == "" {
+		return "", false
+	}
+	if !pluginStoreVersionRegex.MatchString(p.Version) || strings.Contains(p.Version, "..") {
+		return "", false
+	}
+
+	for _, ext := range []string{".tar.gz", ".tgz"} {
+		path := filepath.Join(b.PluginsStorePath, p.Name(), p.Version+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// extractPluginArchive extracts a plugin from an archive to its directory. The
+// archive is either a file from the plugin store, or if that's empty, the
+// plugin's own location, which is downloaded if need be and checked against
+// the plugin's checksum.
+func (b *Bootstrap) extractPluginArchive(sh *shell.Shell, p *plugin.Plugin, archive, id, pluginDirectory string) error {
+	if archive == "" {
+		location, err := p.Repository()
+		if err != nil {
+			return err
+		}
+
+		if p.Scheme == "file" {
+			archive = location
+		} else {
+			f, err := ioutil.TempFile(b.PluginsPath, id+"-*.tar.gz")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+
+			sh.Commentf("Downloading plugin %q", p.Label())
+			err = roko.NewRetrier(
+				roko.WithMaxAttempts(3),
+				roko.WithStrategy(roko.Constant(2*time.Second)),
+			).Do(func(r *roko.Retrier) error {
+				return downloadFile(location, f.Name())
+			})
+			if err != nil {
+				return fmt.Errorf("Failed to download plugin %q: %v", p.Label(), err)
+			}
+			archive = f.Name()
+		}
+
+		sum, err := sha256File(archive)
+		if err != nil {
+			return err
+		}
+		if sum != p.SHA256 {
+			return fmt.Errorf("Plugin %q has a sha256 of %s, expected %s", p.Label(), sum, p.SHA256)
+		}
+	}
+
+	sh.Commentf("Extracting plugin %q from %s to %q", p.Label(), filepath.Base(archive), pluginDirectory)
+
+	tempDir, err := ioutil.TempDir(b.PluginsPath, id)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := extractTarGz(f, tempDir); err != nil {
+		return fmt.Errorf("Failed to extract plugin %q: %v", p.Label(), err)
+	}
+
+	root, err := archiveRoot(tempDir)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(root, pluginDirectory)
+}
+
+// pluginDownloadClient is used to download plugin archives. The timeout is
+// for the whole download, so that a stalled server can't hang the job, but
+// it's generous as plugins are fetched before the job's own timeout applies.
+var pluginDownloadClient = &http.Client{Timeout: 5 * time.Minute}
+
+// downloadFile writes the body of a successful GET of a URL to a file
+func downloadFile(url, filename string) error {
+	resp, err := pluginDownloadClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// archiveRoot returns the directory a plugin was extracted to. Archives of a
+// repository usually have everything in a single top-level directory, like
+// docker-compose-buildkite-plugin-4.0.0/, which is where the plugin is.
+func archiveRoot(dir string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// extractTarGz extracts a gzipped tarball into a directory, refusing any
+// files or links that would end up outside of it. Links can only point within
+// the directory, and nothing is ever written through a link that's already
+// been extracted, as a chain of links that each look fine on their own, like
+// a -> . and a/x -> .., can still lead outside of it.
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok := withinDir(hdr.Name)
+		if !ok {
+			return fmt.Errorf("%q is outside of the archive", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		if err := refuseSymlinks(dir, name); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			// Keep the mode so that hooks stay executable
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("%q links outside of the archive", hdr.Name)
+			}
+			if _, ok := withinDir(filepath.Join(filepath.Dir(name), hdr.Linkname)); !ok {
+				return fmt.Errorf("%q links outside of the archive", hdr.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeXGlobalHeader:
+			// Written by git archive, with the commit it was made from
+
+		default:
+			return fmt.Errorf("%q is an unsupported type of file", hdr.Name)
+		}
+	}
+}
+
+// withinDir cleans a relative path, returning false if it's absolute or goes
+// above the directory it's relative to
+func withinDir(name string) (string, bool) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return name, true
+}
+
+// refuseSymlinks returns an error if the path, or any directory it's in, is a
+// symlink that's already in the directory, so that extracting to it would
+// write through the link rather than to the path
+func refuseSymlinks(dir, name string) error {
+	path := dir
+	for _, component := range strings.Split(name, string(filepath.Separator)) {
+		path = filepath.Join(path, component)
+
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%q would be extracted through the symlink %q", name, path[len(dir)+1:])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTarGz(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, hdr := range headers {
+		body := []byte(hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(body))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(body)
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return &buf
+}
+
+func TestExtractTarGz(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	archive := makeTarGz(t,
+		&tar.Header{Name: "plugin-1.0.0/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "plugin-1.0.0/hooks/environment", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "plugin-1.0.0/lib/shared.bash", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "plugin-1.0.0/hooks/command", Typeflag: tar.TypeSymlink, Linkname: "environment"},
+	)
+	require.NoError(t, extractTarGz(archive, dir))
+
+	root, err := archiveRoot(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "plugin-1.0.0"), root)
+
+	info, err := os.Stat(filepath.Join(root, "hooks", "environment"))
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&0100, "hooks should stay executable")
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "hooks", "command"))
+	require.NoError(t, err)
+	assert.Equal(t, "plugin-1.0.0/hooks/environment", string(data))
+}
+
+func TestExtractTarGzRefusesPathsOutsideTheArchive(t *testing.T) {
+	t.Parallel()
+
+	for name, hdr := range map[string]*tar.Header{
+		"parent":           {Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644},
+		"nested parent":    {Name: "hooks/../../evil", Typeflag: tar.TypeReg, Mode: 0644},
+		"absolute":         {Name: "/tmp/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		"absolute link":    {Name: "hooks/command", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		"parent link":      {Name: "hooks/command", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"},
+		"unsupported type": {Name: "hooks/command", Typeflag: tar.TypeLink, Linkname: "hooks/environment"},
+	} {
+		hdr := hdr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "plugin")
+			require.NoError(t, os.Mkdir(dir, 0700))
+
+			assert.Error(t, extractTarGz(makeTarGz(t, hdr), dir))
+
+			_, err := os.Stat(filepath.Join(parent, "evil"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestExtractTarGzRefusesToWriteThroughSymlinks(t *testing.T) {
+	t.Parallel()
+
+	for name, headers := range map[string][]*tar.Header{
+		"chained links": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "a/x", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/x/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"file over a link": {
+			{Name: "hooks", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "hooks/command", Typeflag: tar.TypeSymlink, Linkname: "environment"},
+			{Name: "hooks/command", Typeflag: tar.TypeReg, Mode: 0755},
+		},
+		"directory through a link": {
+			{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "lib/nested/", Typeflag: tar.TypeDir, Mode: 0755},
+		},
+	} {
+		headers := headers
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "plugin")
+			require.NoError(t, os.Mkdir(dir, 0700))
+
+			assert.Error(t, extractTarGz(makeTarGz(t, headers...), dir))
+
+			_, err := os.Stat(filepath.Join(parent, "evil"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+)
+
+// pluginLock is the commit a plugin's version resolved to, and the tree of
+// that commit
+type pluginLock struct {
+	Commit string `json:"commit"`
+	Tree   string `json:"tree"`
+}
+
+// pluginLockfile is the format of a plugins lockfile, with the locks keyed by
+// the plugin's location and version, as in a pipeline's plugins
+type pluginLockfile struct {
+	Plugins map[string]pluginLock `json:"plugins"`
+}
+
+var fullCommitRegex = regexp.MustCompile(`\A[0-9a-f]{40}([0-9a-f]{24})?\z`)
+
+func (b *Bootstrap) pluginLockingEnabled() bool {
+	return b.PluginsLock || b.PluginsLockfile != ""
+}
+
+// pluginLockMetaDataKey returns the build meta-data key a plugin's lock is
+// recorded under
+func pluginLockMetaDataKey(p *plugin.Plugin) (string, error) {
+	id, err := p.Identifier()
+	if err != nil {
+		return "", err
+	}
+	return "buildkite:plugin-lock:" + id, nil
+}
+
+// lockedPlugin returns the lock for a plugin, or nil if the plugin hasn't been
+// locked in this build yet. Plugins missing from a lockfile are an error, as
+// the lockfile is the complete list of plugins that can be used.
+func (b *Bootstrap) lockedPlugin(sh *shell.Shell, p *plugin.Plugin) (*pluginLock, error) {
+	if b.PluginsLockfile != "" {
+		data, err := ioutil.ReadFile(b.PluginsLockfile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read plugins lockfile: %v", err)
+		}
+
+		var lockfile pluginLockfile
+		if err := json.Unmarshal(data, &lockfile); err != nil {
+			return nil, fmt.Errorf("Failed to parse plugins lockfile %q: %v", b.PluginsLockfile, err)
+		}
+
+		lock, ok := lockfile.Plugins[p.Label()]
+		if !ok {
+			return nil, fmt.Errorf("Plugin %q isn't in the plugins lockfile %q", p.Label(), b.PluginsLockfile)
+		}
+		return &lock, nil
+	}
+
+	key, err := pluginLockMetaDataKey(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sh.Run("buildkite-agent", "meta-data", "exists", key); err != nil {
+		return nil, nil
+	}
+
+	out, err := sh.RunAndCapture("buildkite-agent", "meta-data", "get", key)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock pluginLock
+	if err := json.Unmarshal([]byte(out), &lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse lock for plugin %q: %v", p.Label(), err)
+	}
+	return &lock, nil
+}
+
+// recordPluginLock records a plugin's lock in the build's meta-data for later
+// jobs to check against, and returns the lock that was recorded. Setting
+// meta-data isn't conditional, so jobs that lock a plugin at the same time can
+// each record a different commit if the version moved in between. Reading the
+// lock back afterwards catches a job that recorded its lock just before this
+// one, but not one that records its lock just after this one reads it back, so
+// jobs that start at the same time can still run different commits. Jobs that
+// start later use whichever lock was recorded last.
+func (b *Bootstrap) recordPluginLock(sh *shell.Shell, p *plugin.Plugin, lock pluginLock) (*pluginLock, error) {
+	key, err := pluginLockMetaDataKey(p)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+
+	sh.Commentf("Locking plugin %q to %s", p.Label(), lock.Commit)
+	if err := sh.Run("buildkite-agent", "meta-data", "set", key, string(data)); err != nil {
+		return nil, err
+	}
+
+	recorded, err := b.lockedPlugin(sh, p)
+	if err != nil {
+		return nil, err
+	}
+	if recorded == nil {
+		return nil, fmt.Errorf("Lock for plugin %q is missing after recording it", p.Label())
+	}
+	return recorded, nil
+}
+
+// pluginCheckoutLock returns the commit and tree of a plugin checkout
+func pluginCheckoutLock(sh *shell.Shell, dir string) (pluginLock, error) {
+	out, err := gitRevParseInWorkingDirectory(sh, dir, "HEAD", "HEAD^{tree}")
+	if err != nil {
+		return pluginLock{}, err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return pluginLock{}, fmt.Errorf("Unexpected output from git rev-parse: %q", out)
+	}
+	return pluginLock{Commit: fields[0], Tree: fields[1]}, nil
+}
+
+// resolvePluginVersion returns the commit a plugin's version points to in its
+// repository, or an empty string if it can't be resolved without a clone,
+// such as an abbreviated commit
+func (b *Bootstrap) resolvePluginVersion(sh *shell.Shell, repo, version string) string {
+	if fullCommitRegex.MatchString(version) {
+		return version
+	}
+	if version == "" {
+		version = "HEAD"
+	}
+
+	// Annotated tags are only peeled to their commit if asked for
+	out, err := sh.RunAndCapture("git", "ls-remote", "--", repo, version, version+"^{}")
+	if err != nil {
+		sh.Warningf("Failed to resolve %q in %s: %v", version, repo, err)
+		return ""
+	}
+
+	return resolveLsRemoteRef(out, version)
+}
+
+// resolveLsRemoteRef finds the commit a ref resolves to in the output of "git
+// ls-remote", preferring tags to branches as "git checkout" would for a commit.
+// Annotated tags resolve to the commit they point to.
+func resolveLsRemoteRef(output, ref string) string {
+	refs := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	for _, candidate := range []string{
+		"refs/tags/" + ref + "^{}",
+		"refs/tags/" + ref,
+		"refs/heads/" + ref,
+		ref,
+	} {
+		if commit, ok := refs[candidate]; ok {
+			return commit
+		}
+	}
+
+	return ""
+}
+
+// checkPluginLock compares a plugin checkout in a directory with its lock,
+// recording the lock if there isn't one yet. If another job recorded a
+// different lock before this one read it back, the checkout is moved to that
+// one. See recordPluginLock for the race that's left.
+func (b *Bootstrap) checkPluginLock(sh *shell.Shell, p *plugin.Plugin, dir string, locked *pluginLock) error {
+	current, err := pluginCheckoutLock(sh, dir)
+	if err != nil {
+		return err
+	}
+
+	if locked == nil {
+		if locked, err = b.recordPluginLock(sh, p, current); err != nil {
+			return err
+		}
+		if *locked == current {
+			return nil
+		}
+
+		sh.Commentf("Plugin %q was locked to %s by another job, checking that out instead", p.Label(), locked.Commit)
+		if err := sh.Run("git", "--git-dir", filepath.Join(dir, ".git"), "--work-tree", dir, "checkout", "-f", locked.Commit); err != nil {
+			return err
+		}
+		if current, err = pluginCheckoutLock(sh, dir); err != nil {
+			return err
+		}
+	}
+
+	if current != *locked {
+		return fmt.Errorf("Plugin %q is at commit %s with tree %s, but is locked to commit %s with tree %s",
+			p.Label(), current.Commit, current.Tree, locked.Commit, locked.Tree)
+	}
+
+	sh.Commentf("Plugin %q matches its lock (%s)", p.Label(), current.Commit)
+	return nil
+}
@@ -0,0 +1,30 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveLsRemoteRef(t *testing.T) {
+	t.Parallel()
+
+	output := "1111111111111111111111111111111111111111\tHEAD\n" +
+		"2222222222222222222222222222222222222222\trefs/heads/v1.0.0\n" +
+		"3333333333333333333333333333333333333333\trefs/tags/v1.0.0\n" +
+		"4444444444444444444444444444444444444444\trefs/tags/v1.0.0^{}\n" +
+		"5555555555555555555555555555555555555555\trefs/heads/main\n" +
+		"6666666666666666666666666666666666666666\trefs/heads/feature/main\n"
+
+	for ref, expected := range map[string]string{
+		"v1.0.0":  "4444444444444444444444444444444444444444",
+		"main":    "5555555555555555555555555555555555555555",
+		"HEAD":    "1111111111111111111111111111111111111111",
+		"missing": "",
+	} {
+		assert.Equal(t, expected, resolveLsRemoteRef(output, ref), ref)
+	}
+
+	assert.Equal(t, "3333333333333333333333333333333333333333",
+		resolveLsRemoteRef("3333333333333333333333333333333333333333\trefs/tags/lightweight\n", "lightweight"))
+}
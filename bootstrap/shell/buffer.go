@@ -0,0 +1,115 @@
+package shell
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Buffered returns a copy of the Shell that holds on to what it logs, and the
+// output of the commands it runs, until Flush is called. It's for running
+// commands concurrently with other shells without their output interleaving.
+// The copy has its own working directory, but shares the environment.
+func (s *Shell) Buffered() *Shell {
+	s.cmdLock.Lock()
+	defer s.cmdLock.Unlock()
+
+	buf := &outputBuffer{}
+
+	// Can't copy struct like `newsh := *s` because sync.Mutex can't be copied.
+	return &Shell{
+		Logger:          bufferedLogger{buf},
+		Env:             s.Env,
+		PTY:             s.PTY,
+		Writer:          bufferedWriter{buf},
+		Debug:           s.Debug,
+		wd:              s.wd,
+		ctx:             s.ctx,
+		InterruptSignal: s.InterruptSignal,
+		buffer:          buf,
+		bufferedFrom:    s,
+	}
+}
+
+// Flush writes everything a shell from Buffered has held on to so far to the
+// shell it was made from, in the order it happened
+func (s *Shell) Flush() {
+	if s.buffer == nil {
+		return
+	}
+
+	s.buffer.replay(s.bufferedFrom)
+}
+
+// outputBuffer records log lines and command output as functions to replay
+// them on another shell
+type outputBuffer struct {
+	mu      sync.Mutex
+	entries []func(*Shell)
+}
+
+func (b *outputBuffer) add(entry func(*Shell)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries = append(b.entries, entry)
+}
+
+func (b *outputBuffer) replay(s *Shell) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, entry := range b.entries {
+		entry(s)
+	}
+	b.entries = nil
+}
+
+type bufferedLogger struct {
+	*outputBuffer
+}
+
+func (l bufferedLogger) Write(p []byte) (int, error) {
+	data := append([]byte{}, p...)
+	l.add(func(s *Shell) { s.Logger.Write(data) })
+	return len(p), nil
+}
+
+func (l bufferedLogger) Printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.add(func(s *Shell) { s.Printf("%s", msg) })
+}
+
+func (l bufferedLogger) Headerf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.add(func(s *Shell) { s.Headerf("%s", msg) })
+}
+
+func (l bufferedLogger) Commentf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.add(func(s *Shell) { s.Commentf("%s", msg) })
+}
+
+func (l bufferedLogger) Errorf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.add(func(s *Shell) { s.Errorf("%s", msg) })
+}
+
+func (l bufferedLogger) Warningf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.add(func(s *Shell) { s.Warningf("%s", msg) })
+}
+
+func (l bufferedLogger) Promptf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.add(func(s *Shell) { s.Promptf("%s", msg) })
+}
+
+type bufferedWriter struct {
+	*outputBuffer
+}
+
+func (w bufferedWriter) Write(p []byte) (int, error) {
+	data := append([]byte{}, p...)
+	w.add(func(s *Shell) { s.Writer.Write(data) })
+	return len(p), nil
+}
@@ -69,6 +69,11 @@ type Shell struct {
 
 	// The signal to use to interrupt the command
 	InterruptSignal process.Signal
+
+	// For shells from Buffered, what they've held on to and the shell to
+	// flush it to
+	buffer       *outputBuffer
+	bufferedFrom *Shell
 }
 
 // New returns a new Shell
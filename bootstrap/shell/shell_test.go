@@ -444,3 +444,36 @@ func TestRound(t *testing.T) {
 		}
 	}
 }
+
+func TestBufferedShellFlushesInOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses echo")
+	}
+
+	out := &bytes.Buffer{}
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.Logger = &shell.WriterLogger{Writer: out}
+	sh.Writer = out
+
+	buffered := sh.Buffered()
+	buffered.Commentf("Checking out %s", "llamas")
+	if err := buffered.Run("echo", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing shows until it's flushed
+	sh.Commentf("Meanwhile")
+	assert.Equal(t, "# Meanwhile\n", out.String())
+
+	buffered.Flush()
+	assert.Equal(t, "# Meanwhile\n# Checking out llamas\n$ echo hi\nhi\n", out.String())
+
+	// Changing directory doesn't affect the original shell
+	if err := buffered.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, buffered.Getwd(), sh.Getwd())
+}
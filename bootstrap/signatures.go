@@ -0,0 +1,176 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	signatureVerificationWarn    = "warn"
+	signatureVerificationEnforce = "enforce"
+)
+
+// commitVerificationError is returned when the commits in the checkout can't
+// be verified as signed by a trusted key. It isn't worth retrying the checkout.
+type commitVerificationError struct {
+	error
+}
+
+func isCommitVerificationError(err error) bool {
+	_, ok := errors.Cause(err).(*commitVerificationError)
+	return ok
+}
+
+// verifyCommitSignatures checks that HEAD, or every commit since the trusted
+// base if one is configured, has a valid GPG or SSH signature from one of the
+// configured signers. In warn mode failures are only shown as a warning.
+func (b *Bootstrap) verifyCommitSignatures() error {
+	mode := b.GitVerifySignatures
+	if mode != signatureVerificationWarn && mode != signatureVerificationEnforce {
+		return &commitVerificationError{fmt.Errorf("Unknown signature verification mode %q, expected %q or %q",
+			mode, signatureVerificationWarn, signatureVerificationEnforce)}
+	}
+
+	err := b.verifyCommits()
+	if err == nil {
+		return nil
+	}
+
+	if mode == signatureVerificationWarn {
+		b.shell.Warningf("Commit signature verification failed: %v", err)
+		return nil
+	}
+
+	return &commitVerificationError{err}
+}
+
+// verifyHookCheckout verifies the signatures of the commit checked out by a
+// checkout hook, as the default checkout does, so that verification can't be
+// skipped by adding a plugin with a checkout hook
+func (b *Bootstrap) verifyHookCheckout() error {
+	if b.GitVerifySignatures == "" {
+		return nil
+	}
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	if err := b.shell.Chdir(checkoutPath); err != nil {
+		return err
+	}
+
+	if err := b.verifyCommitSignatures(); err != nil {
+		b.shell.Errorf("Commit signature verification failed! %s", err)
+		return err
+	}
+	return nil
+}
+
+// verifyCommits verifies the signatures of the commits being built. Only the
+// keys in the configured keyring and allowed signers file are trusted, not
+// those of the user the agent runs as, so without an allowed signers file no
+// SSH signatures are. The programs that check signatures are the ones the
+// agent finds, whatever the job's hooks have configured git to use.
+func (b *Bootstrap) verifyCommits() error {
+	commits := []string{"HEAD"}
+	if b.GitVerifySignaturesSince != "" {
+		var err error
+		if commits, err = gitRevList(b.shell, b.GitVerifySignaturesSince); err != nil {
+			return fmt.Errorf("Failed to find commits since %q: %v", b.GitVerifySignaturesSince, err)
+		}
+		b.shell.Commentf("Verifying signatures of %d commit(s) since %s", len(commits), b.GitVerifySignaturesSince)
+	} else {
+		b.shell.Commentf("Verifying signature of HEAD")
+	}
+
+	// Verify GPG signatures against a keyring of our own
+	gnupgHome, err := ioutil.TempDir("", "buildkite-gnupg-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gnupgHome)
+
+	if previous, exists := b.shell.Env.Get("GNUPGHOME"); exists {
+		defer b.shell.Env.Set("GNUPGHOME", previous)
+	} else {
+		defer b.shell.Env.Remove("GNUPGHOME")
+	}
+	b.shell.Env.Set("GNUPGHOME", gnupgHome)
+
+	gpg := agentProgram("gpg")
+	if b.GitGPGKeyring != "" {
+		if err := b.shell.Run(gpg, "--batch", "--quiet", "--import", b.GitGPGKeyring); err != nil {
+			return fmt.Errorf("Failed to import GPG keyring %q: %v", b.GitGPGKeyring, err)
+		}
+	}
+
+	allowedSigners := b.GitAllowedSignersFile
+	if allowedSigners == "" {
+		allowedSigners = filepath.Join(gnupgHome, "allowed_signers")
+		if err := ioutil.WriteFile(allowedSigners, nil, 0600); err != nil {
+			return err
+		}
+	}
+
+	config := []string{
+		"gpg.program=" + gpg,
+		"gpg.ssh.program=" + agentProgram("ssh-keygen"),
+		"gpg.x509.program=" + agentProgram("gpgsm"),
+		"gpg.ssh.allowedSignersFile=" + allowedSigners,
+	}
+
+	var unverified []string
+	err = b.withoutGitConfigEnv(func() error {
+		for _, commit := range commits {
+			if err := gitVerifyCommit(b.shell, config, commit); err != nil {
+				unverified = append(unverified, commit)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(unverified) > 0 {
+		return fmt.Errorf("%d commit(s) aren't signed by a trusted key: %s", len(unverified), strings.Join(unverified, ", "))
+	}
+
+	return nil
+}
+
+// agentProgram returns the path to a program in the agent's own PATH, rather
+// than the job's, which hooks can change
+func agentProgram(name string) string {
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	return name
+}
+
+// withoutGitConfigEnv calls f with the environment variables that configure
+// git, like GIT_CONFIG_PARAMETERS and GIT_CONFIG_KEY_0, removed from the
+// job's environment, so that hooks can't change how git verifies signatures
+func (b *Bootstrap) withoutGitConfigEnv(f func() error) error {
+	removed := map[string]string{}
+	for name, value := range b.shell.Env {
+		if strings.HasPrefix(name, "GIT_CONFIG") {
+			removed[name] = value
+		}
+	}
+
+	for name := range removed {
+		b.shell.Env.Remove(name)
+	}
+	defer func() {
+		for name, value := range removed {
+			b.shell.Env.Set(name, value)
+		}
+	}()
+
+	return f()
+}
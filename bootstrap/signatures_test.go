@@ -0,0 +1,188 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedRepository creates a repository with a commit signed with a new SSH
+// key followed by an unsigned one, returning the repository, the allowed
+// signers file for the key and the signed commit
+func signedRepository(t *testing.T) (repo, allowedSigners, signed string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo = filepath.Join(dir, "repo")
+	key := filepath.Join(dir, "key")
+
+	run := func(name string, args ...string) string {
+		t.Helper()
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %v: %v: %s", name, args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	run("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key)
+	pub, err := ioutil.ReadFile(key + ".pub")
+	require.NoError(t, err)
+
+	allowedSigners = filepath.Join(dir, "allowed_signers")
+	require.NoError(t, ioutil.WriteFile(allowedSigners, []byte("dev@example.com "+string(pub)), 0600))
+
+	git := []string{"-C", repo, "-c", "user.name=Dev", "-c", "user.email=dev@example.com"}
+	run("git", "init", "--quiet", repo)
+	run("git", append(git, "-c", "gpg.format=ssh", "-c", "user.signingkey="+key,
+		"commit", "--quiet", "--allow-empty", "-S", "-m", "Signed")...)
+	signed = run("git", "-C", repo, "rev-parse", "HEAD")
+	run("git", append(git, "commit", "--quiet", "--allow-empty", "--no-gpg-sign", "-m", "Unsigned")...)
+
+	return repo, allowedSigners, signed
+}
+
+func newSignatureTestBootstrap(t *testing.T, repo string, conf Config) *Bootstrap {
+	t.Helper()
+
+	sh := shell.NewTestShell(t)
+	require.NoError(t, sh.Chdir(repo))
+
+	return &Bootstrap{Config: conf, shell: sh}
+}
+
+func TestVerifyCommitSignatures(t *testing.T) {
+	t.Parallel()
+
+	repo, allowedSigners, signed := signedRepository(t)
+
+	// HEAD is the unsigned commit
+	b := newSignatureTestBootstrap(t, repo, Config{
+		GitVerifySignatures:   "enforce",
+		GitAllowedSignersFile: allowedSigners,
+	})
+	err := b.verifyCommitSignatures()
+	require.Error(t, err)
+	assert.True(t, isCommitVerificationError(err))
+	assert.Contains(t, err.Error(), "1 commit(s) aren't signed by a trusted key: HEAD")
+
+	// Warn mode lets it through
+	b.GitVerifySignatures = "warn"
+	assert.NoError(t, b.verifyCommitSignatures())
+
+	// The signed commit passes
+	_, err = b.shell.RunAndCapture("git", "checkout", "--quiet", signed)
+	require.NoError(t, err)
+	b.GitVerifySignatures = "enforce"
+	assert.NoError(t, b.verifyCommitSignatures())
+
+	// But not without the allowed signers
+	b.GitAllowedSignersFile = ""
+	assert.Error(t, b.verifyCommitSignatures())
+}
+
+func TestVerifyCommitSignaturesSince(t *testing.T) {
+	t.Parallel()
+
+	repo, allowedSigners, signed := signedRepository(t)
+
+	b := newSignatureTestBootstrap(t, repo, Config{
+		GitVerifySignatures:      "enforce",
+		GitVerifySignaturesSince: signed,
+		GitAllowedSignersFile:    allowedSigners,
+	})
+
+	head, err := b.shell.RunAndCapture("git", "rev-parse", "HEAD")
+	require.NoError(t, err)
+
+	err = b.verifyCommitSignatures()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 commit(s) aren't signed by a trusted key: "+head)
+
+	// Nothing since HEAD needs verifying
+	b.GitVerifySignaturesSince = "HEAD"
+	assert.NoError(t, b.verifyCommitSignatures())
+}
+
+func TestVerifyHookCheckout(t *testing.T) {
+	t.Parallel()
+
+	repo, allowedSigners, signed := signedRepository(t)
+
+	// The shell starts somewhere else, as it would after a checkout hook
+	b := newSignatureTestBootstrap(t, t.TempDir(), Config{
+		GitVerifySignatures:   "enforce",
+		GitAllowedSignersFile: allowedSigners,
+	})
+	b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", repo)
+
+	err := b.verifyHookCheckout()
+	require.Error(t, err)
+	assert.True(t, isCommitVerificationError(err))
+	assert.Equal(t, repo, b.shell.Getwd())
+
+	_, err = b.shell.RunAndCapture("git", "checkout", "--quiet", signed)
+	require.NoError(t, err)
+	assert.NoError(t, b.verifyHookCheckout())
+
+	// A checkout hook that doesn't leave a repository behind fails too
+	b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", t.TempDir())
+	assert.Error(t, b.verifyHookCheckout())
+
+	// Unless verification is off
+	b.GitVerifySignatures = ""
+	assert.NoError(t, b.verifyHookCheckout())
+}
+
+func TestVerifyCommitSignaturesRejectsUnknownModes(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{GitVerifySignatures: "maybe"}}
+
+	err := b.verifyCommitSignatures()
+	assert.True(t, isCommitVerificationError(err))
+	assert.EqualError(t, err, `Unknown signature verification mode "maybe", expected "warn" or "enforce"`)
+}
+
+func TestVerifyCommitSignaturesIgnoresGitConfigFromTheJob(t *testing.T) {
+	t.Parallel()
+
+	repo, allowedSigners, signed := signedRepository(t)
+
+	b := newSignatureTestBootstrap(t, repo, Config{
+		GitVerifySignatures:   "enforce",
+		GitAllowedSignersFile: allowedSigners,
+	})
+
+	// A hook that points git at a program that says every signature is good
+	fakeKeygen := filepath.Join(t.TempDir(), "ssh-keygen")
+	require.NoError(t, ioutil.WriteFile(fakeKeygen, []byte("#!/bin/sh\nexit 0\n"), 0700))
+	b.shell.Env.Set("GIT_CONFIG_COUNT", "2")
+	b.shell.Env.Set("GIT_CONFIG_KEY_0", "gpg.ssh.program")
+	b.shell.Env.Set("GIT_CONFIG_VALUE_0", fakeKeygen)
+	b.shell.Env.Set("GIT_CONFIG_KEY_1", "gpg.program")
+	b.shell.Env.Set("GIT_CONFIG_VALUE_1", fakeKeygen)
+
+	err := b.verifyCommitSignatures()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "aren't signed by a trusted key: HEAD")
+
+	// The job's configuration is left as it was
+	value, _ := b.shell.Env.Get("GIT_CONFIG_VALUE_0")
+	assert.Equal(t, fakeKeygen, value)
+
+	// Or that trusts signers the agent hasn't been configured with
+	_, err = b.shell.RunAndCapture("git", "checkout", "--quiet", signed)
+	require.NoError(t, err)
+	b.GitAllowedSignersFile = ""
+	b.shell.Env.Set("GIT_CONFIG_COUNT", "1")
+	b.shell.Env.Set("GIT_CONFIG_KEY_0", "gpg.ssh.allowedSignersFile")
+	b.shell.Env.Set("GIT_CONFIG_VALUE_0", allowedSigners)
+	assert.Error(t, b.verifyCommitSignatures())
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,7 +18,10 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/allowlist"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/bootstrap"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/experiments"
@@ -68,6 +72,8 @@ type AgentStartConfig struct {
 	BuildPath                   string   `cli:"build-path" normalize:"filepath" validate:"required"`
 	HooksPath                   string   `cli:"hooks-path" normalize:"filepath"`
 	PluginsPath                 string   `cli:"plugins-path" normalize:"filepath"`
+	PluginsStorePath            string   `cli:"plugins-store-path" normalize:"filepath"`
+	JobTmpdirRoot               string   `cli:"job-tmpdir-root" normalize:"filepath"`
 	Shell                       string   `cli:"shell"`
 	Tags                        []string `cli:"tags" normalize:"list"`
 	TagsFromEC2MetaData         bool     `cli:"tags-from-ec2-meta-data"`
@@ -84,15 +90,37 @@ type AgentStartConfig struct {
 	GitCloneMirrorFlags         string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags               string   `cli:"git-clean-flags"`
 	GitFetchFlags               string   `cli:"git-fetch-flags"`
+	GitCheckoutMode             string   `cli:"git-checkout-mode"`
+	GitCheckoutStrategy         string   `cli:"git-checkout-strategy"`
+	GitVerifySignatures         string   `cli:"git-verify-signatures"`
+	GitVerifySignaturesSince    string   `cli:"git-verify-signatures-since"`
+	GitAllowedSignersFile       string   `cli:"git-allowed-signers-file" normalize:"filepath"`
+	GitGPGKeyring               string   `cli:"git-gpg-keyring" normalize:"filepath"`
+	GitCredentials              []string `cli:"git-credentials" normalize:"list"`
+	GitCredentialsFile          string   `cli:"git-credentials-file" normalize:"filepath"`
 	GitMirrorsPath              string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout       int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate        bool     `cli:"git-mirrors-skip-update"`
+	GitMirrorsMaxSize           int      `cli:"git-mirrors-max-size"`
+	GitMirrorsMaxAge            string   `cli:"git-mirrors-max-age"`
+	GitMirrorsMaintenance       string   `cli:"git-mirrors-maintenance-interval"`
+	GitMirrorsPrefetch          []string `cli:"git-mirrors-prefetch" normalize:"list"`
+	GitMirrorsPrefetchInterval  string   `cli:"git-mirrors-prefetch-interval"`
+	GitLFSStoragePath           string   `cli:"git-lfs-storage-path" normalize:"filepath"`
+	EnvProvenanceFile           string   `cli:"env-provenance-file" normalize:"filepath"`
 	NoGitSubmodules             bool     `cli:"no-git-submodules"`
 	NoSSHKeyscan                bool     `cli:"no-ssh-keyscan"`
 	NoCommandEval               bool     `cli:"no-command-eval"`
+	CommandAllowlist            string   `cli:"command-allowlist" normalize:"filepath"`
 	NoLocalHooks                bool     `cli:"no-local-hooks"`
 	NoPlugins                   bool     `cli:"no-plugins"`
 	NoPluginValidation          bool     `cli:"no-plugin-validation"`
+	PluginsLock                 bool     `cli:"plugins-lock"`
+	PluginsLockfile             string   `cli:"plugins-lockfile" normalize:"filepath"`
+	PluginsPolicyFile           string   `cli:"plugins-policy-file" normalize:"filepath"`
+	JobPolicyFile               string   `cli:"job-policy-file" normalize:"filepath"`
+	HookTimeouts                []string `cli:"hook-timeouts" normalize:"list"`
+	HookFailurePolicies         []string `cli:"hook-failure-policies" normalize:"list"`
 	NoPTY                       bool     `cli:"no-pty"`
 	NoFeatureReporting          bool     `cli:"no-feature-reporting"`
 	TimestampLines              bool     `cli:"timestamp-lines"`
@@ -368,6 +396,44 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Flags to pass to \"git fetch\" command",
 			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
 		},
+		cli.StringFlag{
+			Name:   "git-checkout-mode",
+			Value:  "full",
+			Usage:  "How much history to fetch during checkout, one of \"full\", \"shallow\", \"blobless\" or \"treeless\"",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_MODE",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-strategy",
+			Value:  "clone",
+			Usage:  "How to create the checkout, either \"clone\" or \"worktree\" to use a worktree of the git mirror",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_STRATEGY",
+		},
+		cli.StringFlag{
+			Name:   "git-verify-signatures",
+			Value:  "",
+			Usage:  "Verify commit signatures after checkout, either \"warn\" or \"enforce\". Empty to disable",
+			EnvVar: "BUILDKITE_GIT_VERIFY_SIGNATURES",
+		},
+		cli.StringFlag{
+			Name:   "git-verify-signatures-since",
+			Value:  "",
+			Usage:  "Verify every commit since this trusted revision, rather than just HEAD",
+			EnvVar: "BUILDKITE_GIT_VERIFY_SIGNATURES_SINCE",
+		},
+		cli.StringFlag{
+			Name:   "git-allowed-signers-file",
+			Value:  "",
+			Usage:  "Path to the allowed signers file used to verify SSH commit signatures. Without one, no SSH signatures are trusted",
+			EnvVar: "BUILDKITE_GIT_ALLOWED_SIGNERS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "git-gpg-keyring",
+			Value:  "",
+			Usage:  "Path to the public keys used to verify GPG commit signatures",
+			EnvVar: "BUILDKITE_GIT_GPG_KEYRING",
+		},
+		GitCredentialsFlag,
+		GitCredentialsFileFlag,
 		cli.StringFlag{
 			Name:   "git-clone-mirror-flags",
 			Value:  "-v",
@@ -391,6 +457,38 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		GitMirrorsMaxSizeFlag,
+		GitMirrorsMaxAgeFlag,
+		cli.StringFlag{
+			Name:   "git-mirrors-maintenance-interval",
+			Value:  "",
+			Usage:  "How often to clean up and evict git mirrors in the background, for example \"6h\". Empty to disable",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAINTENANCE_INTERVAL",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-mirrors-prefetch",
+			Value:  &cli.StringSlice{},
+			Usage:  "Repositories (or files listing them, one per line) to clone git mirrors of before the agent starts accepting jobs",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PREFETCH",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-prefetch-interval",
+			Value:  "1h",
+			Usage:  "How often to update the prefetched git mirrors in the background. Empty or 0 to disable",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PREFETCH_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-storage-path",
+			Value:  "",
+			Usage:  "Path to where Git LFS objects are stored, shared between checkouts. Defaults to a directory within the git mirrors path",
+			EnvVar: "BUILDKITE_GIT_LFS_STORAGE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "env-provenance-file",
+			Value:  "",
+			Usage:  "Path to write which hooks and plugins last changed each environment variable to as JSON when each job finishes. Defaults to env-provenance.json in the agent's directory within the build path",
+			EnvVar: "BUILDKITE_ENV_PROVENANCE_FILE",
+		},
 		cli.StringFlag{
 			Name:   "bootstrap-script",
 			Value:  "",
@@ -415,6 +513,18 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Directory where the plugins are saved to",
 			EnvVar: "BUILDKITE_PLUGINS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "plugins-store-path",
+			Value:  "",
+			Usage:  "Directory of plugin archives, like docker-compose/v4.0.0.tar.gz, to use instead of cloning plugins",
+			EnvVar: "BUILDKITE_PLUGINS_STORE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "job-tmpdir-root",
+			Value:  "",
+			Usage:  "Directory to create each job's temporary directory in, like a tmpfs, defaults to the system's temporary directory",
+			EnvVar: "BUILDKITE_JOB_TMPDIR_ROOT",
+		},
 		cli.BoolFlag{
 			Name:   "timestamp-lines",
 			Usage:  "Prepend timestamps on each line of output.",
@@ -440,6 +550,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Don't allow this agent to run arbitrary console commands, including plugins",
 			EnvVar: "BUILDKITE_NO_COMMAND_EVAL",
 		},
+		cli.StringFlag{
+			Name:   "command-allowlist",
+			Value:  "",
+			Usage:  "Path to a file of glob or /regex/ patterns, one per line, that each line of a job's command must match to be run",
+			EnvVar: "BUILDKITE_COMMAND_ALLOWLIST",
+		},
 		cli.BoolFlag{
 			Name:   "no-plugins",
 			Usage:  "Don't allow this agent to load plugins",
@@ -450,6 +566,39 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Don't validate plugin configuration and requirements",
 			EnvVar: "BUILDKITE_NO_PLUGIN_VALIDATION",
 		},
+		cli.BoolFlag{
+			Name:   "plugins-lock",
+			Usage:  "Lock plugins to the commit their version resolves to in the first job of each build to use them, so later jobs can't use a different commit. Jobs that start at the same time may still use different commits",
+			EnvVar: "BUILDKITE_PLUGINS_LOCK",
+		},
+		cli.StringFlag{
+			Name:   "plugins-lockfile",
+			Value:  "",
+			Usage:  "Path to a lockfile of the commits and trees that plugins must be at, instead of locking them per build",
+			EnvVar: "BUILDKITE_PLUGINS_LOCKFILE",
+		},
+		cli.StringFlag{
+			Name:   "plugins-policy-file",
+			Value:  "",
+			Usage:  "Path to a YAML policy of the plugin repositories and versions that this agent allows or denies",
+			EnvVar: "BUILDKITE_PLUGINS_POLICY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "job-policy-file",
+			Value:  "",
+			Usage:  "Path to a YAML policy of the jobs this agent allows or refuses to run, by their repository, branch, pipeline, command, plugins and environment variables",
+			EnvVar: "BUILDKITE_JOB_POLICY_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "hook-timeouts",
+			Usage:  "How long hooks can run for, like pre-command=10m. Hooks can be limited to a plugin, like docker-compose:pre-exit=1m, or to global or local hooks, like global:pre-exit=1m",
+			EnvVar: "BUILDKITE_HOOK_TIMEOUTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "hook-failure-policies",
+			Usage:  "What happens to the job when hooks fail, like post-command=warn. Policies are fail, warn, or soft-fail, optionally with an exit status, like soft-fail:3",
+			EnvVar: "BUILDKITE_HOOK_FAILURE_POLICIES",
+		},
 		cli.BoolFlag{
 			Name:   "no-local-hooks",
 			Usage:  "Don't allow local hooks to be run from checked out repositories",
@@ -710,17 +859,36 @@ var AgentStartCommand = cli.Command{
 			GitMirrorsPath:             cfg.GitMirrorsPath,
 			GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
 			GitMirrorsSkipUpdate:       cfg.GitMirrorsSkipUpdate,
+			GitLFSStoragePath:          cfg.GitLFSStoragePath,
+			EnvProvenanceFile:          cfg.EnvProvenanceFile,
 			HooksPath:                  cfg.HooksPath,
 			PluginsPath:                cfg.PluginsPath,
+			PluginsStorePath:           cfg.PluginsStorePath,
+			JobTmpdirRoot:              cfg.JobTmpdirRoot,
 			GitCloneFlags:              cfg.GitCloneFlags,
 			GitCloneMirrorFlags:        cfg.GitCloneMirrorFlags,
 			GitCleanFlags:              cfg.GitCleanFlags,
 			GitFetchFlags:              cfg.GitFetchFlags,
+			GitCheckoutMode:            cfg.GitCheckoutMode,
+			GitCheckoutStrategy:        cfg.GitCheckoutStrategy,
+			GitVerifySignatures:        cfg.GitVerifySignatures,
+			GitVerifySignaturesSince:   cfg.GitVerifySignaturesSince,
+			GitAllowedSignersFile:      cfg.GitAllowedSignersFile,
+			GitGPGKeyring:              cfg.GitGPGKeyring,
+			GitCredentials:             cfg.GitCredentials,
+			GitCredentialsFile:         cfg.GitCredentialsFile,
 			GitSubmodules:              !cfg.NoGitSubmodules,
 			SSHKeyscan:                 !cfg.NoSSHKeyscan,
 			CommandEval:                !cfg.NoCommandEval,
+			CommandAllowlist:           cfg.CommandAllowlist,
 			PluginsEnabled:             !cfg.NoPlugins,
 			PluginValidation:           !cfg.NoPluginValidation,
+			PluginsLock:                cfg.PluginsLock,
+			PluginsLockfile:            cfg.PluginsLockfile,
+			PluginsPolicyFile:          cfg.PluginsPolicyFile,
+			JobPolicyFile:              cfg.JobPolicyFile,
+			HookTimeouts:               cfg.HookTimeouts,
+			HookFailurePolicies:        cfg.HookFailurePolicies,
 			LocalHooksEnabled:          !cfg.NoLocalHooks,
 			RunInPty:                   !cfg.NoPTY,
 			TimestampLines:             cfg.TimestampLines,
@@ -778,6 +946,13 @@ var AgentStartCommand = cli.Command{
 			l.Info("Evaluating console commands has been disabled")
 		}
 
+		if agentConf.CommandAllowlist != "" {
+			if _, err := allowlist.Load(agentConf.CommandAllowlist); err != nil {
+				l.Fatal("Failed to load command-allowlist: %v", err)
+			}
+			l.Info("Commands are limited to those in the command allowlist %s", agentConf.CommandAllowlist)
+		}
+
 		if !agentConf.PluginsEnabled {
 			l.Info("Plugins have been disabled")
 		}
@@ -799,6 +974,32 @@ var AgentStartCommand = cli.Command{
 			l.Fatal("Failed to parse cancel-signal: %v", err)
 		}
 
+		// Check the plugins policy now rather than failing every job that
+		// uses plugins
+		if agentConf.PluginsPolicyFile != "" {
+			if _, err := plugin.LoadPolicy(agentConf.PluginsPolicyFile); err != nil {
+				l.Fatal("Failed to load plugins-policy-file: %v", err)
+			}
+		}
+
+		// Likewise for the job policy, rather than refusing every job
+		if agentConf.JobPolicyFile != "" {
+			if _, err := agent.LoadJobPolicy(agentConf.JobPolicyFile); err != nil {
+				l.Fatal("Failed to load job-policy-file: %v", err)
+			}
+		}
+
+		// Every job needs somewhere to put its temporary directory
+		if agentConf.JobTmpdirRoot != "" {
+			if info, err := os.Stat(agentConf.JobTmpdirRoot); err != nil || !info.IsDir() {
+				l.Fatal("The job-tmpdir-root %q isn't a directory", agentConf.JobTmpdirRoot)
+			}
+		}
+
+		if err := bootstrap.ValidateHookSettings(agentConf.HookTimeouts, agentConf.HookFailurePolicies); err != nil {
+			l.Fatal("%v", err)
+		}
+
 		// confirm the BuildPath is exists. The bootstrap is going to write to it when a job executes,
 		// so we may as well check that'll work now and fail early if it's a problem
 		if !utils.FileExists(agentConf.BuildPath) {
@@ -888,6 +1089,64 @@ var AgentStartCommand = cli.Command{
 		signals := handlePoolSignals(l, pool)
 		defer close(signals)
 
+		// Periodically clean up git mirrors while the agents run
+		if cfg.GitMirrorsPath != "" && cfg.GitMirrorsMaintenance != "" {
+			interval, err := time.ParseDuration(cfg.GitMirrorsMaintenance)
+			if err != nil {
+				l.Fatal("Failed to parse git-mirrors-maintenance-interval: %v", err)
+			}
+
+			gcConfig, err := gitMirrorsGCConfig(cfg.GitMirrorsPath, cfg.GitMirrorsMaxSize, cfg.GitMirrorsMaxAge)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+
+			go gitMirrorsMaintenance(l, cfg, gcConfig, interval, stop)
+		}
+
+		// Warm up git mirrors before accepting any jobs, and keep them fresh
+		if len(cfg.GitMirrorsPrefetch) > 0 {
+			if !experiments.IsEnabled(`git-mirrors`) || cfg.GitMirrorsPath == "" {
+				l.Warn("Ignoring git-mirrors-prefetch, it needs the git-mirrors experiment and a git-mirrors-path")
+			} else {
+				repositories, err := gitMirrorsPrefetchRepositories(cfg.GitMirrorsPrefetch)
+				if err != nil {
+					l.Fatal("Failed to read git-mirrors-prefetch: %v", err)
+				}
+
+				var interval time.Duration
+				if cfg.GitMirrorsPrefetchInterval != "" {
+					interval, err = time.ParseDuration(cfg.GitMirrorsPrefetchInterval)
+					if err != nil {
+						l.Fatal("Failed to parse git-mirrors-prefetch-interval: %v", err)
+					}
+				}
+
+				mirrorConf := bootstrap.Config{
+					Debug:                 cfg.Debug,
+					GitMirrorsPath:        cfg.GitMirrorsPath,
+					GitMirrorsLockTimeout: cfg.GitMirrorsLockTimeout,
+					GitCloneMirrorFlags:   cfg.GitCloneMirrorFlags,
+					GitCredentials:        cfg.GitCredentials,
+					GitCredentialsFile:    cfg.GitCredentialsFile,
+				}
+
+				plog := l.WithFields(logger.StringField("git-mirrors", "prefetch"))
+				plog.Info("Prefetching git mirrors of %d repositories", len(repositories))
+				prefetchGitMirrors(plog, cfg, mirrorConf, repositories)
+
+				if interval > 0 {
+					stop := make(chan struct{})
+					defer close(stop)
+
+					go gitMirrorsRefresh(plog, cfg, mirrorConf, repositories, interval, stop)
+				}
+			}
+		}
+
 		l.Info("Starting %d Agent(s)", cfg.Spawn)
 		l.Info("You can press Ctrl-C to stop the agents")
 
@@ -954,25 +1213,105 @@ func handlePoolSignals(l logger.Logger, pool *agent.AgentPool) chan os.Signal {
 	return signals
 }
 
-// agentShutdownHook looks for an agent-shutdown hook script in the hooks path
-// and executes it if found. Output (stdout + stderr) is streamed into the main
-// agent logger. Exit status failure is logged but ignored.
-func agentShutdownHook(log logger.Logger, cfg AgentStartConfig) {
-	// search for agent-shutdown hook (including .bat & .ps1 files on Windows)
-	p, err := hook.Find(cfg.HooksPath, "agent-shutdown")
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Error("Error finding agent-shutdown hook: %v", err)
+// gitMirrorsMaintenance cleans up the git mirrors every interval until stop is
+// closed. Output is streamed into the main agent logger.
+func gitMirrorsMaintenance(log logger.Logger, cfg AgentStartConfig, gcConfig bootstrap.GitMirrorsGCConfig, interval time.Duration, stop <-chan struct{}) {
+	log = log.WithFields(logger.StringField("git-mirrors", "gc"))
+	log.Info("Cleaning up git mirrors in %s every %v", gcConfig.Path, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		sh, done, err := loggerShell(log, cfg)
+		if err != nil {
+			log.Error("creating shell for git mirrors maintenance: %v", err)
+			continue
+		}
+
+		if err := bootstrap.GCGitMirrors(sh, gcConfig); err != nil {
+			log.Error("Failed to clean up git mirrors: %v", err)
+		}
+		done()
+	}
+}
+
+// gitMirrorsPrefetchRepositories expands the git-mirrors-prefetch setting into
+// a list of repositories. Entries that are files are read as a list of
+// repositories, one per line, ignoring blank lines and # comments.
+func gitMirrorsPrefetchRepositories(entries []string) ([]string, error) {
+	var repositories []string
+
+	for _, entry := range entries {
+		if info, err := os.Stat(entry); err != nil || info.IsDir() {
+			repositories = append(repositories, entry)
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(entry)
+		if err != nil {
+			return nil, err
 		}
+
+		for _, line := range strings.Split(string(contents), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				repositories = append(repositories, line)
+			}
+		}
+	}
+
+	return repositories, nil
+}
+
+// prefetchGitMirrors clones or updates the git mirror of each repository.
+// Failures are logged rather than fatal, as jobs will clone the mirror
+// themselves if it's missing.
+func prefetchGitMirrors(log logger.Logger, cfg AgentStartConfig, mirrorConf bootstrap.Config, repositories []string) {
+	sh, done, err := loggerShell(log, cfg)
+	if err != nil {
+		log.Error("creating shell for git mirrors prefetch: %v", err)
 		return
 	}
+	defer done()
+
+	for _, repository := range repositories {
+		if _, err := bootstrap.PrefetchGitMirror(sh, mirrorConf, repository); err != nil {
+			log.Error("Failed to prefetch git mirror of %s: %v", repository, err)
+		}
+	}
+}
+
+// gitMirrorsRefresh prefetches the git mirrors every interval until stop is
+// closed
+func gitMirrorsRefresh(log logger.Logger, cfg AgentStartConfig, mirrorConf bootstrap.Config, repositories []string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			prefetchGitMirrors(log, cfg, mirrorConf, repositories)
+		}
+	}
+}
+
+// loggerShell returns a shell whose output is streamed into the logger, one
+// line at a time, along with a func to call once the shell is finished with
+func loggerShell(log logger.Logger, cfg AgentStartConfig) (*shell.Shell, func(), error) {
 	sh, err := shell.New()
 	if err != nil {
-		log.Error("creating shell for agent-shutdown hook: %v", err)
-		return
+		return nil, nil, err
 	}
 
-	// pipe from hook output to logger
+	// pipe from shell output to logger
 	r, w := io.Pipe()
 	sh.Logger = &shell.WriterLogger{Writer: w, Ansi: !cfg.NoColor} // for Promptf
 	sh.Writer = w                                                  // for stdout+stderr
@@ -981,19 +1320,41 @@ func agentShutdownHook(log logger.Logger, cfg AgentStartConfig) {
 	go func() {
 		defer wg.Done()
 		scan := bufio.NewScanner(r) // log each line separately
-		log = log.WithFields(logger.StringField("hook", "agent-shutdown"))
 		for scan.Scan() {
 			log.Info(scan.Text())
 		}
 	}()
 
+	return sh, func() {
+		w.Close() // goroutine scans until pipe is closed
+		wg.Wait()
+	}, nil
+}
+
+// agentShutdownHook looks for an agent-shutdown hook script in the hooks path
+// and executes it if found. Output (stdout + stderr) is streamed into the main
+// agent logger. Exit status failure is logged but ignored.
+func agentShutdownHook(log logger.Logger, cfg AgentStartConfig) {
+	// search for agent-shutdown hook (including .bat & .ps1 files on Windows)
+	p, err := hook.Find(cfg.HooksPath, "agent-shutdown")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Error finding agent-shutdown hook: %v", err)
+		}
+		return
+	}
+	sh, done, err := loggerShell(log.WithFields(logger.StringField("hook", "agent-shutdown")), cfg)
+	if err != nil {
+		log.Error("creating shell for agent-shutdown hook: %v", err)
+		return
+	}
+
 	// run agent-shutdown hook
 	sh.Promptf("%s", p)
 	if err = sh.RunScript(context.Background(), p, nil); err != nil {
 		log.Error("agent-shutdown hook: %v", err)
 	}
-	w.Close() // goroutine scans until pipe is closed
 
-	// wait for hook to finish and output to flush to logger
-	wg.Wait()
+	// wait for output to flush to logger
+	done()
 }
@@ -72,3 +72,19 @@ func TestAgentShutdownHook(t *testing.T) {
 		assert.Equal(t, []string{}, log.Messages)
 	})
 }
+
+func TestGitMirrorsPrefetchRepositories(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "repositories")
+	err := ioutil.WriteFile(list, []byte("# Monorepos\ngit@github.com:buildkite/agent.git\n\n  https://github.com/buildkite/docs.git  \n"), 0600)
+	assert.NoError(t, err)
+
+	repositories, err := gitMirrorsPrefetchRepositories([]string{"git@github.com:buildkite/cli.git", list, dir})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"git@github.com:buildkite/cli.git",
+		"git@github.com:buildkite/agent.git",
+		"https://github.com/buildkite/docs.git",
+		dir,
+	}, repositories)
+}
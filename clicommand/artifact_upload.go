@@ -44,6 +44,22 @@ Example:
 
    $ export BUILDKITE_S3_SESSION_TOKEN=zzz
 
+   Or to an S3 compatible store, like MinIO or Ceph RGW, at a custom endpoint,
+   most of which need the bucket in the path rather than the host name:
+
+   $ export BUILDKITE_S3_ENDPOINT=https://minio.example.com
+   $ export BUILDKITE_S3_FORCE_PATH_STYLE=true
+   $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-bucket/$BUILDKITE_JOB_ID
+
+   Artifacts bigger than 64MiB are uploaded to S3 and Google Cloud Storage in
+   parts, 4 at a time, which are retried on their own. If an upload fails part
+   way through, it's resumed from where it was up to when it's retried, and
+   if it's given up on, the parts that were uploaded are deleted. Both can be
+   changed:
+
+   $ export BUILDKITE_ARTIFACT_UPLOAD_PART_SIZE=134217728 # in bytes
+   $ export BUILDKITE_ARTIFACT_UPLOAD_PART_CONCURRENCY=8
+
    Or upload directly to Google Cloud Storage:
 
    $ export BUILDKITE_GS_ACL=private
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap"
 	"github.com/buildkite/agent/v3/cliconfig"
@@ -62,10 +63,24 @@ type BootstrapConfig struct {
 	AutomaticArtifactUploadPaths string   `cli:"artifact-upload-paths"`
 	ArtifactUploadDestination    string   `cli:"artifact-upload-destination"`
 	CleanCheckout                bool     `cli:"clean-checkout"`
+	ChangedPathsBase             string   `cli:"changed-paths-base"`
 	GitCloneFlags                string   `cli:"git-clone-flags"`
 	GitFetchFlags                string   `cli:"git-fetch-flags"`
 	GitCloneMirrorFlags          string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags                string   `cli:"git-clean-flags"`
+	GitCheckoutMode              string   `cli:"git-checkout-mode"`
+	GitCheckoutStrategy          string   `cli:"git-checkout-strategy"`
+	GitVerifySignatures          string   `cli:"git-verify-signatures"`
+	GitVerifySignaturesSince     string   `cli:"git-verify-signatures-since"`
+	GitAllowedSignersFile        string   `cli:"git-allowed-signers-file" normalize:"filepath"`
+	GitGPGKeyring                string   `cli:"git-gpg-keyring" normalize:"filepath"`
+	GitCredentials               []string `cli:"git-credentials" normalize:"list"`
+	GitCredentialsFile           string   `cli:"git-credentials-file" normalize:"filepath"`
+	GitLFS                       bool     `cli:"git-lfs"`
+	GitLFSInclude                string   `cli:"git-lfs-include"`
+	GitLFSExclude                string   `cli:"git-lfs-exclude"`
+	GitLFSStoragePath            string   `cli:"git-lfs-storage-path" normalize:"filepath"`
+	GitSparseCheckoutPaths       string   `cli:"git-sparse-checkout-paths"`
 	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate         bool     `cli:"git-mirrors-skip-update"`
@@ -73,19 +88,30 @@ type BootstrapConfig struct {
 	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
 	PluginsPath                  string   `cli:"plugins-path" normalize:"filepath"`
+	PluginsStorePath             string   `cli:"plugins-store-path" normalize:"filepath"`
+	JobTmpdirRoot                string   `cli:"job-tmpdir-root" normalize:"filepath"`
 	CommandEval                  bool     `cli:"command-eval"`
+	CommandAllowlist             string   `cli:"command-allowlist" normalize:"filepath"`
 	PluginsEnabled               bool     `cli:"plugins-enabled"`
 	PluginValidation             bool     `cli:"plugin-validation"`
 	PluginsAlwaysCloneFresh      bool     `cli:"plugins-always-clone-fresh"`
+	PluginsLock                  bool     `cli:"plugins-lock"`
+	PluginsLockfile              string   `cli:"plugins-lockfile" normalize:"filepath"`
+	PluginsPolicyFile            string   `cli:"plugins-policy-file" normalize:"filepath"`
 	LocalHooksEnabled            bool     `cli:"local-hooks-enabled"`
 	PTY                          bool     `cli:"pty"`
 	LogLevel                     string   `cli:"log-level"`
 	Debug                        bool     `cli:"debug"`
+	DebugEnv                     bool     `cli:"debug-env"`
+	EnvProvenanceFile            string   `cli:"env-provenance-file" normalize:"filepath"`
 	Shell                        string   `cli:"shell"`
 	Experiments                  []string `cli:"experiment" normalize:"list"`
 	Phases                       []string `cli:"phases" normalize:"list"`
 	Profile                      string   `cli:"profile"`
 	CancelSignal                 string   `cli:"cancel-signal"`
+	CancelGracePeriod            int      `cli:"cancel-grace-period"`
+	HookTimeouts                 []string `cli:"hook-timeouts" normalize:"list"`
+	HookFailurePolicies          []string `cli:"hook-failure-policies" normalize:"list"`
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
 	TracingBackend               string   `cli:"tracing-backend"`
 }
@@ -196,6 +222,12 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Whether or not the bootstrap should remove the existing repository before running the command",
 			EnvVar: "BUILDKITE_CLEAN_CHECKOUT",
 		},
+		cli.StringFlag{
+			Name:   "changed-paths-base",
+			Value:  "",
+			Usage:  "Comma-separated strategies for the revision to find changed paths against (pull-request, meta-data:<key>, or a git revision)",
+			EnvVar: "BUILDKITE_CHANGED_PATHS_BASE",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-flags",
 			Value:  "-v",
@@ -214,6 +246,73 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Flags to pass to \"git clean\" command",
 			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
 		},
+		cli.StringFlag{
+			Name:   "git-checkout-mode",
+			Value:  "",
+			Usage:  "How much history to fetch during checkout, one of \"full\", \"shallow\", \"blobless\" or \"treeless\"",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_MODE",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-strategy",
+			Value:  "",
+			Usage:  "How to create the checkout, either \"clone\" or \"worktree\" to use a worktree of the git mirror",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_STRATEGY",
+		},
+		cli.StringFlag{
+			Name:   "git-verify-signatures",
+			Value:  "",
+			Usage:  "Verify commit signatures after checkout, either \"warn\" or \"enforce\"",
+			EnvVar: "BUILDKITE_GIT_VERIFY_SIGNATURES",
+		},
+		cli.StringFlag{
+			Name:   "git-verify-signatures-since",
+			Value:  "",
+			Usage:  "Verify every commit since this trusted revision, rather than just HEAD",
+			EnvVar: "BUILDKITE_GIT_VERIFY_SIGNATURES_SINCE",
+		},
+		cli.StringFlag{
+			Name:   "git-allowed-signers-file",
+			Value:  "",
+			Usage:  "Path to the allowed signers file used to verify SSH commit signatures. Without one, no SSH signatures are trusted",
+			EnvVar: "BUILDKITE_GIT_ALLOWED_SIGNERS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "git-gpg-keyring",
+			Value:  "",
+			Usage:  "Path to the public keys used to verify GPG commit signatures",
+			EnvVar: "BUILDKITE_GIT_GPG_KEYRING",
+		},
+		GitCredentialsFlag,
+		GitCredentialsFileFlag,
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Fetch and checkout Git LFS objects after checkout",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-include",
+			Value:  "",
+			Usage:  "Comma-separated paths of Git LFS objects to fetch, defaults to all of them",
+			EnvVar: "BUILDKITE_GIT_LFS_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-exclude",
+			Value:  "",
+			Usage:  "Comma-separated paths of Git LFS objects not to fetch",
+			EnvVar: "BUILDKITE_GIT_LFS_EXCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-storage-path",
+			Value:  "",
+			Usage:  "Path to where Git LFS objects are stored, shared between checkouts. Defaults to a directory within the git mirrors path",
+			EnvVar: "BUILDKITE_GIT_LFS_STORAGE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  "",
+			Usage:  "Directories to limit the checkout to using cone-mode \"git sparse-checkout\", separated by commas",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
 		cli.StringFlag{
 			Name:   "git-fetch-flags",
 			Value:  "",
@@ -261,11 +360,29 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Directory where the plugins are saved to",
 			EnvVar: "BUILDKITE_PLUGINS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "plugins-store-path",
+			Value:  "",
+			Usage:  "Directory of plugin archives, like docker-compose/v4.0.0.tar.gz, to use instead of cloning plugins",
+			EnvVar: "BUILDKITE_PLUGINS_STORE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "job-tmpdir-root",
+			Value:  "",
+			Usage:  "Directory to create each job's temporary directory in, like a tmpfs, defaults to the system's temporary directory",
+			EnvVar: "BUILDKITE_JOB_TMPDIR_ROOT",
+		},
 		cli.BoolTFlag{
 			Name:   "command-eval",
 			Usage:  "Allow running of arbitrary commands",
 			EnvVar: "BUILDKITE_COMMAND_EVAL",
 		},
+		cli.StringFlag{
+			Name:   "command-allowlist",
+			Value:  "",
+			Usage:  "Path to a file of glob or /regex/ patterns, one per line, that each line of a command must match to be run",
+			EnvVar: "BUILDKITE_COMMAND_ALLOWLIST",
+		},
 		cli.BoolTFlag{
 			Name:   "plugins-enabled",
 			Usage:  "Allow plugins to be run",
@@ -281,6 +398,23 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Always make a new clone of plugin source, even if already present",
 			EnvVar: "BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH",
 		},
+		cli.BoolFlag{
+			Name:   "plugins-lock",
+			Usage:  "Lock plugins to the commit their version resolves to in the first job of the build to use them",
+			EnvVar: "BUILDKITE_PLUGINS_LOCK",
+		},
+		cli.StringFlag{
+			Name:   "plugins-lockfile",
+			Value:  "",
+			Usage:  "Path to a lockfile of the commits and trees that plugins must be at",
+			EnvVar: "BUILDKITE_PLUGINS_LOCKFILE",
+		},
+		cli.StringFlag{
+			Name:   "plugins-policy-file",
+			Value:  "",
+			Usage:  "Path to a YAML policy of the plugin repositories and versions that are allowed or denied",
+			EnvVar: "BUILDKITE_PLUGINS_POLICY_FILE",
+		},
 		cli.BoolTFlag{
 			Name:   "local-hooks-enabled",
 			Usage:  "Allow local hooks to be run",
@@ -318,6 +452,22 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
 			Value:  "SIGTERM",
 		},
+		cli.IntFlag{
+			Name:   "cancel-grace-period",
+			Value:  10,
+			Usage:  "The number of seconds a hook that has timed out is given to finish after being interrupted, before it's terminated",
+			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
+		},
+		cli.StringSliceFlag{
+			Name:   "hook-timeouts",
+			Usage:  "How long hooks can run for, like pre-command=10m. Hooks can be limited to a plugin, like docker-compose:pre-exit=1m, or to global or local hooks, like global:pre-exit=1m",
+			EnvVar: "BUILDKITE_HOOK_TIMEOUTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "hook-failure-policies",
+			Usage:  "What happens to the job when hooks fail, like post-command=warn. Policies are fail, warn, or soft-fail, optionally with an exit status, like soft-fail:3",
+			EnvVar: "BUILDKITE_HOOK_FAILURE_POLICIES",
+		},
 		cli.StringSliceFlag{
 			Name:   "redacted-vars",
 			Usage:  "Pattern of environment variable names containing sensitive values",
@@ -329,6 +479,17 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_TRACING_BACKEND",
 			Value:  "",
 		},
+		cli.BoolFlag{
+			Name:   "debug-env",
+			Usage:  "Show which hooks and plugins last changed each environment variable when the job finishes",
+			EnvVar: "BUILDKITE_DEBUG_ENV",
+		},
+		cli.StringFlag{
+			Name:   "env-provenance-file",
+			Value:  "",
+			Usage:  "Path to write which hooks and plugins last changed each environment variable to as JSON when the job finishes. Defaults to env-provenance.json in the agent's directory within the build path",
+			EnvVar: "BUILDKITE_ENV_PROVENANCE_FILE",
+		},
 		DebugFlag,
 		LogLevelFlag,
 		ExperimentsFlag,
@@ -345,6 +506,14 @@ var BootstrapCommand = cli.Command{
 			os.Exit(1)
 		}
 
+		// The git credentials are in the config now, so remove them from the
+		// environment, where anything that can read this process's
+		// environment could find them
+		if err := os.Unsetenv("BUILDKITE_GIT_CREDENTIALS"); err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
 		l := CreateLogger(&cfg)
 
 		// Now that we have a logger, log out the warnings that loading config generated
@@ -382,6 +551,10 @@ var BootstrapCommand = cli.Command{
 			l.Fatal("Failed to parse cancel-signal: %v", err)
 		}
 
+		if err := bootstrap.ValidateHookSettings(cfg.HookTimeouts, cfg.HookFailurePolicies); err != nil {
+			l.Fatal("%v", err)
+		}
+
 		// Configure the bootstraper
 		bootstrap := bootstrap.New(bootstrap.Config{
 			AgentName:                    cfg.AgentName,
@@ -390,12 +563,17 @@ var BootstrapCommand = cli.Command{
 			BinPath:                      cfg.BinPath,
 			Branch:                       cfg.Branch,
 			BuildPath:                    cfg.BuildPath,
+			CancelGracePeriod:            time.Duration(cfg.CancelGracePeriod) * time.Second,
 			CancelSignal:                 cancelSig,
+			ChangedPathsBase:             cfg.ChangedPathsBase,
 			CleanCheckout:                cfg.CleanCheckout,
 			Command:                      cfg.Command,
 			CommandEval:                  cfg.CommandEval,
+			CommandAllowlist:             cfg.CommandAllowlist,
 			Commit:                       cfg.Commit,
 			Debug:                        cfg.Debug,
+			DebugEnv:                     cfg.DebugEnv,
+			EnvProvenanceFile:            cfg.EnvProvenanceFile,
 			GitCleanFlags:                cfg.GitCleanFlags,
 			GitCloneFlags:                cfg.GitCloneFlags,
 			GitCloneMirrorFlags:          cfg.GitCloneMirrorFlags,
@@ -403,9 +581,25 @@ var BootstrapCommand = cli.Command{
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
+			GitCheckoutMode:              cfg.GitCheckoutMode,
+			GitCheckoutStrategy:          cfg.GitCheckoutStrategy,
+			GitVerifySignatures:          cfg.GitVerifySignatures,
+			GitVerifySignaturesSince:     cfg.GitVerifySignaturesSince,
+			GitAllowedSignersFile:        cfg.GitAllowedSignersFile,
+			GitGPGKeyring:                cfg.GitGPGKeyring,
+			GitCredentials:               cfg.GitCredentials,
+			GitCredentialsFile:           cfg.GitCredentialsFile,
+			GitLFS:                       cfg.GitLFS,
+			GitLFSInclude:                cfg.GitLFSInclude,
+			GitLFSExclude:                cfg.GitLFSExclude,
+			GitLFSStoragePath:            cfg.GitLFSStoragePath,
+			GitSparseCheckoutPaths:       cfg.GitSparseCheckoutPaths,
 			GitSubmodules:                cfg.GitSubmodules,
+			HookFailurePolicies:          cfg.HookFailurePolicies,
+			HookTimeouts:                 cfg.HookTimeouts,
 			HooksPath:                    cfg.HooksPath,
 			JobID:                        cfg.JobID,
+			JobTmpdirRoot:                cfg.JobTmpdirRoot,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
 			OrganizationSlug:             cfg.OrganizationSlug,
 			Phases:                       cfg.Phases,
@@ -415,7 +609,11 @@ var BootstrapCommand = cli.Command{
 			Plugins:                      cfg.Plugins,
 			PluginsEnabled:               cfg.PluginsEnabled,
 			PluginsAlwaysCloneFresh:      cfg.PluginsAlwaysCloneFresh,
+			PluginsLock:                  cfg.PluginsLock,
+			PluginsLockfile:              cfg.PluginsLockfile,
+			PluginsPolicyFile:            cfg.PluginsPolicyFile,
 			PluginsPath:                  cfg.PluginsPath,
+			PluginsStorePath:             cfg.PluginsStorePath,
 			PullRequest:                  cfg.PullRequest,
 			Queue:                        cfg.Queue,
 			RedactedVars:                 cfg.RedactedVars,
@@ -0,0 +1,154 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var GitMirrorsGCHelpDescription = `Usage:
+
+   buildkite-agent git-mirrors gc [options...]
+
+Description:
+
+   Cleans up the git mirrors created by the git-mirrors experiment.
+
+   Each mirror has stale refs and the worktrees of removed checkouts pruned,
+   and git's own maintenance run over it (falling back to "git gc --auto" on
+   older versions of git). Mirrors that haven't been used by a checkout for
+   longer than --git-mirrors-max-age are removed, and then the least recently
+   used mirrors are removed until the total size is under
+   --git-mirrors-max-size.
+
+   The same locks as the checkout are used, so this is safe to run while jobs
+   are running. Mirrors that are locked are skipped, as are mirrors that have
+   worktrees checked out, although a job that's using a mirror when it's
+   removed may still fail. The agent can also do this periodically with
+   --git-mirrors-maintenance-interval.
+
+Example:
+
+   $ buildkite-agent git-mirrors gc --git-mirrors-max-size 10240 --git-mirrors-max-age 720h`
+
+type GitMirrorsGCConfig struct {
+	Config            string `cli:"config"`
+	GitMirrorsPath    string `cli:"git-mirrors-path" normalize:"filepath" validate:"required"`
+	GitMirrorsMaxSize int    `cli:"git-mirrors-max-size"`
+	GitMirrorsMaxAge  string `cli:"git-mirrors-max-age"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var GitMirrorsMaxSizeFlag = cli.IntFlag{
+	Name:   "git-mirrors-max-size",
+	Value:  0,
+	Usage:  "The total size in megabytes that git mirrors can use before the least recently used are removed, 0 for no limit",
+	EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_SIZE",
+}
+
+var GitMirrorsMaxAgeFlag = cli.StringFlag{
+	Name:   "git-mirrors-max-age",
+	Value:  "",
+	Usage:  "Remove git mirrors that haven't been used for this long, for example \"720h\". Empty for no limit",
+	EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_AGE",
+}
+
+var GitMirrorsGCCommand = cli.Command{
+	Name:        "gc",
+	Usage:       "Clean up and evict git mirrors",
+	Description: GitMirrorsGCHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		GitMirrorsMaxSizeFlag,
+		GitMirrorsMaxAgeFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := GitMirrorsGCConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		gcConfig, err := gitMirrorsGCConfig(cfg.GitMirrorsPath, cfg.GitMirrorsMaxSize, cfg.GitMirrorsMaxAge)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		sh, err := shell.New()
+		if err != nil {
+			l.Fatal("Failed to create shell: %v", err)
+		}
+		sh.Logger = &shell.WriterLogger{Writer: os.Stderr, Ansi: !cfg.NoColor}
+
+		if err := bootstrap.GCGitMirrors(sh, gcConfig); err != nil {
+			l.Fatal("Failed to clean up git mirrors: %v", err)
+		}
+	},
+}
+
+// gitMirrorsGCConfig builds the git mirrors maintenance configuration from
+// command line options
+func gitMirrorsGCConfig(path string, maxSizeMB int, maxAge string) (bootstrap.GitMirrorsGCConfig, error) {
+	cfg := bootstrap.GitMirrorsGCConfig{
+		Path:    path,
+		MaxSize: int64(maxSizeMB) * 1024 * 1024,
+	}
+
+	if maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return cfg, fmt.Errorf("Failed to parse git-mirrors-max-age: %v", err)
+		}
+		cfg.MaxAge = d
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,133 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/allowlist"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/urfave/cli"
+)
+
+var PipelineLintHelpDescription = `Usage:
+
+   buildkite-agent pipeline lint [file] [options...]
+
+Description:
+
+   Checks the commands in a pipeline against a command allowlist, the same
+   way agents started with --command-allowlist check them before running
+   them, so that pipelines can be checked before they're uploaded. The
+   pipeline is found the same way as for "buildkite-agent pipeline upload".
+
+   Every line of each step's command has to match one of the patterns in the
+   allowlist. The command exits with a status of 1 if any don't.
+
+Example:
+
+   $ buildkite-agent pipeline lint --command-allowlist /etc/buildkite-agent/allowlist
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline lint --command-allowlist allowlist`
+
+type PipelineLintConfig struct {
+	FilePath         string `cli:"arg:0" label:"lint paths"`
+	CommandAllowlist string `cli:"command-allowlist" normalize:"filepath" validate:"required"`
+	NoInterpolation  bool   `cli:"no-interpolation"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var PipelineLintCommand = cli.Command{
+	Name:        "lint",
+	Usage:       "Checks the commands in a pipeline against a command allowlist",
+	Description: PipelineLintHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "command-allowlist",
+			Value:  "",
+			Usage:  "Path to a file of glob or /regex/ patterns, one per line, that each line of a command must match",
+			EnvVar: "BUILDKITE_COMMAND_ALLOWLIST",
+		},
+		cli.BoolFlag{
+			Name:   "no-interpolation",
+			Usage:  "Skip variable interpolation of the pipeline before it's checked",
+			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := PipelineLintConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		list, err := allowlist.Load(cfg.CommandAllowlist)
+		if err != nil {
+			l.Fatal("Failed to load command-allowlist: %v", err)
+		}
+
+		input, filename := readPipelineInput(l, cfg.FilePath, "lint")
+		if len(input) == 0 {
+			l.Fatal("Config file is empty")
+		}
+
+		src := filename
+		if src == "" {
+			src = "(stdin)"
+		}
+
+		result, err := agent.PipelineParser{
+			Env:             env.FromSlice(os.Environ()),
+			Filename:        filename,
+			Pipeline:        input,
+			NoInterpolation: cfg.NoInterpolation,
+		}.Parse()
+		if err != nil {
+			l.Fatal("Pipeline parsing of \"%s\" failed (%s)", src, err)
+		}
+
+		failures := 0
+		for _, command := range result.Commands() {
+			for _, line := range allowlist.Lines(command.Command) {
+				if !list.Allowed(line) {
+					l.Error("Step %q runs %q, which doesn't match any pattern in the command allowlist", command.Step, line)
+					failures++
+				}
+			}
+		}
+
+		if failures > 0 {
+			l.Fatal("Pipeline %q has %d command(s) that aren't allowed", src, failures)
+		}
+
+		l.Info("All of the commands in pipeline %q are allowed", src)
+	},
+}
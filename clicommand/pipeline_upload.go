@@ -16,6 +16,7 @@ import (
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/redaction"
 	"github.com/buildkite/agent/v3/stdin"
 	"github.com/buildkite/roko"
@@ -45,6 +46,16 @@ Description:
    You can also pipe build pipelines to the command allowing you to create
    scripts that generate dynamic pipelines.
 
+   Steps (and group steps) can have an "if_changed" attribute containing a glob
+   or list of globs. If the bootstrap has found the paths changed by the build
+   (see --changed-paths-base on the bootstrap command), any step whose globs
+   don't match a changed path is removed before the pipeline is uploaded.
+   Steps that depend on a removed step no longer depend on it.
+
+   Pipelines larger than --max-upload-size are uploaded in several batches,
+   in order. Group steps, and steps that depend on steps later in the
+   pipeline, are never split across batches.
+
 Example:
 
    $ buildkite-agent pipeline upload
@@ -59,6 +70,8 @@ type PipelineUploadConfig struct {
 	NoInterpolation bool     `cli:"no-interpolation"`
 	RedactedVars    []string `cli:"redacted-vars" normalize:"list"`
 	RejectSecrets   bool     `cli:"reject-secrets"`
+	ChangedPaths    string   `cli:"changed-paths-file" normalize:"filepath"`
+	MaxUploadSize   int      `cli:"max-upload-size"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -105,6 +118,18 @@ var PipelineUploadCommand = cli.Command{
 			Usage:  "When true, fail the pipeline upload early if the pipeline contains secrets",
 			EnvVar: "BUILDKITE_AGENT_PIPELINE_UPLOAD_REJECT_SECRETS",
 		},
+		cli.StringFlag{
+			Name:   "changed-paths-file",
+			Value:  "",
+			Usage:  "A file listing the paths changed by this build, one per line, used to filter steps with if_changed",
+			EnvVar: "BUILDKITE_CHANGED_PATHS_FILE",
+		},
+		cli.IntFlag{
+			Name:   "max-upload-size",
+			Value:  1024 * 1024,
+			Usage:  "Pipelines larger than this many bytes are split into batches that are uploaded one after the other",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_MAX_SIZE",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
@@ -142,69 +167,13 @@ var PipelineUploadCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		if cfg.MaxUploadSize <= 0 {
+			l.Fatal("Invalid max-upload-size %d, it must be a positive number of bytes", cfg.MaxUploadSize)
+		}
+
 		// Find the pipeline file either from STDIN or the first
 		// argument
-		var input []byte
-		var filename string
-
-		if cfg.FilePath != "" {
-			l.Info("Reading pipeline config from \"%s\"", cfg.FilePath)
-
-			filename = filepath.Base(cfg.FilePath)
-			input, err = ioutil.ReadFile(cfg.FilePath)
-			if err != nil {
-				l.Fatal("Failed to read file: %s", err)
-			}
-		} else if stdin.IsReadable() {
-			l.Info("Reading pipeline config from STDIN")
-
-			// Actually read the file from STDIN
-			input, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				l.Fatal("Failed to read from STDIN: %s", err)
-			}
-		} else {
-			l.Info("Searching for pipeline config...")
-
-			paths := []string{
-				"buildkite.yml",
-				"buildkite.yaml",
-				"buildkite.json",
-				filepath.FromSlash(".buildkite/pipeline.yml"),
-				filepath.FromSlash(".buildkite/pipeline.yaml"),
-				filepath.FromSlash(".buildkite/pipeline.json"),
-				filepath.FromSlash("buildkite/pipeline.yml"),
-				filepath.FromSlash("buildkite/pipeline.yaml"),
-				filepath.FromSlash("buildkite/pipeline.json"),
-			}
-
-			// Collect all the files that exist
-			exists := []string{}
-			for _, path := range paths {
-				if _, err := os.Stat(path); err == nil {
-					exists = append(exists, path)
-				}
-			}
-
-			// If more than 1 of the config files exist, throw an
-			// error. There can only be one!!
-			if len(exists) > 1 {
-				l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
-			} else if len(exists) == 0 {
-				l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
-			}
-
-			found := exists[0]
-
-			l.Info("Found config file \"%s\"", found)
-
-			// Read the default file
-			filename = path.Base(found)
-			input, err = ioutil.ReadFile(found)
-			if err != nil {
-				l.Fatal("Failed to read file \"%s\" (%s)", found, err)
-			}
-		}
+		input, filename := readPipelineInput(l, cfg.FilePath, "upload")
 
 		// Make sure the file actually has something in it
 		if len(input) == 0 {
@@ -242,6 +211,28 @@ var PipelineUploadCommand = cli.Command{
 			l.Fatal("Pipeline parsing of \"%s\" failed (%s)", src, err)
 		}
 
+		// Remove any steps that don't apply to the paths changed by this build
+		if result.HasIfChanged() {
+			var changed []string
+			if cfg.ChangedPaths != "" {
+				changed, err = readChangedPaths(cfg.ChangedPaths)
+				if err != nil {
+					l.Fatal("Failed to read changed paths from %q (%s)", cfg.ChangedPaths, err)
+				}
+				l.Info("Filtering steps with if_changed against %d changed paths", len(changed))
+			} else {
+				l.Warn("Pipeline %q has steps with if_changed, but no changed paths are available so all steps will be uploaded", src)
+			}
+
+			dropped, err := result.FilterIfChanged(changed)
+			if err != nil {
+				l.Fatal("Pipeline filtering of \"%s\" failed (%s)", src, err)
+			}
+			for _, step := range dropped {
+				l.Info("Skipping step %q, none of its if_changed paths have changed", step)
+			}
+		}
+
 		if len(cfg.RedactedVars) > 0 {
 			needles := redaction.GetKeyValuesToRedact(shell.StderrLogger, cfg.RedactedVars, env.FromSlice(os.Environ()))
 			serialisedPipeline, err := result.MarshalJSON()
@@ -297,28 +288,65 @@ var PipelineUploadCommand = cli.Command{
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
-		// Generate a UUID that will identify this pipeline change. We
-		// do this outside of the retry loop because we want this UUID
+		// Very large pipelines are split into batches that are uploaded one
+		// after the other, so that each request stays under the size limit
+		batches, err := result.Split(cfg.MaxUploadSize)
+		if err != nil {
+			l.Fatal("Failed to split pipeline \"%s\" into batches (%s)", src, err)
+		}
+		if len(batches) > 1 {
+			l.Info("Pipeline is larger than %d bytes, uploading it in %d batches", cfg.MaxUploadSize, len(batches))
+		}
+
+		// Generate a UUID that will identify each pipeline change. We
+		// do this outside of the retry loop because we want these UUIDs
 		// to be the same for each attempt at updating the pipeline.
-		uuid := api.NewUUID()
+		uploads := make([]*api.Pipeline, 0, len(batches))
+		for i, batch := range batches {
+			uploads = append(uploads, &api.Pipeline{
+				UUID:     api.NewUUID(),
+				Pipeline: batch,
+				// Only the first batch replaces the rest of the pipeline,
+				// otherwise each batch would replace the one before it
+				Replace: cfg.Replace && i == 0,
+			})
+		}
 
-		// Retry the pipeline upload a few times before giving up
+		// Retry the pipeline upload a few times before giving up. The batches
+		// are retried as a unit: each attempt carries on from the first batch
+		// that hasn't been uploaded yet, and as every batch keeps its UUID
+		// between attempts, a batch that reached Buildkite before a failure
+		// can't be applied twice.
+		uploaded := 0
 		err = roko.NewRetrier(
 			roko.WithMaxAttempts(60),
 			roko.WithStrategy(roko.Constant(5*time.Second)),
 		).Do(func(r *roko.Retrier) error {
-			_, err = client.UploadPipeline(cfg.Job, &api.Pipeline{UUID: uuid, Pipeline: result, Replace: cfg.Replace})
-			if err != nil {
-				l.Warn("%s (%s)", err, r)
+			for uploaded < len(uploads) {
+				_, err = client.UploadPipeline(cfg.Job, uploads[uploaded])
+				if err != nil {
+					if len(uploads) > 1 {
+						l.Warn("Batch %d of %d: %s (%s)", uploaded+1, len(uploads), err, r)
+					} else {
+						l.Warn("%s (%s)", err, r)
+					}
+
+					// 422 responses will always fail no need to retry
+					if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Response.StatusCode == 422 {
+						l.Error("Unrecoverable error, skipping retries")
+						r.Break()
+					}
+
+					return err
+				}
 
-				// 422 responses will always fail no need to retry
-				if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Response.StatusCode == 422 {
-					l.Error("Unrecoverable error, skipping retries")
-					r.Break()
+				uploaded++
+				if len(uploads) > 1 {
+					l.Info("Uploaded batch %d of %d", uploaded, len(uploads))
 				}
 			}
 
-			return err
+			return nil
 			// On a server error, it means there is downtime or other problems, we
 			// need to retry. Let's retry every 5 seconds, for a total of 5 minutes.
 		})
@@ -330,3 +358,87 @@ var PipelineUploadCommand = cli.Command{
 		l.Info("Successfully uploaded and parsed pipeline config")
 	},
 }
+
+// readPipelineInput reads a pipeline from a file, STDIN, or the first of the
+// default pipeline files that exists, returning it and its file name
+func readPipelineInput(l logger.Logger, filePath, command string) (input []byte, filename string) {
+	var err error
+
+	if filePath != "" {
+		l.Info("Reading pipeline config from \"%s\"", filePath)
+
+		filename = filepath.Base(filePath)
+		input, err = ioutil.ReadFile(filePath)
+		if err != nil {
+			l.Fatal("Failed to read file: %s", err)
+		}
+	} else if stdin.IsReadable() {
+		l.Info("Reading pipeline config from STDIN")
+
+		// Actually read the file from STDIN
+		input, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			l.Fatal("Failed to read from STDIN: %s", err)
+		}
+	} else {
+		l.Info("Searching for pipeline config...")
+
+		paths := []string{
+			"buildkite.yml",
+			"buildkite.yaml",
+			"buildkite.json",
+			filepath.FromSlash(".buildkite/pipeline.yml"),
+			filepath.FromSlash(".buildkite/pipeline.yaml"),
+			filepath.FromSlash(".buildkite/pipeline.json"),
+			filepath.FromSlash("buildkite/pipeline.yml"),
+			filepath.FromSlash("buildkite/pipeline.yaml"),
+			filepath.FromSlash("buildkite/pipeline.json"),
+		}
+
+		// Collect all the files that exist
+		exists := []string{}
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				exists = append(exists, path)
+			}
+		}
+
+		// If more than 1 of the config files exist, throw an
+		// error. There can only be one!!
+		if len(exists) > 1 {
+			l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
+		} else if len(exists) == 0 {
+			l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline %s --help` for more information.", command)
+		}
+
+		found := exists[0]
+
+		l.Info("Found config file \"%s\"", found)
+
+		// Read the default file
+		filename = path.Base(found)
+		input, err = ioutil.ReadFile(found)
+		if err != nil {
+			l.Fatal("Failed to read file \"%s\" (%s)", found, err)
+		}
+	}
+
+	return input, filename
+}
+
+// readChangedPaths reads a file with one path per line, ignoring blank lines
+func readChangedPaths(file string) ([]string, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			paths = append(paths, filepath.ToSlash(line))
+		}
+	}
+
+	return paths, nil
+}
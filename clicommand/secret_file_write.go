@@ -0,0 +1,131 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var SecretFileWriteHelpDescription = `Usage:
+
+   buildkite-agent secret-file write <name> [options...]
+
+Description:
+
+   Writes a secret read from STDIN to a file that only the agent's user can
+   read, within the job's temporary directory, and prints its path. The file is
+   removed along with the rest of the job's temporary directory when the job
+   finishes, even if it's cancelled.
+
+   Secrets are read from STDIN rather than given as arguments so that they
+   don't show up in the list of running processes.
+
+Example:
+
+   $ echo "$DEPLOY_KEY" | buildkite-agent secret-file write deploy-key
+   $ ssh -i "$(buildkite-agent secret-file write deploy-key < key.pem)" deploy@host`
+
+type SecretFileWriteConfig struct {
+	Name      string `cli:"arg:0" label:"secret file name" validate:"required"`
+	JobTmpdir string `cli:"job-tmpdir" normalize:"filepath" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var SecretFileWriteCommand = cli.Command{
+	Name:        "write",
+	Usage:       "Write a secret to a file in the job's temporary directory",
+	Description: SecretFileWriteHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job-tmpdir",
+			Value:  "",
+			Usage:  "The job's temporary directory, which the secret file is written within",
+			EnvVar: "BUILDKITE_JOB_TMPDIR",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SecretFileWriteConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		path, err := writeSecretFile(cfg.JobTmpdir, cfg.Name, os.Stdin)
+		if err != nil {
+			l.Fatal("Failed to write secret file: %v", err)
+		}
+
+		// The path is the output, so it can be used in a command substitution
+		fmt.Println(path)
+	},
+}
+
+// writeSecretFile writes a secret to a file only readable by the current
+// user, within a secrets directory in the job's temporary directory, and
+// returns its path. Secrets are written to a temporary file and moved into
+// place, so they're never partially written or readable by anyone else.
+func writeSecretFile(jobTmpdir, name string, r io.Reader) (string, error) {
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%q isn't a valid secret file name, it can't be a path", name)
+	}
+
+	dir := filepath.Join(jobTmpdir, "secrets")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,57 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSecretFile(t *testing.T) {
+	t.Parallel()
+
+	jobTmpdir := t.TempDir()
+
+	path, err := writeSecretFile(jobTmpdir, "deploy-key", strings.NewReader("llamas"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(jobTmpdir, "secrets", "deploy-key"), path)
+
+	// Writing it again replaces it
+	path, err = writeSecretFile(jobTmpdir, "deploy-key", strings.NewReader("alpacas"))
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "alpacas", string(data))
+
+	// Nothing else is left in the secrets directory
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		info, err = os.Stat(filepath.Dir(path))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+}
+
+func TestWriteSecretFileRejectsPaths(t *testing.T) {
+	t.Parallel()
+
+	jobTmpdir := t.TempDir()
+
+	for _, name := range []string{"../escape", "nested/key", `nested\key`, ".", ".."} {
+		_, err := writeSecretFile(jobTmpdir, name, strings.NewReader("llamas"))
+		assert.Error(t, err, name)
+	}
+}
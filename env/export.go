@@ -10,7 +10,6 @@ var (
 	//                                                             ^
 	//                                                             |
 	//                                           all of the available options for declare
-	endsWithUnescapedQuoteRegex = regexp.MustCompile("([^\\\\]\"\\z|\\A\"\\z)")
 
 	// There are a bunch of types of bash variable that we want to ignore, becuase supporting them
 	// is either a pain, or useless, or both.
@@ -81,7 +80,7 @@ func FromExport(body string) Environment {
 
 				// If it ends with an unescaped quote `"`, then
 				// that's the end of the variable!
-				if endsWithUnescapedQuoteRegex.MatchString(line) {
+				if endsWithUnescapedQuote(line) {
 					// Join all the lines together
 					joinedLines := strings.Join(openKeyValue, "\n")
 
@@ -136,7 +135,7 @@ func FromExport(body string) Environment {
 				// If the value ends with an unescaped quote,
 				// then we know it's a single line environment
 				// variable (see example 1)
-				if endsWithUnescapedQuoteRegex.MatchString(val) {
+				if endsWithUnescapedQuote(val) {
 					// Remove the `"` at the end
 					singleLineValueWithQuoteRemoved := strings.TrimSuffix(val, `"`)
 
@@ -167,6 +166,28 @@ func FromExport(body string) Environment {
 	return FromSlice(lines)
 }
 
+// FromNulDelimited parses environment variables from a NUL separated dump of
+// them, like the output of `env -0`. Unlike an export, there's no quoting to
+// undo, so values come back exactly as they were, newlines and all.
+func FromNulDelimited(body string) Environment {
+	return FromSlice(strings.Split(strings.TrimSuffix(body, "\x00"), "\x00"))
+}
+
+// endsWithUnescapedQuote returns whether a line ends with a quote that isn't
+// escaped, which is one preceded by an even number of backslashes, so that
+// values ending with a backslash, like "C:\\", are closed properly
+func endsWithUnescapedQuote(line string) bool {
+	if !strings.HasSuffix(line, `"`) {
+		return false
+	}
+
+	backslashes := 0
+	for i := len(line) - 2; i >= 0 && line[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 0
+}
+
 func containsDisallowedOpts(opts string) bool {
 	for _, opt := range opts {
 		if _, present := disallowedDeclareOpts[opt]; present {
@@ -177,21 +198,24 @@ func containsDisallowedOpts(opts string) bool {
 	return false
 }
 
+// unquoteShell removes the backslashes that shells escape the characters
+// that are special within double quotes with: backslashes, dollars, double
+// quotes and backticks. Other backslashes are left alone.
 func unquoteShell(value string) string {
-	// Turn things like \\n back into \n
-	value = strings.Replace(value, `\\`, `\`, -1)
-
-	// Shells escape $ cause of environment variable interpolation
-	value = strings.Replace(value, `\$`, `$`, -1)
-
-	// They also escape double quotes when showing a value within double
-	// quotes, for example, "this is a \" quote string"
-	value = strings.Replace(value, `\"`, `"`, -1)
+	if !strings.Contains(value, `\`) {
+		return value
+	}
 
-	// Replace a literal escaped backtick (\`) with just a backtick (`)
-	// Some variables (like passwords) can contain backticks that should be interpreted as literal backticks, rather than
-	// as the beginning of a subcommand
-	value = strings.Replace(value, "\\`", "`", -1)
+	var unquoted strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			switch value[i+1] {
+			case '\\', '$', '"', '`':
+				i++
+			}
+		}
+		unquoted.WriteByte(value[i])
+	}
 
-	return value
+	return unquoted.String()
 }
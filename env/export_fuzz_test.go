@@ -0,0 +1,88 @@
+package env
+
+import (
+	"strings"
+	"testing"
+)
+
+// declareExport formats variables the way bash's `export -p` does
+func declareExport(vars [][2]string) string {
+	var lines []string
+	for _, v := range vars {
+		value := strings.NewReplacer(`\`, `\\`, `$`, `\$`, `"`, `\"`, "`", "\\`").Replace(v[1])
+		lines = append(lines, `declare -x `+v[0]+`="`+value+`"`)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func nulDelimited(vars [][2]string) string {
+	var body strings.Builder
+	for _, v := range vars {
+		body.WriteString(v[0] + "=" + v[1] + "\x00")
+	}
+	return body.String()
+}
+
+var exportFuzzSeeds = []string{
+	"",
+	"llamas",
+	"multi\nline\nvalue",
+	`ends with a backslash \`,
+	`C:\`,
+	"ends with a quote \"\nand a new line \"",
+	`i love $money and \$escaped money`,
+	"look at this -----> ` <----- cool backtick",
+	`{"json": "inside", "with": ["a", "list"]}`,
+	"declare -x LOOKS_LIKE=\"another variable\"",
+	"trailing newline\n",
+	`\\"\`,
+}
+
+func FuzzFromNulDelimited(f *testing.F) {
+	for _, seed := range exportFuzzSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		if strings.ContainsRune(value, 0) {
+			t.Skip("values can't contain NUL")
+		}
+
+		vars := [][2]string{{"BEFORE", "before"}, {"FUZZ", value}, {"AFTER", "after"}}
+		env := FromNulDelimited(nulDelimited(vars))
+
+		if got, _ := env.Get("FUZZ"); got != value {
+			t.Fatalf("FromNulDelimited parsed %q as %q", value, got)
+		}
+		if env.Length() != 3 {
+			t.Fatalf("FromNulDelimited parsed %d variables, expected 3: %v", env.Length(), env)
+		}
+	})
+}
+
+// FromExport is kept for shells that can't dump their environment NUL
+// separated, so it should agree with FromNulDelimited on anything bash exports
+func FuzzFromExportMatchesFromNulDelimited(f *testing.F) {
+	for _, seed := range exportFuzzSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		if strings.ContainsAny(value, "\x00\r") {
+			t.Skip("values can't contain NUL, and exports have their line endings normalized")
+		}
+
+		vars := [][2]string{{"BEFORE", "before"}, {"FUZZ", value}, {"AFTER", "after"}}
+		fromExport := FromExport(declareExport(vars))
+		fromNul := FromNulDelimited(nulDelimited(vars))
+
+		if len(fromExport) != len(fromNul) {
+			t.Fatalf("FromExport parsed %v, FromNulDelimited parsed %v", fromExport, fromNul)
+		}
+		for k, v := range fromNul {
+			if got, _ := fromExport.Get(k); got != v {
+				t.Fatalf("FromExport parsed %s as %q, FromNulDelimited parsed it as %q", k, got, v)
+			}
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+)
+
+const (
+	hookEnvFileEnv        = "BUILDKITE_HOOK_ENV_FILE"
+	hookWorkingDirFileEnv = "BUILDKITE_HOOK_WORKING_DIR_FILE"
+)
+
+// Interpreters of scripts that are run directly, optionally with a version,
+// like python3.11. Scripts for any other interpreter are sourced like any
+// other hook, as they might be for a shell the agent doesn't know about, like
+// "#!/usr/local/bin/bash5" or "#!/bin/busybox sh", and sourcing them is the
+// only way to see what they export. Plugins can run those directly by listing
+// them in executable_hooks.
+var executableInterpreterRegex = regexp.MustCompile(`\A(?:python|ruby|node|nodejs|perl|php|lua|deno|bun|pwsh|Rscript)[0-9.]*\z`)
+
+// Magic numbers at the start of compiled programs: ELF, Mach-O (32 and 64
+// bit, both byte orders, and universal binaries) and Windows PE
+var executableMagics = [][]byte{
+	[]byte("\x7fELF"),
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe},
+	{0xcf, 0xfa, 0xed, 0xfe},
+	{0xca, 0xfe, 0xba, 0xbe},
+	[]byte("MZ"),
+}
+
+// IsExecutable returns whether a hook should be run directly, rather than
+// sourced by a shell. Those are hooks that are compiled programs, hooks with
+// an .exe extension, and scripts for one of the interpreters that are known
+// not to be shells, like "#!/usr/bin/env python3".
+func IsExecutable(path string) bool {
+	if strings.EqualFold(filepath.Ext(path), ".exe") {
+		return true
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head, err := bufio.NewReader(f).Peek(256)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return false
+	}
+
+	for _, magic := range executableMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return false
+	}
+
+	line := string(head[2:])
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	// Look past env to what it runs, like "#!/usr/bin/env -S python3 -u"
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interpreter = filepath.Base(field)
+				break
+			}
+		}
+	}
+
+	return executableInterpreterRegex.MatchString(interpreter)
+}
+
+// ExecutableWrapper provides the files that a hook that's run directly, and
+// so can't be sourced, writes the changes it makes to. The hook is given their
+// paths in BUILDKITE_HOOK_ENV_FILE and BUILDKITE_HOOK_WORKING_DIR_FILE.
+//
+// The environment file is a JSON object of the variables to set, with null
+// for those to unset, like {"FOO": "bar", "BAZ": null}. The working directory
+// file is a JSON string of the directory to change to. A hook that doesn't
+// change either leaves the file empty.
+type ExecutableWrapper struct {
+	hookPath       string
+	envFile        *os.File
+	workingDirFile *os.File
+}
+
+// NewExecutableWrapper creates the files for a hook to write its changes to
+func NewExecutableWrapper(hookPath string) (*ExecutableWrapper, error) {
+	wrap := &ExecutableWrapper{hookPath: hookPath}
+
+	var err error
+	wrap.envFile, err = shell.TempFileWithExtension(`buildkite-agent-bootstrap-hook-env.json`)
+	if err != nil {
+		return nil, err
+	}
+	wrap.envFile.Close()
+
+	wrap.workingDirFile, err = shell.TempFileWithExtension(`buildkite-agent-bootstrap-hook-working-dir.json`)
+	if err != nil {
+		os.Remove(wrap.envFile.Name())
+		return nil, err
+	}
+	wrap.workingDirFile.Close()
+
+	return wrap, nil
+}
+
+// Env returns the environment variables to run the hook with, which tell it
+// where to write its changes
+func (wrap *ExecutableWrapper) Env() env.Environment {
+	return env.Environment{
+		hookEnvFileEnv:        wrap.envFile.Name(),
+		hookWorkingDirFileEnv: wrap.workingDirFile.Name(),
+	}
+}
+
+// Close cleans up the files the hook wrote its changes to
+func (wrap *ExecutableWrapper) Close() {
+	os.Remove(wrap.envFile.Name())
+	os.Remove(wrap.workingDirFile.Name())
+}
+
+// Changes returns the changes the hook wrote, compared to the environment it
+// was run with
+func (wrap *ExecutableWrapper) Changes(before env.Environment) (HookScriptChanges, error) {
+	diff := env.Diff{
+		Added:   map[string]string{},
+		Changed: map[string]env.DiffPair{},
+		Removed: map[string]struct{}{},
+	}
+
+	var vars map[string]*string
+	if err := wrap.readJSON(wrap.envFile.Name(), hookEnvFileEnv, &vars); err != nil {
+		return HookScriptChanges{}, err
+	}
+
+	for name, value := range vars {
+		old, exists := before.Get(name)
+		switch {
+		case value == nil:
+			if exists {
+				diff.Removed[name] = struct{}{}
+			}
+		case !exists:
+			diff.Added[name] = *value
+		case old != *value:
+			diff.Changed[name] = env.DiffPair{Old: old, New: *value}
+		}
+	}
+
+	var afterWd string
+	if err := wrap.readJSON(wrap.workingDirFile.Name(), hookWorkingDirFileEnv, &afterWd); err != nil {
+		return HookScriptChanges{}, err
+	}
+
+	return HookScriptChanges{Diff: diff, afterWd: afterWd}, nil
+}
+
+// readJSON parses a file the hook wrote, if it wrote anything
+func (wrap *ExecutableWrapper) readJSON(filename, envName string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to read \"%s\" (%s)", filename, err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Hook %q wrote invalid JSON to %s (%s)", wrap.hookPath, envName, err)
+	}
+
+	return nil
+}
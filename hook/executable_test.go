@@ -0,0 +1,111 @@
+package hook
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsExecutable(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		filename   string
+		contents   string
+		executable bool
+	}{
+		{"bash", "environment", "#!/bin/bash\nexport LLAMAS=rock\n", false},
+		{"env bash", "environment", "#!/usr/bin/env bash\nexport LLAMAS=rock\n", false},
+		{"sh with flags", "environment", "#!/bin/sh -e\nexport LLAMAS=rock\n", false},
+		{"no shebang", "environment", "export LLAMAS=rock\n", false},
+		{"batch", "environment.bat", "@echo off\r\nset LLAMAS=rock\r\n", false},
+		{"empty", "environment", "", false},
+		{"python", "environment", "#!/usr/bin/python3\nprint('hi')\n", true},
+		{"env python", "environment", "#!/usr/bin/env python3\r\nprint('hi')\r\n", true},
+		{"env with flags", "environment", "#!/usr/bin/env -S ruby -w\nputs 'hi'\n", true},
+		{"versioned python", "environment", "#!/usr/local/bin/python3.11\nprint('hi')\n", true},
+		{"node", "environment", "#!/usr/bin/env node\nconsole.log('hi')\n", true},
+		{"unknown shell", "environment", "#!/usr/local/bin/bash5\nexport LLAMAS=rock\n", false},
+		{"busybox", "environment", "#!/bin/busybox sh\nexport LLAMAS=rock\n", false},
+		{"unknown interpreter", "environment", "#!/usr/bin/env fish\nset -x LLAMAS rock\n", false},
+		{"elf", "environment", "\x7fELF\x02\x01\x01\x00", true},
+		{"mach-o", "environment", "\xcf\xfa\xed\xfe\x07\x00\x00\x01", true},
+		{"exe", "environment.exe", "", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), tc.filename)
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.contents), 0700))
+
+			assert.Equal(t, tc.executable, IsExecutable(path))
+		})
+	}
+}
+
+func TestExecutableWrapperChanges(t *testing.T) {
+	t.Parallel()
+
+	wrapper, err := NewExecutableWrapper("/hooks/environment")
+	require.NoError(t, err)
+	defer wrapper.Close()
+
+	hookEnv := wrapper.Env()
+	envFile, _ := hookEnv.Get("BUILDKITE_HOOK_ENV_FILE")
+	wdFile, _ := hookEnv.Get("BUILDKITE_HOOK_WORKING_DIR_FILE")
+
+	require.NoError(t, ioutil.WriteFile(envFile, []byte(`{"LLAMAS":"rock","ALPACAS":"are ok","UNCHANGED":"same","GONE":null,"NEVER_SET":null}`), 0600))
+	require.NoError(t, ioutil.WriteFile(wdFile, []byte(`"/tmp/elsewhere"`), 0600))
+
+	changes, err := wrapper.Changes(env.FromSlice([]string{
+		"ALPACAS=are meh",
+		"UNCHANGED=same",
+		"GONE=soon",
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, env.Diff{
+		Added:   map[string]string{"LLAMAS": "rock"},
+		Changed: map[string]env.DiffPair{"ALPACAS": {Old: "are meh", New: "are ok"}},
+		Removed: map[string]struct{}{"GONE": {}},
+	}, changes.Diff)
+
+	wd, err := changes.GetAfterWd()
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/elsewhere", wd)
+}
+
+func TestExecutableWrapperWithoutChanges(t *testing.T) {
+	t.Parallel()
+
+	wrapper, err := NewExecutableWrapper("/hooks/environment")
+	require.NoError(t, err)
+	defer wrapper.Close()
+
+	changes, err := wrapper.Changes(env.FromSlice([]string{"LLAMAS=rock"}))
+	require.NoError(t, err)
+	assert.True(t, changes.Diff.Empty())
+
+	_, err = changes.GetAfterWd()
+	assert.Error(t, err)
+}
+
+func TestExecutableWrapperRejectsInvalidJSON(t *testing.T) {
+	t.Parallel()
+
+	wrapper, err := NewExecutableWrapper("/hooks/environment")
+	require.NoError(t, err)
+	defer wrapper.Close()
+
+	envFile, _ := wrapper.Env().Get("BUILDKITE_HOOK_ENV_FILE")
+	require.NoError(t, ioutil.WriteFile(envFile, []byte("LLAMAS=rock\n"), 0600))
+
+	_, err = wrapper.Changes(env.New())
+	assert.EqualError(t, err, `Hook "/hooks/environment" wrote invalid JSON to BUILDKITE_HOOK_ENV_FILE (invalid character 'L' looking for beginning of value)`)
+}
@@ -1,9 +1,11 @@
 package hook
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/utils"
@@ -14,7 +16,7 @@ import (
 func Find(hookDir string, name string) (string, error) {
 	if runtime.GOOS == "windows" {
 		// check for windows types first
-		if p, err := shell.LookPath(name, hookDir, ".BAT;.CMD;.PS1"); err == nil {
+		if p, err := shell.LookPath(name, hookDir, ".BAT;.CMD;.PS1;.EXE"); err == nil {
 			return p, nil
 		}
 	}
@@ -26,3 +28,34 @@ func Find(hookDir string, name string) (string, error) {
 	// For example, os.IfNotExist(err) does not handle wrapped errors.
 	return "", os.ErrNotExist
 }
+
+// FindAll returns the absolute paths to all of the hook files for a name in a
+// path, in the order they're run. That's the hook file Find returns, followed
+// by the files in a directory named after the hook, like environment.d, in
+// lexical order. Hidden files in the directory are ignored. It returns
+// os.ErrNotExist if there aren't any.
+func FindAll(hookDir string, name string) ([]string, error) {
+	var paths []string
+
+	if p, err := Find(hookDir, name); err == nil {
+		paths = append(paths, p)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(hookDir, name+".d"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// ReadDir sorts the entries by name
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(hookDir, name+".d", entry.Name()))
+	}
+
+	if len(paths) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return paths, nil
+}
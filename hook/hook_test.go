@@ -0,0 +1,46 @@
+package hook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindAll(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "environment.d", "nested"), 0777))
+
+	for _, name := range []string{
+		"environment",
+		"environment.d/20-team",
+		"environment.d/10-security",
+		"environment.d/.10-security.swp",
+		"environment.d/nested/30-ignored",
+		"pre-command.d/10-platform",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/bash\n"), 0700))
+	}
+
+	paths, err := FindAll(dir, "environment")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "environment"),
+		filepath.Join(dir, "environment.d", "10-security"),
+		filepath.Join(dir, "environment.d", "20-team"),
+	}, paths)
+
+	paths, err = FindAll(dir, "pre-command")
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "pre-command.d", "10-platform")}, paths)
+
+	_, err = FindAll(dir, "post-command")
+	assert.True(t, os.IsNotExist(err))
+}
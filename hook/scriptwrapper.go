@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"text/template"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
@@ -35,11 +36,13 @@ $Env:BUILDKITE_HOOK_WORKING_DIR = $PWD | Select-Object -ExpandProperty Path
 Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "{{.AfterEnvFileName}}"
 exit $Env:BUILDKITE_HOOK_EXIT_STATUS`
 
-	bashScript = `export -p > "{{.BeforeEnvFileName}}"
+	// The environment is dumped NUL separated where env supports it, which
+	// can be parsed without ambiguity, and exported otherwise
+	bashScript = `env -0 > "{{.BeforeEnvFileName}}" 2>/dev/null || export -p > "{{.BeforeEnvFileName}}"
 . "{{.PathToHook}}"
 export BUILDKITE_HOOK_EXIT_STATUS=$?
 export BUILDKITE_HOOK_WORKING_DIR=$PWD
-export -p > "{{.AfterEnvFileName}}"
+env -0 > "{{.AfterEnvFileName}}" 2>/dev/null || export -p > "{{.AfterEnvFileName}}"
 exit $BUILDKITE_HOOK_EXIT_STATUS`
 )
 
@@ -230,8 +233,8 @@ func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 		return HookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", wrap.afterEnvFile.Name(), err)
 	}
 
-	beforeEnv := env.FromExport(string(beforeEnvContents))
-	afterEnv := env.FromExport(string(afterEnvContents))
+	beforeEnv := parseEnvDump(string(beforeEnvContents))
+	afterEnv := parseEnvDump(string(afterEnvContents))
 
 	if afterEnv.Length() == 0 {
 		return HookScriptChanges{}, &HookExitError{hookPath: wrap.hookPath}
@@ -258,3 +261,23 @@ func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 
 	return HookScriptChanges{Diff: diff, afterWd: afterWd}, nil
 }
+
+// parseEnvDump parses an environment written by a wrapper script, either NUL
+// separated by `env -0`, or by `export -p` or `SET` if that wasn't available
+func parseEnvDump(body string) env.Environment {
+	if !strings.Contains(body, "\x00") {
+		return env.FromExport(body)
+	}
+
+	environ := env.FromNulDelimited(body)
+
+	// Bash exports functions as variables, which export -p never showed, and
+	// which we don't want to carry over into the job's environment
+	for name := range environ {
+		if strings.HasPrefix(name, "BASH_FUNC_") {
+			environ.Remove(name)
+		}
+	}
+
+	return environ
+}
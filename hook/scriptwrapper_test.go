@@ -70,6 +70,49 @@ func TestRunningHookDetectsChangedEnvironment(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestRunningHookDetectsChangedEnvironmentLosslessly(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported on windows")
+	}
+
+	ctx := context.Background()
+
+	wrapper := newTestScriptWrapper(t, []string{
+		"#!/bin/bash",
+		`export WINDOWS_PATH='C:\'`,
+		`export QUOTED='"quoted" \"escaped\" $dollars and ` + "`backticks`" + `'`,
+		`export MULTILINE="first line`,
+		`declare -x LOOKS_LIKE=\"another variable\"`,
+		`last line"`,
+		"llamas() { echo rock; }",
+		"export -f llamas",
+	})
+	defer os.Remove(wrapper.Path())
+
+	sh := shell.NewTestShell(t)
+
+	if err := sh.RunScript(ctx, wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, env.Diff{
+		Added: map[string]string{
+			"WINDOWS_PATH": `C:\`,
+			"QUOTED":       `"quoted" \"escaped\" $dollars and ` + "`backticks`",
+			"MULTILINE":    "first line\n" + `declare -x LOOKS_LIKE="another variable"` + "\nlast line",
+		},
+		Changed: map[string]env.DiffPair{},
+		Removed: map[string]struct{}{},
+	}, changes.Diff)
+}
+
 func TestHookScriptsAreGeneratedCorrectlyOnWindowsBatch(t *testing.T) {
 	t.Parallel()
 
@@ -152,11 +195,11 @@ func TestHookScriptsAreGeneratedCorrectlyOnUnix(t *testing.T) {
 
 	defer wrapper.Close()
 
-	scriptTemplate := `export -p > "%s"
-. "%s"
+	scriptTemplate := `env -0 > "%[1]s" 2>/dev/null || export -p > "%[1]s"
+. "%[2]s"
 export BUILDKITE_HOOK_EXIT_STATUS=$?
 export BUILDKITE_HOOK_WORKING_DIR=$PWD
-export -p > "%s"
+env -0 > "%[3]s" 2>/dev/null || export -p > "%[3]s"
 exit $BUILDKITE_HOOK_EXIT_STATUS`
 
 	assertScriptLike(t, scriptTemplate, hookFile.Name(), wrapper)
@@ -80,6 +80,14 @@ func main() {
 				clicommand.ArtifactShasumCommand,
 			},
 		},
+		clicommand.GitCredentialsCommand,
+		{
+			Name:  "git-mirrors",
+			Usage: "Manage the git mirrors used by the git-mirrors experiment",
+			Subcommands: []cli.Command{
+				clicommand.GitMirrorsGCCommand,
+			},
+		},
 		{
 			Name:  "meta-data",
 			Usage: "Get/set data from Buildkite jobs",
@@ -95,6 +103,14 @@ func main() {
 			Usage: "Make changes to the pipeline of the currently running build",
 			Subcommands: []cli.Command{
 				clicommand.PipelineUploadCommand,
+				clicommand.PipelineLintCommand,
+			},
+		},
+		{
+			Name:  "secret-file",
+			Usage: "Write secrets to files that are removed when the job finishes",
+			Subcommands: []cli.Command{
+				clicommand.SecretFileWriteCommand,
 			},
 		},
 		{